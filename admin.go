@@ -0,0 +1,64 @@
+package rwtxt
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/schollz/logger"
+)
+
+// adminPaths are served by the admin listener when Config.AdminBind is set,
+// and by the main listener otherwise.
+var adminPaths = map[string]bool{
+	"/healthz":         true,
+	"/api/v1/domains":  true,
+	"/api/v1/domains/": true,
+	"/api/v1/debug":    true,
+}
+
+func isAdminPath(path string) bool {
+	return adminPaths[path]
+}
+
+// serveAdmin listens on Config.AdminBind for the admin paths only.
+func (rwt *RWTxt) serveAdmin() error {
+	log.Infof("admin listening on %v", rwt.Config.AdminBind)
+	return rwt.adminServer.ListenAndServe()
+}
+
+// AdminHandler serves the health check and the admin API.
+func (rwt *RWTxt) AdminHandler(w http.ResponseWriter, r *http.Request) {
+	t := time.Now().UTC()
+	err := rwt.handleAdmin(w, r)
+	if err != nil {
+		log.Error(err)
+	}
+	log.Infof("admin %v %v %v %s", r.RemoteAddr, r.Method, r.URL.Path, time.Since(t))
+}
+
+func (rwt *RWTxt) handleAdmin(w http.ResponseWriter, r *http.Request) (err error) {
+	if !isAdminPath(r.URL.Path) {
+		http.NotFound(w, r)
+		return
+	}
+	if r.URL.Path == "/healthz" {
+		return rwt.handleHealthz(w, r)
+	}
+	key := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if r.URL.Path == "/api/v1/debug" {
+		return rwt.handleAPIDebug(w, r, key)
+	}
+	return rwt.handleAPIDomains(w, r, key)
+}
+
+// handleHealthz reports whether the database can be reached and queried, for
+// load balancers. It needs no key.
+func (rwt *RWTxt) handleHealthz(w http.ResponseWriter, r *http.Request) (err error) {
+	w.Header().Set("Cache-Control", "no-store")
+	if errPing := rwt.fs.Ping(r.Context()); errPing != nil {
+		log.Error(errPing)
+		return writeAPIJSON(w, http.StatusServiceUnavailable, APIHealth{Status: "error", Error: errPing.Error()})
+	}
+	return writeAPIJSON(w, http.StatusOK, APIHealth{Status: "ok"})
+}
@@ -0,0 +1,646 @@
+package rwtxt
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"argc.in/scratch/pkg/db"
+	log "github.com/schollz/logger"
+)
+
+// APIPage is the metadata of a page returned by the API, without its contents.
+// Pages listed since a cursor may be in the trash, with Deleted set.
+type APIPage struct {
+	ID        string     `json:"id"`
+	Slug      string     `json:"slug"`
+	Title     string     `json:"title"`
+	Created   time.Time  `json:"created"`
+	Modified  time.Time  `json:"modified"`
+	Views     int        `json:"views"`
+	Deleted   bool       `json:"deleted,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// APIDomain is the summary of a domain returned by the admin API.
+type APIDomain struct {
+	Name    string     `json:"name"`
+	Public  bool       `json:"public"`
+	Pages   int        `json:"pages"`
+	Created *time.Time `json:"created,omitempty"`
+}
+
+// APIDebug is the size of the database and the plans of its main queries,
+// for operators to tune large instances.
+type APIDebug struct {
+	db.DBStats
+	Domain     string         `json:"domain"`
+	QueryPlans []db.QueryPlan `json:"query_plans"`
+}
+
+// APIDictionary is the custom dictionary of a domain, or the words to add to it.
+type APIDictionary struct {
+	Words []string `json:"words"`
+}
+
+// APIHealth is the answer of /healthz, with the error of the database when its
+// Status isn't ok.
+type APIHealth struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// APIStats is the usage of a domain and its quotas, zero when unlimited.
+type APIStats struct {
+	Pages       int   `json:"pages"`
+	PageBytes   int64 `json:"page_bytes"`
+	UploadBytes int64 `json:"upload_bytes"`
+	MaxPages    int   `json:"max_pages"`
+	MaxBytes    int64 `json:"max_bytes"`
+	MaxWrites   int   `json:"max_writes_per_minute"`
+}
+
+// APIPageList is a list of the pages modified since a cursor, with the cursor
+// listing the pages modified since the last of them.
+type APIPageList struct {
+	Pages      []APIPage `json:"pages"`
+	NextCursor string    `json:"next_cursor"`
+	HasMore    bool      `json:"has_more"`
+}
+
+// APIPageInput is the body of requests creating or updating a page, fields
+// left out of an update are kept.
+type APIPageInput struct {
+	Slug *string `json:"slug"`
+	Data *string `json:"data"`
+}
+
+// APICreated is returned when a page is created.
+type APICreated struct {
+	ID   string `json:"id"`
+	Slug string `json:"slug"`
+}
+
+type apiError struct {
+	Message string `json:"message"`
+}
+
+// handleAPI serves the JSON API under /api/v1/{domain}/..., the admin API under
+// /api/v1/domains is routed by handleAdmin. Pages are created with POST to
+// /pages, and read, updated and deleted with GET, PUT and DELETE to
+// /pages/{id}.
+func (rwt *RWTxt) handleAPI(w http.ResponseWriter, r *http.Request) (err error) {
+	fields := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	key := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if len(fields) < 4 || fields[1] != "v1" {
+		return writeAPIError(w, http.StatusNotFound, "not found")
+	}
+	domain := strings.TrimSpace(strings.ToLower(fields[2]))
+
+	// authenticate using the domain key
+	if key == "" {
+		return writeAPIError(w, http.StatusUnauthorized, "missing api key")
+	}
+	_, keyDomain, keyErr := rwt.fs.CheckKey(key)
+	if keyErr != nil || keyDomain != domain {
+		return writeAPIError(w, http.StatusUnauthorized, "invalid api key")
+	}
+
+	if fields[3] == "pages" && len(fields) == 4 {
+		switch r.Method {
+		case http.MethodGet:
+			return rwt.handleAPIPages(w, r, domain)
+		case http.MethodPost:
+			return rwt.handleAPICreatePage(w, r, domain)
+		}
+		return writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+	if fields[3] == "pages" && len(fields) == 5 {
+		switch r.Method {
+		case http.MethodGet:
+			return rwt.handleAPIGetPage(w, r, domain, fields[4])
+		case http.MethodPut:
+			return rwt.handleAPIUpdatePage(w, r, domain, fields[4])
+		case http.MethodDelete:
+			return rwt.handleAPIDeletePage(w, r, domain, fields[4])
+		}
+		return writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+	if fields[3] == "dictionary" && len(fields) == 4 {
+		switch r.Method {
+		case http.MethodGet:
+			return rwt.handleAPIDictionary(w, r, domain)
+		case http.MethodPost:
+			return rwt.handleAPIAddToDictionary(w, r, domain)
+		}
+		return writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+	if fields[3] == "stats" && len(fields) == 4 {
+		if r.Method != http.MethodGet {
+			return writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return rwt.handleAPIStats(w, r, domain)
+	}
+	return writeAPIError(w, http.StatusNotFound, "not found")
+}
+
+// handleAPIDomains lists all domains, which is only allowed with the admin key.
+func (rwt *RWTxt) handleAPIDomains(w http.ResponseWriter, r *http.Request, key string) (err error) {
+	if !rwt.isAdminKey(key) {
+		return writeAPIError(w, http.StatusUnauthorized, "invalid admin key")
+	}
+	if r.Method != http.MethodGet {
+		return writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+
+	page, perPage := rwt.apiPagination(r)
+	summaries, total, err := rwt.fs.GetDomainsPage((page-1)*perPage, perPage)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "could not list domains")
+		return
+	}
+
+	domains := make([]APIDomain, len(summaries))
+	for i, d := range summaries {
+		domains[i] = APIDomain{
+			Name:   d.Name,
+			Public: d.Public,
+			Pages:  d.Pages,
+		}
+		if !d.Created.IsZero() {
+			domains[i].Created = &summaries[i].Created
+		}
+	}
+
+	setAPIPageLinks(w, r, page, perPage, total)
+	return writeAPIJSON(w, http.StatusOK, domains)
+}
+
+// handleAPIDebug reports the size of the database and the query plans of the
+// main queries reading the pages of ?domain=, the default domain if not
+// given, which is only allowed with the admin key.
+func (rwt *RWTxt) handleAPIDebug(w http.ResponseWriter, r *http.Request, key string) (err error) {
+	if !rwt.isAdminKey(key) {
+		return writeAPIError(w, http.StatusUnauthorized, "invalid admin key")
+	}
+	if r.Method != http.MethodGet {
+		return writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+
+	debug := APIDebug{Domain: strings.TrimSpace(strings.ToLower(r.URL.Query().Get("domain")))}
+	if debug.Domain == "" {
+		debug.Domain = rwt.Config.DefaultDomain
+	}
+	debug.DBStats, err = rwt.fs.Stats()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "could not get database stats")
+		return
+	}
+	debug.QueryPlans, err = rwt.fs.ExplainQueries(debug.Domain)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "could not explain queries")
+		return
+	}
+	return writeAPIJSON(w, http.StatusOK, debug)
+}
+
+// isAdminKey returns whether the key is the admin key, never if there is none.
+func (rwt *RWTxt) isAdminKey(key string) bool {
+	return rwt.Config.AdminKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(rwt.Config.AdminKey)) == 1
+}
+
+// handleAPIPages lists the pages of the domain, a page of results at a time,
+// or the pages modified since a cursor or time given by the cursor or since
+// parameters.
+func (rwt *RWTxt) handleAPIPages(w http.ResponseWriter, r *http.Request, domain string) (err error) {
+	lastModified, err := rwt.fs.DomainLastModified(domain)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "could not list pages")
+		return
+	}
+	if notModified(w, r, lastModified) {
+		return
+	}
+	if r.URL.Query().Has("cursor") || r.URL.Query().Has("since") {
+		return rwt.handleAPIPagesSince(w, r, domain)
+	}
+
+	page, perPage := rwt.apiPagination(r)
+	files, total, err := rwt.fs.GetList(domain, (page-1)*perPage, perPage, rwt.Config.OrderByCreated)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "could not list pages")
+		return
+	}
+
+	setAPIPageLinks(w, r, page, perPage, total)
+	return writeAPIJSON(w, http.StatusOK, apiPages(files))
+}
+
+// handleAPIPagesSince lists the pages changed after the cursor, or at or after
+// the since time, the least recently changed first, including those moved to
+// the trash so clients can delete them too. The next cursor is returned even
+// with no more pages, for the next sync to start from.
+func (rwt *RWTxt) handleAPIPagesSince(w http.ResponseWriter, r *http.Request, domain string) (err error) {
+	var since time.Time
+	var afterID string
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		since, afterID, err = parseAPICursor(cursor)
+		if err != nil {
+			return writeAPIError(w, http.StatusBadRequest, "invalid cursor")
+		}
+	} else if s := r.URL.Query().Get("since"); s != "" {
+		since, err = time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return writeAPIError(w, http.StatusBadRequest, "invalid since, it must be like 2006-01-02T15:04:05Z")
+		}
+	}
+
+	_, perPage := rwt.apiPagination(r)
+	// one more to know if there are more
+	files, err := rwt.fs.GetListSince(domain, since, afterID, perPage+1, true)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "could not list pages")
+		return
+	}
+
+	list := APIPageList{NextCursor: r.URL.Query().Get("cursor")}
+	if len(files) > perPage {
+		files = files[:perPage]
+		list.HasMore = true
+	}
+	list.Pages = apiPages(files)
+	if len(files) > 0 {
+		last := files[len(files)-1]
+		list.NextCursor = apiCursor(last.Changed(), last.ID)
+	} else if list.NextCursor == "" {
+		list.NextCursor = apiCursor(since, "")
+	}
+	return writeAPIJSON(w, http.StatusOK, list)
+}
+
+// apiCursor returns the opaque cursor of a page, which parseAPICursor reads.
+func apiCursor(modified time.Time, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(modified.UTC().Format(time.RFC3339Nano) + " " + id))
+}
+
+func parseAPICursor(cursor string) (modified time.Time, id string, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return
+	}
+	s, id, _ := strings.Cut(string(b), " ")
+	modified, err = time.Parse(time.RFC3339Nano, s)
+	return
+}
+
+func apiPages(files []db.File) []APIPage {
+	pages := make([]APIPage, len(files))
+	for i, f := range files {
+		pages[i] = APIPage{
+			ID:       f.ID,
+			Slug:     f.Slug,
+			Title:    f.Title,
+			Created:  f.Created,
+			Modified: f.Modified,
+			Views:    f.Views,
+		}
+		if !f.Deleted.IsZero() {
+			pages[i].Deleted = true
+			pages[i].DeletedAt = &files[i].Deleted
+		}
+	}
+	return pages
+}
+
+// notModified sets the Last-Modified header, and responds with 304 Not
+// Modified if the client has the latest version according to its
+// If-Modified-Since header.
+func notModified(w http.ResponseWriter, r *http.Request, lastModified time.Time) bool {
+	if lastModified.IsZero() {
+		return false
+	}
+	w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || lastModified.Truncate(time.Second).After(since) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// handleAPICreatePage creates a page, from the template of the domain unless
+// its data is given.
+func (rwt *RWTxt) handleAPICreatePage(w http.ResponseWriter, r *http.Request, domain string) (err error) {
+	var in APIPageInput
+	if !rwt.readAPIPageInput(w, r, &in) {
+		return
+	}
+
+	id, err := rwt.fs.NewID()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "could not create a page")
+		return
+	}
+	f := db.File{
+		ID:      id,
+		Created: time.Now().UTC(),
+		Domain:  domain,
+	}
+	if in.Slug != nil {
+		f.Slug = strings.TrimSpace(*in.Slug)
+	}
+	if in.Data != nil {
+		f.Data = strings.TrimSpace(*in.Data)
+	} else {
+		_, _, options, _, _ := rwt.fs.GetDomainFromName(domain)
+		f.Data = newPageData(options, f)
+	}
+
+	if !rwt.saveAPIPage(w, f, true) {
+		return
+	}
+	w.Header().Set("Location", "/api/v1/"+domain+"/pages/"+f.ID)
+	return writeAPIJSON(w, http.StatusCreated, APICreated{ID: f.ID, Slug: f.Slug})
+}
+
+// handleAPIGetPage returns a page, by id or slug.
+func (rwt *RWTxt) handleAPIGetPage(w http.ResponseWriter, r *http.Request, domain, page string) (err error) {
+	f, ok := rwt.getAPIPage(w, domain, page)
+	if !ok {
+		return
+	}
+	if notModified(w, r, f.Modified) {
+		return
+	}
+	return writeAPIJSON(w, http.StatusOK, f)
+}
+
+// handleAPIUpdatePage replaces the slug and data of a page given in the body.
+func (rwt *RWTxt) handleAPIUpdatePage(w http.ResponseWriter, r *http.Request, domain, page string) (err error) {
+	f, ok := rwt.getAPIPage(w, domain, page)
+	if !ok {
+		return
+	}
+	var in APIPageInput
+	if !rwt.readAPIPageInput(w, r, &in) {
+		return
+	}
+	if in.Slug != nil {
+		f.Slug = strings.TrimSpace(*in.Slug)
+	}
+	if in.Data != nil {
+		f.Data = strings.TrimSpace(*in.Data)
+	}
+
+	// don't clobber the edits of someone in the editor
+	_, _, options, _, _ := rwt.fs.GetDomainFromName(domain)
+	if options.LockEditing && rwt.locks.held(f.ID) {
+		return writeAPIError(w, http.StatusConflict, "page is being edited")
+	}
+
+	if !rwt.saveAPIPage(w, f, false) {
+		return
+	}
+	files, err := rwt.fs.Get(f.ID, domain)
+	if err != nil || len(files) != 1 {
+		writeAPIError(w, http.StatusInternalServerError, "could not get page")
+		return
+	}
+	files[0].Domain = domain
+	files[0].DataHTML = ""
+	return writeAPIJSON(w, http.StatusOK, files[0])
+}
+
+// handleAPIDeletePage moves a page to the trash.
+func (rwt *RWTxt) handleAPIDeletePage(w http.ResponseWriter, r *http.Request, domain, page string) (err error) {
+	f, ok := rwt.getAPIPage(w, domain, page)
+	if !ok {
+		return
+	}
+	err = rwt.fs.TrashFile(f.ID, domain)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "could not delete page")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return
+}
+
+// getAPIPage returns the page of the domain with the id or slug, writing an
+// error if there is no such page or it is in the trash.
+func (rwt *RWTxt) getAPIPage(w http.ResponseWriter, domain, page string) (f db.File, ok bool) {
+	id, many, err := rwt.fs.Exists(page, domain)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "could not get page")
+		return
+	}
+	if many {
+		writeAPIError(w, http.StatusConflict, "several pages have that slug, use the id")
+		return
+	}
+	if id == "" {
+		writeAPIError(w, http.StatusNotFound, "no such page")
+		return
+	}
+	files, err := rwt.fs.Get(id, domain)
+	if err != nil || len(files) != 1 {
+		writeAPIError(w, http.StatusInternalServerError, "could not get page")
+		return
+	}
+	if !files[0].Deleted.IsZero() {
+		writeAPIError(w, http.StatusGone, "page was deleted")
+		return
+	}
+	f = files[0]
+	f.Domain = domain
+	f.DataHTML = ""
+	return f, true
+}
+
+// readAPIPageInput decodes the body of a request creating or updating a page,
+// writing an error if it is not valid.
+func (rwt *RWTxt) readAPIPageInput(w http.ResponseWriter, r *http.Request, in *APIPageInput) bool {
+	body := io.Reader(r.Body)
+	if rwt.fs.MaxPageBytes > 0 {
+		// escaping can make the JSON of a page much larger than the page
+		body = http.MaxBytesReader(w, r.Body, int64(2*rwt.fs.MaxPageBytes)+apiBodySlack)
+	}
+	err := json.NewDecoder(body).Decode(in)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "page is too large")
+		return false
+	} else if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid page: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// apiBodySlack is how much larger than a page the body of a request saving it
+// may be, for its other fields.
+const apiBodySlack = 4096
+
+// saveAPIPage saves the page if its domain has room for it, writing an error
+// if it can't.
+func (rwt *RWTxt) saveAPIPage(w http.ResponseWriter, f db.File, newPage bool) bool {
+	err := rwt.fs.CheckPageSize(f.Data)
+	if err == nil {
+		err = rwt.checkQuota(f.Domain, newPage, rwt.pageGrowth(f))
+	}
+	if err == nil {
+		err = rwt.fs.Save(f)
+	}
+	var tooLarge *db.PageTooLargeError
+	var qe *quotaError
+	if errors.As(err, &qe) {
+		setQuotaHeaders(w, qe)
+		writeAPIError(w, qe.status, qe.reason)
+		return false
+	} else if errors.As(err, &tooLarge) {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, tooLarge.Error())
+		return false
+	} else if err != nil {
+		log.Error(err)
+		writeAPIError(w, http.StatusInternalServerError, "could not save page")
+		return false
+	}
+	return true
+}
+
+// dictionaryWord matches the words of custom dictionaries.
+var dictionaryWord = regexp.MustCompile(`^[\pL\pN\pM'’._-]{1,64}$`)
+
+// checkDictionary returns an error naming the first word which can't be in a
+// custom dictionary, or if there are too many.
+func checkDictionary(words []string) error {
+	if len(words) > db.MaxDictionaryWords {
+		return db.ErrDictionaryFull
+	}
+	for _, word := range words {
+		if !dictionaryWord.MatchString(word) {
+			return fmt.Errorf("invalid dictionary word %q", word)
+		}
+	}
+	return nil
+}
+
+// handleAPIDictionary returns the custom dictionary of the domain.
+func (rwt *RWTxt) handleAPIDictionary(w http.ResponseWriter, r *http.Request, domain string) (err error) {
+	_, _, options, _, err := rwt.fs.GetDomainFromName(domain)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "could not get dictionary")
+		return
+	}
+	words := options.CustomDictionary
+	if words == nil {
+		words = []string{}
+	}
+	return writeAPIJSON(w, http.StatusOK, APIDictionary{Words: words})
+}
+
+// handleAPIAddToDictionary adds the words of the body to the custom dictionary
+// of the domain, and returns the dictionary.
+func (rwt *RWTxt) handleAPIAddToDictionary(w http.ResponseWriter, r *http.Request, domain string) (err error) {
+	var input APIDictionary
+	if err = json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&input); err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "invalid json")
+	}
+	if len(input.Words) == 0 {
+		return writeAPIError(w, http.StatusBadRequest, "no words to add")
+	}
+	if errCheck := checkDictionary(input.Words); errCheck != nil {
+		return writeAPIError(w, http.StatusBadRequest, errCheck.Error())
+	}
+	words, err := rwt.fs.AddToDictionary(domain, input.Words)
+	if errors.Is(err, db.ErrDictionaryFull) {
+		return writeAPIError(w, http.StatusBadRequest, err.Error())
+	} else if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "could not add to dictionary")
+		return
+	}
+	return writeAPIJSON(w, http.StatusOK, APIDictionary{Words: words})
+}
+
+// handleAPIStats returns the usage of the domain against its quotas.
+func (rwt *RWTxt) handleAPIStats(w http.ResponseWriter, r *http.Request, domain string) (err error) {
+	usage, err := rwt.fs.GetUsage(domain)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "could not get usage")
+		return
+	}
+	return writeAPIJSON(w, http.StatusOK, APIStats{
+		Pages:       usage.Pages,
+		PageBytes:   usage.PageBytes,
+		UploadBytes: usage.UploadBytes,
+		MaxPages:    rwt.Config.DomainMaxPages,
+		MaxBytes:    rwt.Config.DomainMaxBytes,
+		MaxWrites:   rwt.Config.DomainWritesPerMinute,
+	})
+}
+
+// apiPagination returns the requested page, starting at 1, and page size,
+// clamped to Config.MaxPageSize.
+func (rwt *RWTxt) apiPagination(r *http.Request) (page, perPage int) {
+	page, _ = strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ = strconv.Atoi(r.URL.Query().Get("per_page"))
+	if perPage < 1 {
+		perPage = rwt.Config.DefaultPageSize
+	}
+	if perPage > rwt.Config.MaxPageSize {
+		perPage = rwt.Config.MaxPageSize
+	}
+	return
+}
+
+// setAPIPageLinks sets the Link, X-Total-Count and X-Per-Page headers of a
+// paginated response, X-Per-Page telling clients the page size they got.
+func setAPIPageLinks(w http.ResponseWriter, r *http.Request, page, perPage, total int) {
+	lastPage := (total + perPage - 1) / perPage
+	if lastPage < 1 {
+		lastPage = 1
+	}
+	links := []string{
+		apiLink(r, 1, perPage, "first"),
+		apiLink(r, lastPage, perPage, "last"),
+	}
+	if page > 1 {
+		links = append(links, apiLink(r, page-1, perPage, "prev"))
+	}
+	if page < lastPage {
+		links = append(links, apiLink(r, page+1, perPage, "next"))
+	}
+	w.Header().Set("Link", strings.Join(links, ", "))
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	w.Header().Set("X-Per-Page", strconv.Itoa(perPage))
+}
+
+func apiLink(r *http.Request, page, perPage int, rel string) string {
+	u := *r.URL
+	q := u.Query()
+	q.Set("page", strconv.Itoa(page))
+	q.Set("per_page", strconv.Itoa(perPage))
+	u.RawQuery = q.Encode()
+	return fmt.Sprintf(`<%s>; rel="%s"`, u.RequestURI(), rel)
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) error {
+	return writeAPIJSON(w, status, apiError{Message: message})
+}
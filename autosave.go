@@ -0,0 +1,86 @@
+package rwtxt
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/schollz/logger"
+
+	"argc.in/scratch/pkg/db"
+)
+
+// autosaver coalesces the saves of each page so that at most one is committed
+// per interval, committing only the latest content. The saves held on to that
+// fail are passed to failed, as Save already returned.
+type autosaver struct {
+	interval time.Duration
+	save     func(db.File) error
+	failed   func(db.File, error)
+
+	mu      sync.Mutex
+	last    map[string]time.Time
+	pending map[string]db.File
+	timers  map[string]*time.Timer
+}
+
+func newAutosaver(interval time.Duration, save func(db.File) error, failed func(db.File, error)) *autosaver {
+	return &autosaver{
+		interval: interval,
+		save:     save,
+		failed:   failed,
+		last:     make(map[string]time.Time),
+		pending:  make(map[string]db.File),
+		timers:   make(map[string]*time.Timer),
+	}
+}
+
+// Save commits f right away if the page wasn't saved within the interval,
+// otherwise it holds on to f until the interval is over.
+func (a *autosaver) Save(f db.File) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	wait := a.interval - time.Since(a.last[f.ID])
+	if wait <= 0 {
+		delete(a.pending, f.ID)
+		a.last[f.ID] = time.Now()
+		return a.save(f)
+	}
+
+	a.pending[f.ID] = f
+	if _, ok := a.timers[f.ID]; !ok {
+		a.timers[f.ID] = time.AfterFunc(wait, func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			delete(a.timers, f.ID)
+			a.flush(f.ID)
+		})
+	}
+	return nil
+}
+
+// Flush commits all the pending saves.
+func (a *autosaver) Flush() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for id, t := range a.timers {
+		t.Stop()
+		delete(a.timers, id)
+	}
+	for id := range a.pending {
+		a.flush(id)
+	}
+}
+
+func (a *autosaver) flush(id string) {
+	f, ok := a.pending[id]
+	if !ok {
+		return
+	}
+	delete(a.pending, id)
+	a.last[id] = time.Now()
+	if err := a.save(f); err != nil {
+		log.Errorf("saving %s: %s", id, err)
+		a.failed(f, err)
+	}
+}
@@ -0,0 +1,43 @@
+package rwtxt
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"argc.in/scratch/pkg/db"
+)
+
+func TestAutosaverReportsFailedSaves(t *testing.T) {
+	errSave := errors.New("disk full")
+	var saved, failed []string
+	a := newAutosaver(time.Hour, func(f db.File) error {
+		saved = append(saved, f.Data)
+		return errSave
+	}, func(f db.File, err error) {
+		if err != errSave {
+			t.Errorf("failed with %v, want %v", err, errSave)
+		}
+		failed = append(failed, f.Data)
+	})
+
+	// the first save is committed right away, the next ones are held on to
+	if err := a.Save(db.File{ID: "page", Data: "one"}); err != errSave {
+		t.Errorf("Save = %v, want %v", err, errSave)
+	}
+	for _, data := range []string{"two", "three"} {
+		if err := a.Save(db.File{ID: "page", Data: data}); err != nil {
+			t.Errorf("Save held = %v", err)
+		}
+	}
+	if len(failed) != 0 {
+		t.Errorf("failed before the flush: %v", failed)
+	}
+	a.Flush()
+	if want := []string{"one", "three"}; len(saved) != 2 || saved[1] != want[1] {
+		t.Errorf("saved %v, want %v", saved, want)
+	}
+	if len(failed) != 1 || failed[0] != "three" {
+		t.Errorf("failed %v, want [three]", failed)
+	}
+}
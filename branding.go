@@ -0,0 +1,146 @@
+package rwtxt
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/schollz/logger"
+)
+
+// The site wide favicon and logo, used by domains without their own.
+const (
+	defaultFavicon = "/favicon.ico"
+	defaultLogo    = "/static/img/logo.png"
+)
+
+// embeddedFavicon is the favicon of rwtxt in _static.
+const embeddedFavicon = "static/img/favicon/favicon.ico"
+
+// faviconMaxAge is how long browsers may cache the site wide favicon.
+const faviconMaxAge = 7 * 24 * time.Hour
+
+// loadFavicon reads the favicon of Config.Favicon, or the embedded one if it
+// isn't set or can't be read.
+func (rwt *RWTxt) loadFavicon() {
+	rwt.faviconModTime = time.Now()
+	if rwt.Config.Favicon != "" {
+		info, err := os.Stat(rwt.Config.Favicon)
+		if err == nil {
+			rwt.favicon, err = os.ReadFile(rwt.Config.Favicon)
+		}
+		if err == nil {
+			rwt.faviconModTime = info.ModTime()
+			return
+		}
+		log.Warnf("cannot read favicon %s, using the default: %s", rwt.Config.Favicon, err)
+	}
+	var err error
+	rwt.favicon, err = fs.ReadFile(_static, embeddedFavicon)
+	if err != nil {
+		log.Warnf("no favicon: %s", err)
+	}
+}
+
+// loadTemplates parses the embedded templates, replacing those given in
+// Config.Templates. The embedded ones are all used if those can't be parsed.
+func (rwt *RWTxt) loadTemplates(funcMap template.FuncMap) {
+	rwt.templates = template.Must(template.New("scratch").Funcs(funcMap).ParseFS(_templates, "templates/*.html"))
+	if rwt.Config.Templates == nil {
+		return
+	}
+	overrides, err := fs.Glob(rwt.Config.Templates, "*.html")
+	if err == nil && len(overrides) == 0 {
+		err = errors.New("no *.html templates")
+	}
+	var templates *template.Template
+	if err == nil {
+		templates, err = template.Must(rwt.templates.Clone()).ParseFS(rwt.Config.Templates, overrides...)
+	}
+	if err != nil {
+		log.Warnf("cannot read templates, using the default: %s", err)
+		return
+	}
+	log.Debugf("templates replaced: %s", strings.Join(overrides, ", "))
+	rwt.templates = templates
+}
+
+// handleFavicon serves the site wide favicon, with a long Cache-Control.
+func (rwt *RWTxt) handleFavicon(w http.ResponseWriter, r *http.Request) (err error) {
+	if len(rwt.favicon) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	contentType := http.DetectContentType(rwt.favicon)
+	if !strings.HasPrefix(contentType, "image/") {
+		contentType = "image/x-icon"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(faviconMaxAge.Seconds())))
+	http.ServeContent(w, r, "favicon.ico", rwt.faviconModTime, bytes.NewReader(rwt.favicon))
+	return
+}
+
+// uploadID returns the id of an upload given either by its id or by its URL,
+// like /uploads/sha256-...?filename=logo.png.
+func uploadID(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.Index(s, "/uploads/"); i >= 0 {
+		s = s[i+len("/uploads/"):]
+	}
+	if i := strings.IndexAny(s, "?#"); i >= 0 {
+		s = s[:i]
+	}
+	return s
+}
+
+// checkBrandingUpload returns an error unless the upload with the id is an
+// image uploaded to the domain.
+func (rwt *RWTxt) checkBrandingUpload(domain, id string) error {
+	info, err := rwt.fs.GetBlobInfo(id)
+	if err != nil || info.Domain != domain || !strings.HasPrefix(info.MimeType, "image/") {
+		return errors.New("logo and favicon must be images uploaded to " + domain)
+	}
+	return nil
+}
+
+// handleBranding serves the logo of the domain if logo is set and its favicon
+// otherwise, or redirects to the site wide one if the domain has none or can't
+// be viewed.
+func (tr *TemplateRender) handleBranding(w http.ResponseWriter, r *http.Request, logo bool) (err error) {
+	_, tr.DomainIsPublic, tr.Options, _, _ = tr.rwt.fs.GetDomainFromName(tr.Domain)
+	id, fallback := tr.Options.FaviconBlobID, defaultFavicon
+	if logo {
+		id, fallback = tr.Options.LogoBlobID, defaultLogo
+	}
+	if id == "" || (!tr.SignedIn && !tr.DomainIsPublic) {
+		http.Redirect(w, r, fallback, http.StatusFound)
+		return
+	}
+	info, err := tr.rwt.fs.GetBlobInfo(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Redirect(w, r, fallback, http.StatusFound)
+		return nil
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, data, _, err := tr.rwt.fs.GetBlob(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Content-Type", info.MimeType)
+	_, err = w.Write(data)
+	return
+}
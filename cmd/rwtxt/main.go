@@ -1,10 +1,18 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
 	"runtime/pprof"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	log "github.com/cihub/seelog"
@@ -12,6 +20,7 @@ import (
 
 	"argc.in/scratch"
 	"argc.in/scratch/pkg/db"
+	"argc.in/scratch/pkg/markdown"
 )
 
 var (
@@ -23,17 +32,72 @@ func main() {
 	var (
 		err             error
 		export          = flag.Bool("export", false, "export uploads to {{TIMESTAMP}}-uploads.zip and posts to {{TIMESTAMP}}-posts.zip")
+		exportTimezone  = flag.String("exporttz", "UTC", "timezone of the dates of exported posts, like Europe/Berlin or Local")
 		resizeWidth     = flag.Int("resizewidth", -1, "image width to resize on the fly")
 		resizeOnUpload  = flag.Bool("resizeonupload", false, "resize on upload")
 		resizeOnRequest = flag.Bool("resizeonrequest", false, "resize on request")
+		resizeWidths    = flag.String("resizewidths", "", "comma separated widths, besides resizewidth, that clients can ask images to be resized to with ?w=")
+		resizeRate      = flag.Int("resizerate", 0, "images resized on request per minute for each client IP (0 for no limit)")
+		resizeQuality   = flag.Int("resizequality", 0, "JPEG quality of resized images, from 1 to 100 (0 for the default)")
+		resizeFormat    = flag.String("resizeformat", rwtxt.DefaultResizeFormat, "preferred format of images resized on request (jpeg or png), JPEG is served to clients not accepting it")
 		debug           = flag.Bool("debug", false, "debug mode")
+		maxRenders      = flag.Int("maxrenders", 0, "markdown renders running at once, excess requests queue briefly then get a 503 (0 means no limit)")
+		domainWriteRate = flag.Int("domainwriterate", 0, "saves, uploads and page creations per minute for each domain (0 means no limit)")
+		domainMaxPages  = flag.Int("domainmaxpages", 0, "maximum number of pages of each domain (0 means no limit)")
+		domainMaxBytes  = flag.Int64("domainmaxbytes", 0, "maximum bytes of pages and uploads of each domain (0 means no limit)")
+		pageSize        = flag.Int("pagesize", rwtxt.DefaultPageSize, "results per page of paginated responses")
+		maxPageSize     = flag.Int("maxpagesize", rwtxt.MaxPageSize, "most results per page clients can ask for")
+		highlightStyle  = flag.String("highlightstyle", markdown.DefaultHighlightStyle, "chroma style of code blocks, like monokai or github")
 		showVersion     = flag.Bool("v", false, "show version")
 		profileMemory   = flag.Bool("memprofile", false, "profile memory")
-		database        = flag.String("db", "rwtxt.db", "name of the database")
+		database        = flag.String("db", "rwtxt.db", "name of the database, :memory: to keep it in memory until exit")
 		listen          = flag.String("listen", ":8152", "interface:port to listen on")
+		tlsCert         = flag.String("tlscert", "", "certificate file to serve HTTPS on -listen, with -tlskey")
+		tlsKey          = flag.String("tlskey", "", "private key file of -tlscert")
+		redirectListen  = flag.String("redirectlisten", "", "interface:port redirecting HTTP to HTTPS when serving it, like :80")
+		cookieSecure    = flag.Bool("cookiesecure", false, "only send cookies over HTTPS, for when a proxy in front serves it")
+		adminListen     = flag.String("adminlisten", "", "interface:port serving /healthz and the admin API, instead of -listen")
+		readTimeout     = flag.Duration("readtimeout", 0, "maximum time to read a request, uploads included (0 for no limit)")
+		writeTimeout    = flag.Duration("writetimeout", 0, "maximum time to write a response, not applied to the editor's websocket (0 for no limit)")
+		idleTimeout     = flag.Duration("idletimeout", 2*time.Minute, "time idle keep-alive connections are kept open")
+		shutdownTimeout = flag.Duration("shutdowntimeout", 30*time.Second, "time given to requests in progress and editors to finish on SIGINT or SIGTERM")
 		private         = flag.Bool("private", false, "private setup (allows listing of public notes)")
+		allowIndexing   = flag.Bool("allowindexing", false, "let search engines index public domains, unless they opt out")
 		created         = flag.Bool("created", false, "order by date created rather than date modified")
+		canonicalID     = flag.Bool("canonicalid", false, "use page ids rather than slugs as canonical URLs")
+		renderTimeout   = flag.Duration("rendertimeout", 10*time.Second, "maximum time to render a page (0 for no limit)")
+		maxPageBytes    = flag.Int("maxpagebytes", rwtxt.DefaultMaxPageBytes, "maximum size of a page in bytes (0 for no limit)")
+		maxUploadBytes  = flag.Int64("maxuploadbytes", rwtxt.DefaultMaxUploadBytes, "maximum size of an upload in bytes")
+		noPublic        = flag.Bool("nopublic", false, "do not create the public domain")
+		defaultDomain   = flag.String("defaultdomain", "public", "domain anyone can read and write, shown to visitors that are not signed in")
+		anonymousCreate = flag.Bool("anonymouscreate", true, "allow visitors that are not signed in to create pages in the default domain")
+		anonymousEdit   = flag.Bool("anonymousedit", true, "allow visitors that are not signed in to edit pages in the default domain")
+		autosave        = flag.Duration("autosave", 2*time.Second, "minimum time between saves of a page being edited")
+		securityHeaders = flag.Bool("securityheaders", false, "send HSTS (over TLS), nosniff, referrer policy and frame options headers")
+		domainOptions   = flag.String("domainoptions", "", "JSON options of new domains, overriding showing search and 10 recent, created and most edited pages")
+		summaryLength   = flag.Int("summarylength", db.DefaultSummaryLength, "maximum length of the summaries of pages shown in lists")
+		uploadRate      = flag.Int("uploadrate", 0, "uploads allowed per minute for each domain and each client IP (0 for no limit)")
+		favicon         = flag.String("favicon", "", "file served at /favicon.ico (empty for the favicon of rwtxt)")
+		templatesDir    = flag.String("templates", "", "directory of *.html templates replacing the embedded ones of the same name")
+		slowQueryMS     = flag.Int("slowqueryms", 0, "log database queries taking longer than this many milliseconds (0 to never log them)")
+		uploadTypes     = flag.String("uploadtypes", "", "comma separated MIME types, like image/*, of files that can be uploaded (empty for any)")
+		idLength        = flag.Int("idlength", 10, "length of the ids of new pages")
+		idAlphabet      = flag.String("idalphabet", "", "characters of the ids of new pages, like abcdefghijkmnpqrstuvwxyz23456789 to avoid ambiguous ones (empty for a-z and 0-9)")
+		adminKey        = flag.String("adminkey", "", "key of the admin API listing all domains (disabled if empty)")
+		maxDomains      = flag.Int("maxdomains", 0, "maximum number of domains (0 means no limit)")
+		adminCreate     = flag.Bool("admincreate", false, "only let those giving the -adminkey create domains")
+		sessions        = flag.String("sessions", "", "where to keep the domain keys of signed in browsers: memory or db, with only a session id in their cookie (empty to keep the keys in the cookie)")
+		csp             = flag.String("csp", rwtxt.DefaultCSP, "Content-Security-Policy of pages, {nonce} is replaced by the nonce of inline scripts (empty for none)")
 	)
+	headerOverrides := make(map[string]string)
+	flag.Func("header", "override a security header as 'Name: value', an empty value drops it (repeatable)", func(s string) error {
+		name, value, ok := strings.Cut(s, ":")
+		if !ok {
+			return errors.New("expected 'Name: value'")
+		}
+		headerOverrides[http.CanonicalHeaderKey(strings.TrimSpace(name))] = strings.TrimSpace(value)
+		return nil
+	})
 	flag.Parse()
 
 	if *profileMemory {
@@ -68,13 +132,38 @@ func main() {
 	dbName = *database
 	defer log.Flush()
 
-	fs, err := db.New(dbName)
+	if *noPublic {
+		*defaultDomain = ""
+	}
+	fs, err := db.New(dbName, db.WithPublicDomain(*defaultDomain))
 	if err != nil {
 		panic(err)
 	}
+	if ids, err := fs.VerifyConsistency(); err != nil {
+		log.Error(err)
+	} else if len(ids) > 0 {
+		log.Warnf("pages only partially saved, those missing from search were restored from their history: %v", ids)
+	}
+
+	if *defaultDomain != "" {
+		_, isPublic, options, _, err := fs.GetDomainFromName(*defaultDomain)
+		if err != nil {
+			panic(err)
+		}
+		options.AllowAnonymousCreate = *anonymousCreate
+		options.AllowAnonymousEdit = *anonymousEdit
+		err = fs.UpdateDomain(*defaultDomain, "", isPublic, options)
+		if err != nil {
+			panic(err)
+		}
+	}
 
 	if *export {
-		err = fs.ExportPosts()
+		loc, err := time.LoadLocation(*exportTimezone)
+		if err != nil {
+			panic(err)
+		}
+		err = fs.ExportPosts(loc)
 		if err != nil {
 			panic(err)
 		}
@@ -85,19 +174,125 @@ func main() {
 		return
 	}
 
+	newDomainOptions := db.DefaultDomainOptions()
+	newDomainOptions.ShowSearch = true
+	newDomainOptions.MostRecent = 10
+	newDomainOptions.LastCreated = 10
+	newDomainOptions.MostEdited = 10
+	if *domainOptions != "" {
+		err = json.Unmarshal([]byte(*domainOptions), &newDomainOptions)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	var widths []int
+	for _, field := range strings.Split(*resizeWidths, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+		width, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || width <= 0 {
+			panic(fmt.Sprintf("invalid resize width %q", field))
+		}
+		widths = append(widths, width)
+	}
+
+	var sessionStore rwtxt.SessionStore
+	switch *sessions {
+	case "":
+	case "memory":
+		sessionStore = rwtxt.NewMemorySessionStore()
+	case "db":
+		sessionStore = rwtxt.NewDBSessionStore(fs)
+	default:
+		log.Errorf("invalid session store %q, want memory or db", *sessions)
+		return
+	}
+
 	config := rwtxt.Config{
-		Bind:            *listen,
-		Private:         *private,
-		ResizeWidth:     *resizeWidth,
-		ResizeOnRequest: *resizeOnRequest,
-		ResizeOnUpload:  *resizeOnUpload,
-		OrderByCreated:  *created,
+		Version:          Version,
+		Bind:             *listen,
+		AdminBind:        *adminListen,
+		TLSCert:          *tlsCert,
+		TLSKey:           *tlsKey,
+		RedirectBind:     *redirectListen,
+		CookieSecure:     *cookieSecure,
+		ReadTimeout:      *readTimeout,
+		WriteTimeout:     *writeTimeout,
+		IdleTimeout:      *idleTimeout,
+		Private:          *private,
+		ResizeWidth:      *resizeWidth,
+		ResizeWidths:     widths,
+		ResizesPerMinute: *resizeRate,
+		ResizeOnRequest:  *resizeOnRequest,
+		ResizeOnUpload:   *resizeOnUpload,
+		ResizeQuality:    *resizeQuality,
+		ResizeFormat:     *resizeFormat,
+		OrderByCreated:   *created,
+		CanonicalByID:    *canonicalID,
+		RenderTimeout:    *renderTimeout,
+		MaxPageBytes:     *maxPageBytes,
+		MaxUploadBytes:   *maxUploadBytes,
+		DefaultDomain:    *defaultDomain,
+		AutosaveInterval: *autosave,
+		CSP:              *csp,
+		SecurityHeaders:  *securityHeaders,
+		HeaderOverrides:  headerOverrides,
+		AdminKey:         *adminKey,
+		MaxDomains:       *maxDomains,
+		SummaryLength:    *summaryLength,
+		IDLength:         *idLength,
+		IDAlphabet:       *idAlphabet,
+		UploadsPerMinute: *uploadRate,
+		SlowQueryMS:      *slowQueryMS,
+		Favicon:          *favicon,
+
+		MaxConcurrentRenders: *maxRenders,
+
+		DomainWritesPerMinute: *domainWriteRate,
+		DomainMaxPages:        *domainMaxPages,
+		DomainMaxBytes:        *domainMaxBytes,
+
+		HighlightStyle: *highlightStyle,
+
+		DefaultPageSize: *pageSize,
+		MaxPageSize:     *maxPageSize,
+
+		AllowedUploadTypes: strings.FieldsFunc(*uploadTypes, func(r rune) bool { return r == ',' || r == ' ' }),
+
+		AllowIndexing: *allowIndexing,
+
+		RequireAdminKeyForDomainCreate: *adminCreate,
+
+		Sessions: sessionStore,
+
+		DefaultDomainOptions: &newDomainOptions,
+	}
+	if *templatesDir != "" {
+		config.Templates = os.DirFS(*templatesDir)
 	}
 
-	err = rwtxt.New(fs, config).Serve()
+	rwt := rwtxt.New(fs, config)
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		log.Infof("got %v, shutting down", <-signals)
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := rwt.Shutdown(ctx); err != nil {
+			log.Error(err)
+		}
+	}()
+	err = rwt.Serve()
 	if err != nil {
 		log.Error(err)
+		return
 	}
+	// Serve returns as soon as Shutdown stops listening
+	<-shutdown
 }
 
 // setLogLevel determines the log level
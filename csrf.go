@@ -0,0 +1,71 @@
+package rwtxt
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"html/template"
+	"net/http"
+
+	log "github.com/schollz/logger"
+)
+
+// csrfCookie holds the CSRF token of a browser, which its forms send back in
+// the csrfParam field so other sites can't submit them.
+const (
+	csrfCookie = "rwtxt-csrf"
+	csrfParam  = "csrf_token"
+)
+
+// csrfToken returns the CSRF token of the browser, setting a new one if it has
+// none.
+func (rwt *RWTxt) csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(csrfCookie); err == nil && len(cookie.Value) == 64 {
+		return cookie.Value
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Error(err)
+		return ""
+	}
+	token := hex.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   rwt.secureCookie(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token
+}
+
+// validCSRF reports whether the request sends back the CSRF token of its
+// cookie, in its query or else its form. Uploads send it in the query, so
+// their body isn't read before its size is limited.
+func validCSRF(r *http.Request) bool {
+	cookie, err := r.Cookie(csrfCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	token := r.URL.Query().Get(csrfParam)
+	if token == "" {
+		token = r.PostFormValue(csrfParam)
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(token)) == 1
+}
+
+// checkCSRF writes a 403 and returns false if the request doesn't send back
+// its CSRF token.
+func (tr *TemplateRender) checkCSRF(w http.ResponseWriter, r *http.Request) bool {
+	if !validCSRF(r) {
+		tr.httpError(w, r, "invalid CSRF token, reload the page and try again", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// csrfField is the hidden input sending the CSRF token with a form.
+func csrfField(token string) template.HTML {
+	return template.HTML(`<input type="hidden" name="` + csrfParam + `" value="` + template.HTMLEscapeString(token) + `">`)
+}
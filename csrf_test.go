@@ -0,0 +1,92 @@
+package rwtxt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"argc.in/scratch/pkg/db"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// testCSRFToken is a CSRF token as csrfToken makes them.
+const testCSRFToken = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+// newTestRWTxt returns an RWTxt with the default Config on an empty in-memory
+// database.
+func newTestRWTxt(t testing.TB) *RWTxt {
+	t.Helper()
+	fs, err := db.New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fs.Close() })
+	return New(fs, Config{})
+}
+
+func TestCSRF(t *testing.T) {
+	rwt := newTestRWTxt(t)
+
+	handlers := []struct {
+		name   string
+		handle func(tr *TemplateRender, w http.ResponseWriter, r *http.Request) error
+		// uploads send the token in the query, the others in the form
+		inQuery bool
+	}{
+		{"logout", (*TemplateRender).handleLogout, false},
+		{"update", (*TemplateRender).handleLoginUpdate, false},
+		{"upload", (*TemplateRender).handleUpload, true},
+	}
+	tests := []struct {
+		name   string
+		cookie string
+		token  string
+		valid  bool
+	}{
+		{"no token", testCSRFToken, "", false},
+		{"no cookie", "", testCSRFToken, false},
+		{"wrong token", testCSRFToken, strings.Repeat("0", len(testCSRFToken)), false},
+		{"matching token", testCSRFToken, testCSRFToken, true},
+	}
+	for _, h := range handlers {
+		for _, tt := range tests {
+			form := url.Values{"domain": {"test"}}
+			target := "/" + h.name
+			if h.inQuery {
+				target += "?" + url.Values{"domain": {"test"}, csrfParam: {tt.token}}.Encode()
+			} else {
+				form.Set(csrfParam, tt.token)
+			}
+			r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: csrfCookie, Value: tt.cookie})
+			}
+			w := httptest.NewRecorder()
+			if err := h.handle(NewTemplateRender(rwt), w, r); err != nil {
+				t.Errorf("%s, %s: %v", h.name, tt.name, err)
+				continue
+			}
+			refused := w.Code == http.StatusForbidden && strings.Contains(w.Body.String(), "invalid CSRF token")
+			if refused == tt.valid {
+				t.Errorf("%s, %s: %d %q, want the token valid %v", h.name, tt.name, w.Code, w.Body.String(), tt.valid)
+			}
+		}
+	}
+}
+
+func TestLogoutNeedsPost(t *testing.T) {
+	rwt := newTestRWTxt(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/logout?domain=test&"+csrfParam+"="+testCSRFToken, nil)
+	r.AddCookie(&http.Cookie{Name: csrfCookie, Value: testCSRFToken})
+	w := httptest.NewRecorder()
+	if err := NewTemplateRender(rwt).handleLogout(w, r); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /logout = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
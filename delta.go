@@ -0,0 +1,49 @@
+package rwtxt
+
+import (
+	"errors"
+	"unicode/utf16"
+)
+
+// Delta is an edit sent over the websocket instead of the full document. It
+// replaces Delete code units at Start with Insert. Offsets are in UTF-16 code
+// units, as the editor counts them.
+type Delta struct {
+	Base   uint32 `json:"base"` // hashText of the document the delta applies to
+	Start  int    `json:"start"`
+	Delete int    `json:"delete"`
+	Insert string `json:"insert"`
+}
+
+var errDeltaMismatch = errors.New("delta does not apply to the document")
+
+// apply returns the document with the delta applied, or errDeltaMismatch if
+// the delta was made against a different document.
+func (d Delta) apply(base string) (string, error) {
+	units := utf16.Encode([]rune(base))
+	if hashUnits(units) != d.Base || d.Start < 0 || d.Delete < 0 ||
+		// compared without adding them, which could overflow
+		d.Start > len(units) || d.Delete > len(units)-d.Start {
+		return "", errDeltaMismatch
+	}
+	insert := utf16.Encode([]rune(d.Insert))
+	result := make([]uint16, 0, len(units)-d.Delete+len(insert))
+	result = append(result, units[:d.Start]...)
+	result = append(result, insert...)
+	result = append(result, units[d.Start+d.Delete:]...)
+	return string(utf16.Decode(result)), nil
+}
+
+// hashText is a cheap 32-bit hash of the UTF-16 code units of s, matching
+// CY.hashText in rwtxt.js.
+func hashText(s string) uint32 {
+	return hashUnits(utf16.Encode([]rune(s)))
+}
+
+func hashUnits(units []uint16) uint32 {
+	var h uint32
+	for _, u := range units {
+		h = h*31 + uint32(u)
+	}
+	return h
+}
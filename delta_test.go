@@ -0,0 +1,34 @@
+package rwtxt
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDeltaApply(t *testing.T) {
+	const base = "hello, 世界 😀"
+	tests := []struct {
+		name  string
+		delta Delta
+		want  string
+		err   error
+	}{
+		{"insert", Delta{Start: 5, Insert: " there"}, "hello there, 世界 😀", nil},
+		{"replace", Delta{Start: 7, Delete: 2, Insert: "world"}, "hello, world 😀", nil},
+		{"append", Delta{Start: 12, Insert: "!"}, base + "!", nil},
+		{"past the end", Delta{Start: 12, Delete: 1}, "", errDeltaMismatch},
+		{"negative", Delta{Start: -1, Delete: 1}, "", errDeltaMismatch},
+		{"overflowing start", Delta{Start: math.MaxInt, Delete: 1}, "", errDeltaMismatch},
+		{"overflowing delete", Delta{Start: 1, Delete: math.MaxInt}, "", errDeltaMismatch},
+	}
+	for _, tt := range tests {
+		tt.delta.Base = hashText(base)
+		got, err := tt.delta.apply(base)
+		if got != tt.want || err != tt.err {
+			t.Errorf("%s: apply = %q, %v, want %q, %v", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+	if _, err := (Delta{Base: hashText("other")}).apply(base); err != errDeltaMismatch {
+		t.Errorf("other base: err = %v, want %v", err, errDeltaMismatch)
+	}
+}
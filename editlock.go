@@ -0,0 +1,57 @@
+package rwtxt
+
+import (
+	"sync"
+	"time"
+)
+
+// editLockTTL is how long an edit lock is held without being refreshed by its
+// session.
+const editLockTTL = 30 * time.Second
+
+// editLocks keeps advisory locks on pages being edited, so two sessions don't
+// clobber each other. Locks are only held in memory.
+type editLocks struct {
+	sync.Mutex
+	locks map[string]editLock
+}
+
+type editLock struct {
+	session string
+	expires time.Time
+}
+
+func newEditLocks() *editLocks {
+	return &editLocks{locks: make(map[string]editLock)}
+}
+
+// acquire locks the page for the session, or refreshes its lock. It fails if
+// another session holds an unexpired lock, unless takeover is set.
+func (l *editLocks) acquire(id, session string, takeover bool) bool {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	lock, ok := l.locks[id]
+	if ok && lock.session != session && now.Before(lock.expires) && !takeover {
+		return false
+	}
+	l.locks[id] = editLock{session: session, expires: now.Add(editLockTTL)}
+	return true
+}
+
+// held reports whether any session holds an unexpired lock on the page.
+func (l *editLocks) held(id string) bool {
+	l.Lock()
+	defer l.Unlock()
+	lock, ok := l.locks[id]
+	return ok && time.Now().Before(lock.expires)
+}
+
+// release unlocks the page if the session holds its lock.
+func (l *editLocks) release(id, session string) {
+	l.Lock()
+	defer l.Unlock()
+	if lock, ok := l.locks[id]; ok && lock.session == session {
+		delete(l.locks, id)
+	}
+}
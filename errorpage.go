@@ -0,0 +1,94 @@
+package rwtxt
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/schollz/logger"
+)
+
+// acceptsHTML reports whether the client asked for HTML, as browsers do when
+// following links and submitting forms, unlike the scripts of the pages.
+func acceptsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// httpError replies with the message and status like http.Error, but on the
+// error page, styled by the domain, when the client asked for HTML.
+func (tr *TemplateRender) httpError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	if !acceptsHTML(r) {
+		http.Error(w, message, status)
+		return
+	}
+	tr.ErrorStatus = status
+	tr.Message = message
+	tr.Title = http.StatusText(status)
+	// only those who can see the domain see its style, and special paths
+	// like /update are no domain to go back to
+	_, public, options, _, err := tr.rwt.fs.GetDomainFromName(tr.Domain)
+	if err != nil {
+		tr.Domain = ""
+	} else if public || tr.SignedIn {
+		tr.Options = options
+		tr.CustomCSS = template.CSS(options.CSS)
+	}
+	var b bytes.Buffer
+	if err = tr.rwt.templates.ExecuteTemplate(&b, "error.html", tr); err != nil {
+		log.Error(err)
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(b.Bytes())
+}
+
+// handleError replies to a request Handle failed without replying to with a
+// 500 on the error page, keeping the error itself in the log.
+func (rwt *RWTxt) handleError(w http.ResponseWriter, r *http.Request) {
+	tr := NewTemplateRender(rwt)
+	tr.Domain = strings.TrimSpace(strings.ToLower(strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")[0]))
+	tr.Nonce = newNonce()
+	rwt.setCSP(w, tr.Nonce)
+	tr.httpError(w, r, "something went wrong, try again later", http.StatusInternalServerError)
+}
+
+// responseWriter remembers whether a response was started, so Handler knows
+// whether to reply when Handle fails.
+type responseWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	w.started = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets websockets take over the connection.
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can't be hijacked")
+	}
+	w.started = true
+	return h.Hijack()
+}
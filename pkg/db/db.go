@@ -3,12 +3,16 @@ package db
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"io"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -17,24 +21,81 @@ import (
 	"github.com/pkg/errors"
 	"github.com/schollz/versionedtext"
 
+	"argc.in/scratch/pkg/markdown"
 	"argc.in/scratch/pkg/utils"
 )
 
+// DefaultSummaryLength is the length of summaries unless set otherwise.
+const DefaultSummaryLength = 200
+
+// Option configures a FileSystem created by New.
+type Option func(*FileSystem)
+
+// WithPublicDomain sets the name of the public domain, which anyone can read
+// and write. It defaults to "public".
+func WithPublicDomain(name string) Option {
+	return func(fs *FileSystem) {
+		fs.publicDomain = strings.ToLower(name)
+	}
+}
+
+// WithoutPublicDomain skips creating the public domain, for strictly private
+// deployments.
+func WithoutPublicDomain() Option {
+	return WithPublicDomain("")
+}
+
+// DefaultPragmas let readers carry on while a page is saved, and wait for a
+// lock instead of failing with "database is locked".
+var DefaultPragmas = map[string]string{
+	"journal_mode": "WAL",
+	"busy_timeout": "5000",
+	"synchronous":  "NORMAL",
+}
+
+// WithPragmas replaces DefaultPragmas, nil keeps the defaults of SQLite. The
+// pragmas are set on every connection, through the connection parameters of
+// go-sqlite3, so only those it supports can be set. Parameters given in the
+// name of the database take precedence.
+func WithPragmas(pragmas map[string]string) Option {
+	return func(fs *FileSystem) {
+		fs.pragmas = pragmas
+	}
+}
+
 // New will initialize a filesystem by creating DB and calling InitializeDB.
 // Callers should ensure "github.com/mattn/go-sqlite3" is imported in some way
 // before calling this so the sqlite3 driver is available.
-func New(name string) (fs *FileSystem, err error) {
-	fs = new(FileSystem)
+//
+// A name of ":memory:", or a URI like "file::memory:" or "file:x?mode=memory",
+// keeps the database in memory, for tests and ephemeral demos. It is gone once
+// the FileSystem is closed.
+//
+// Connections are opened with DefaultPragmas unless WithPragmas is given.
+func New(name string, opts ...Option) (fs *FileSystem, err error) {
+	fs = &FileSystem{
+		SummaryLength:    DefaultSummaryLength,
+		NewDomainOptions: DefaultDomainOptions(),
+		publicDomain:     "public",
+		pragmas:          DefaultPragmas,
+	}
+	for _, opt := range opts {
+		opt(fs)
+	}
 	if name == "" {
 		err = errors.New("database must have name")
 		return
 	}
 	fs.Name = name
 
-	fs.DB, err = sql.Open("sqlite3", fs.Name)
+	fs.DB, err = fs.openTimed("sqlite3", withPragmas(fs.Name, fs.pragmas))
 	if err != nil {
 		return
 	}
+	if isMemoryDB(fs.Name) {
+		// every connection would open its own empty database
+		fs.DB.SetMaxOpenConns(1)
+	}
 	err = fs.InitializeDB()
 	if err != nil {
 		err = errors.Wrap(err, "could not initialize")
@@ -44,9 +105,58 @@ func New(name string) (fs *FileSystem, err error) {
 	return
 }
 
+// withPragmas returns the name of the database with the pragmas added as
+// go-sqlite3 connection parameters, after those already in the name.
+func withPragmas(name string, pragmas map[string]string) string {
+	if len(pragmas) == 0 {
+		return name
+	}
+	names := make([]string, 0, len(pragmas))
+	for pragma := range pragmas {
+		names = append(names, pragma)
+	}
+	sort.Strings(names)
+	params := make([]string, len(names))
+	for i, pragma := range names {
+		params[i] = "_" + pragma + "=" + url.QueryEscape(pragmas[pragma])
+	}
+	sep := "?"
+	if strings.Contains(name, "?") {
+		sep = "&"
+	}
+	return name + sep + strings.Join(params, "&")
+}
+
+// isMemoryDB reports whether the SQLite database name opens an in-memory
+// database.
+func isMemoryDB(name string) bool {
+	if name == ":memory:" {
+		return true
+	}
+	if !strings.HasPrefix(name, "file:") {
+		return false
+	}
+	path, query, _ := strings.Cut(strings.TrimPrefix(name, "file:"), "?")
+	if path == ":memory:" {
+		return true
+	}
+	for _, param := range strings.Split(query, "&") {
+		if param == "mode=memory" {
+			return true
+		}
+	}
+	return false
+}
+
 // InitializeDB will initialize schema if not already done and if dump is true,
 // will create the an initial DB dump. This is automatically called by New.
 func (fs *FileSystem) InitializeDB() (err error) {
+	// nearly every read joins the full text search table
+	err = fs.checkFTS5()
+	if err != nil {
+		return
+	}
+
 	sqlStmt := `CREATE TABLE IF NOT EXISTS
 		fs (
 			id TEXT NOT NULL PRIMARY KEY,
@@ -55,7 +165,12 @@ func (fs *FileSystem) InitializeDB() (err error) {
 			created TIMESTAMP,
 			modified TIMESTAMP,
 			history TEXT,
-			views INTEGER DEFAULT 0
+			views INTEGER DEFAULT 0,
+			published INTEGER DEFAULT 1,
+			publish_at TIMESTAMP,
+			summary TEXT,
+			title TEXT,
+			deleted TIMESTAMP
 		);`
 	_, err = fs.DB.Exec(sqlStmt)
 	if err != nil {
@@ -63,6 +178,28 @@ func (fs *FileSystem) InitializeDB() (err error) {
 		return
 	}
 
+	// add the columns missing from databases created by older versions
+	err = fs.addColumn("fs", "published", "INTEGER DEFAULT 1")
+	if err != nil {
+		return
+	}
+	err = fs.addColumn("fs", "publish_at", "TIMESTAMP")
+	if err != nil {
+		return
+	}
+	err = fs.addColumn("fs", "summary", "TEXT")
+	if err != nil {
+		return
+	}
+	err = fs.addColumn("fs", "title", "TEXT")
+	if err != nil {
+		return
+	}
+	err = fs.addColumn("fs", "deleted", "TIMESTAMP")
+	if err != nil {
+		return
+	}
+
 	sqlStmt = `CREATE VIRTUAL TABLE IF NOT EXISTS 
 		fts USING fts5 (id,data);`
 	_, err = fs.DB.Exec(sqlStmt)
@@ -70,19 +207,61 @@ func (fs *FileSystem) InitializeDB() (err error) {
 		err = errors.Wrap(err, "creating virtual table")
 	}
 
+	err = fs.backfillPages()
+	if err != nil {
+		return
+	}
+
+	// the #tags of each page, kept by Save so listing them doesn't read every
+	// page of the domain
+	var tagsExisted bool
+	err = fs.DB.QueryRow(`SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = 'tags'`).Scan(&tagsExisted)
+	if err != nil {
+		return errors.Wrap(err, "checking for tags table")
+	}
+	sqlStmt = `CREATE TABLE IF NOT EXISTS
+	tags (
+		id TEXT NOT NULL,
+		tag TEXT NOT NULL,
+		PRIMARY KEY (id, tag)
+	);`
+	_, err = fs.DB.Exec(sqlStmt)
+	if err != nil {
+		return errors.Wrap(err, "creating tags table")
+	}
+	sqlStmt = `CREATE INDEX IF NOT EXISTS
+	tagstag ON tags(tag);`
+	_, err = fs.DB.Exec(sqlStmt)
+	if err != nil {
+		return errors.Wrap(err, "creating index")
+	}
+	if !tagsExisted {
+		err = fs.backfillTags()
+		if err != nil {
+			return
+		}
+	}
+
 	sqlStmt = `CREATE TABLE IF NOT EXISTS 
 	domains (
 		id INTEGER NOT NULL PRIMARY KEY,
 		name TEXT,
 		hashed_pass TEXT,
 		ispublic INTEGER DEFAULT 0,
-		options BLOB
+		options BLOB,
+		created TIMESTAMP
 	);`
 	_, err = fs.DB.Exec(sqlStmt)
 	if err != nil {
 		err = errors.Wrap(err, "creating domains table")
 	}
 
+	// domains created by older versions keep an unknown creation time
+	err = fs.addColumn("domains", "created", "TIMESTAMP")
+	if err != nil {
+		return
+	}
+
 	sqlStmt = `CREATE TABLE IF NOT EXISTS
 	keys (
 		id INTEGER NOT NULL PRIMARY KEY,
@@ -94,19 +273,70 @@ func (fs *FileSystem) InitializeDB() (err error) {
 	if err != nil {
 		err = errors.Wrap(err, "creating keys table")
 	}
+	// keys without an expiry, like those of older versions, never expire
+	err = fs.addColumn("keys", "expires", "TIMESTAMP")
+	if err != nil {
+		return
+	}
+
+	sqlStmt = `CREATE TABLE IF NOT EXISTS
+	sessions (
+		id TEXT NOT NULL PRIMARY KEY,
+		data TEXT,
+		modified TIMESTAMP
+	);`
+	_, err = fs.DB.Exec(sqlStmt)
+	if err != nil {
+		err = errors.Wrap(err, "creating sessions table")
+	}
 
 	sqlStmt = `CREATE TABLE IF NOT EXISTS
 	blobs (
 		id TEXT NOT NULL PRIMARY KEY,
 		name TEXT,
 		data BLOB,
-		views INTEGER DEFAULT 0
+		views INTEGER DEFAULT 0,
+		mimetype TEXT,
+		size INTEGER
 	);`
 	_, err = fs.DB.Exec(sqlStmt)
 	if err != nil {
 		err = errors.Wrap(err, "creating domains table")
 	}
 
+	// the type of blobs uploaded with older versions is unknown
+	err = fs.addColumn("blobs", "mimetype", "TEXT")
+	if err != nil {
+		return
+	}
+	err = fs.addColumn("blobs", "size", "INTEGER")
+	if err != nil {
+		return
+	}
+	// nor is the domain they were uploaded to, so they count for none
+	err = fs.addColumn("blobs", "domainid", "INTEGER")
+	if err != nil {
+		return
+	}
+
+	// the data of blobs, in rows of blobChunkSize bytes so it can be read a
+	// row at a time without SQLite loading all of it for every row
+	sqlStmt = `CREATE TABLE IF NOT EXISTS
+	blob_chunks (
+		id TEXT NOT NULL,
+		n INTEGER NOT NULL,
+		data BLOB,
+		PRIMARY KEY (id, n)
+	);`
+	_, err = fs.DB.Exec(sqlStmt)
+	if err != nil {
+		return errors.Wrap(err, "creating blob_chunks table")
+	}
+	err = fs.chunkBlobs()
+	if err != nil {
+		return
+	}
+
 	sqlStmt = `DROP TABLE IF EXISTS	cached_images;`
 	_, err = fs.DB.Exec(sqlStmt)
 	if err != nil {
@@ -135,19 +365,25 @@ func (fs *FileSystem) InitializeDB() (err error) {
 	cached_html (
 		id TEXT NOT NULL PRIMARY KEY,
 		modified TIMESTAMP,
-		tr BLBOB
+		tr BLOB
 	);`
 	_, err = fs.DB.Exec(sqlStmt)
 	if err != nil {
 		err = errors.Wrap(err, "creating cached_html table")
 	}
 
+	// pages by slug, the most recently modified first, replacing fsslugs
+	// which lost to fsmodified without statistics to tell them apart
 	sqlStmt = `CREATE INDEX IF NOT EXISTS
-	fsslugs ON fs(slug,domainid);`
+	fsslugmodified ON fs(slug,domainid,modified);`
 	_, err = fs.DB.Exec(sqlStmt)
 	if err != nil {
 		err = errors.Wrap(err, "creating index")
 	}
+	_, err = fs.DB.Exec("DROP INDEX IF EXISTS fsslugs")
+	if err != nil {
+		err = errors.Wrap(err, "dropping index")
+	}
 
 	sqlStmt = `CREATE INDEX IF NOT EXISTS
 	domainsname ON domains(name);`
@@ -156,19 +392,295 @@ func (fs *FileSystem) InitializeDB() (err error) {
 		err = errors.Wrap(err, "creating index")
 	}
 
-	domainid, _, _, _, _ := fs.getDomainFromName("public")
+	// listings of a domain ordered by when pages were modified or created or
+	// by their views
+	sqlStmt = `CREATE INDEX IF NOT EXISTS
+	fsmodified ON fs(domainid,modified);`
+	_, err = fs.DB.Exec(sqlStmt)
+	if err != nil {
+		err = errors.Wrap(err, "creating index")
+	}
+
+	sqlStmt = `CREATE INDEX IF NOT EXISTS
+	fscreated ON fs(domainid,created);`
+	_, err = fs.DB.Exec(sqlStmt)
+	if err != nil {
+		err = errors.Wrap(err, "creating index")
+	}
+
+	sqlStmt = `CREATE INDEX IF NOT EXISTS
+	fsviews ON fs(domainid,views);`
+	_, err = fs.DB.Exec(sqlStmt)
+	if err != nil {
+		err = errors.Wrap(err, "creating index")
+	}
+
+	if fs.publicDomain == "" {
+		return
+	}
+	domainid, _, _, _, _, _ := fs.getDomainFromName(fs.publicDomain)
 	if domainid == 0 {
-		fs.setDomain("public", "")
-		fs.UpdateDomain("public", "", true, DomainOptions{})
+		fs.setDomain(fs.publicDomain, "")
+		fs.UpdateDomain(fs.publicDomain, "", true, DefaultDomainOptions())
+	}
+
+	return
+}
+
+// checkFTS5 returns an error if SQLite was built without the FTS5 extension.
+func (fs *FileSystem) checkFTS5() (err error) {
+	_, err = fs.DB.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS temp.fts5_check USING fts5 (data);
+	DROP TABLE temp.fts5_check;`)
+	if err != nil && strings.Contains(err.Error(), "no such module") {
+		return errors.New("SQLite built without FTS5; rebuild with -tags fts5")
+	}
+	return errors.Wrap(err, "checking for FTS5")
+}
+
+// backfillPages computes the summaries and titles of pages saved by older
+// versions.
+func (fs *FileSystem) backfillPages() (err error) {
+	rows, err := fs.DB.Query(`SELECT fs.id, fs.slug, fts.data FROM fs
+	INNER JOIN fts ON fs.id=fts.id WHERE fs.summary IS NULL OR fs.title IS NULL`)
+	if err != nil {
+		return errors.Wrap(err, "query backfillPages")
+	}
+	files := []File{}
+	for rows.Next() {
+		var f File
+		var slug sql.NullString
+		err = rows.Scan(&f.ID, &slug, &f.Data)
+		if err != nil {
+			rows.Close()
+			return errors.Wrap(err, "scan backfillPages")
+		}
+		f.Slug = slug.String
+		f.Summary = markdown.PlainText(f.Data, fs.SummaryLength)
+		f.Title = pageTitle(f)
+		files = append(files, f)
+	}
+	rows.Close()
+	if len(files) == 0 {
+		return
+	}
+
+	tx, err := fs.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin backfillPages")
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`UPDATE fs SET summary = ?, title = ? WHERE id = ?`)
+	if err != nil {
+		return errors.Wrap(err, "stmt backfillPages")
+	}
+	defer stmt.Close()
+	for _, f := range files {
+		_, err = stmt.Exec(f.Summary, f.Title, f.ID)
+		if err != nil {
+			return errors.Wrap(err, "exec backfillPages")
+		}
+	}
+	log.Infof("computed the summaries and titles of %d pages", len(files))
+	return errors.Wrap(tx.Commit(), "commit backfillPages")
+}
+
+// chunkBlobs moves the data of blobs saved by older versions, which kept it in
+// the blobs table, into blob_chunks. Blobs are moved one at a time, so only one
+// is in memory at once.
+func (fs *FileSystem) chunkBlobs() (err error) {
+	moved := 0
+	for {
+		var id string
+		var data []byte
+		err = fs.DB.QueryRow(`SELECT id, data FROM blobs WHERE data IS NOT NULL LIMIT 1`).Scan(&id, &data)
+		if errors.Is(err, sql.ErrNoRows) {
+			break
+		} else if err != nil {
+			return errors.Wrap(err, "query chunkBlobs")
+		}
+
+		var tx *sql.Tx
+		tx, err = fs.DB.Begin()
+		if err != nil {
+			return errors.Wrap(err, "begin chunkBlobs")
+		}
+		err = saveBlobChunks(tx, id, data)
+		if err == nil {
+			_, err = tx.Exec(`UPDATE blobs SET data = NULL WHERE id = ?`, id)
+		}
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "exec chunkBlobs")
+		}
+		err = tx.Commit()
+		if err != nil {
+			return errors.Wrap(err, "commit chunkBlobs")
+		}
+		moved++
+	}
+	if moved > 0 {
+		log.Infof("split the data of %d uploads into chunks", moved)
+	}
+	return nil
+}
+
+// saveBlobChunks replaces the chunks of the blob with the id by data.
+func saveBlobChunks(tx *sql.Tx, id string, data []byte) (err error) {
+	_, err = tx.Exec(`DELETE FROM blob_chunks WHERE id = ?`, id)
+	if err != nil {
+		return
+	}
+	stmt, err := tx.Prepare(`INSERT INTO blob_chunks (id, n, data) VALUES (?, ?, ?)`)
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+	for n := 0; len(data) > 0; n++ {
+		chunk := data
+		if len(chunk) > blobChunkSize {
+			chunk = chunk[:blobChunkSize]
+		}
+		_, err = stmt.Exec(id, n, chunk)
+		if err != nil {
+			return
+		}
+		data = data[len(chunk):]
+	}
+	return
+}
+
+// backfillTags fills the tags table with the #tags of the pages saved by older
+// versions.
+func (fs *FileSystem) backfillTags() (err error) {
+	rows, err := fs.DB.Query(`SELECT fs.id, fts.data FROM fs
+	INNER JOIN fts ON fs.id=fts.id`)
+	if err != nil {
+		return errors.Wrap(err, "query backfillTags")
+	}
+	files := []File{}
+	for rows.Next() {
+		var f File
+		err = rows.Scan(&f.ID, &f.Data)
+		if err != nil {
+			rows.Close()
+			return errors.Wrap(err, "scan backfillTags")
+		}
+		files = append(files, f)
+	}
+	rows.Close()
+	if len(files) == 0 {
+		return
+	}
+
+	tx, err := fs.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin backfillTags")
+	}
+	defer tx.Rollback()
+	for _, f := range files {
+		err = setTags(context.Background(), tx, f.ID, f.Data)
+		if err != nil {
+			return
+		}
+	}
+	log.Infof("listed the tags of %d pages", len(files))
+	return errors.Wrap(tx.Commit(), "commit backfillTags")
+}
+
+// setTags replaces the #tags of the page with the id by those used in data.
+func setTags(ctx context.Context, tx *sql.Tx, id, data string) (err error) {
+	_, err = tx.ExecContext(ctx, `DELETE FROM tags WHERE id = ?`, id)
+	if err != nil {
+		return errors.Wrap(err, "delete tags")
+	}
+	for _, tag := range markdown.Tags(data) {
+		_, err = tx.ExecContext(ctx, `INSERT INTO tags(id,tag) VALUES (?,?)`, id, tag)
+		if err != nil {
+			return errors.Wrap(err, "insert tags")
+		}
+	}
+	return
+}
+
+// pageTitle returns the text of the first heading of the page, or its slug.
+func pageTitle(f File) string {
+	if title := markdown.Title(f.Data); title != "" {
+		return title
+	}
+	return strings.Replace(f.Slug, "-", " ", -1)
+}
+
+// addColumn adds a column to a table, unless the table already has it
+func (fs *FileSystem) addColumn(table, column, definition string) (err error) {
+	rows, err := fs.DB.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return errors.Wrap(err, "table info "+table)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return errors.Wrap(err, "table info "+table)
+		}
+		if name == column {
+			return
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return errors.Wrap(err, "table info "+table)
 	}
+	rows.Close()
 
+	_, err = fs.DB.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	if err != nil {
+		err = errors.Wrap(err, "adding column "+table+"."+column)
+	}
 	return
 }
 
+// newIDAttempts is how many ids NewID generates before giving up.
+const newIDAttempts = 10
+
+// NewID returns a random id for a new page, which no page has yet
+func (fs *FileSystem) NewID() (id string, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	for i := 0; i < newIDAttempts; i++ {
+		id = fs.randomID()
+		var exists bool
+		exists, err = fs.isID(context.Background(), id)
+		if err != nil || !exists {
+			return
+		}
+		log.Warnf("generated id %s already exists", id)
+	}
+	return "", errors.New("could not generate an unused id, make ids longer")
+}
+
+func (fs *FileSystem) randomID() string {
+	if fs.IDLength <= 0 && fs.IDAlphabet == "" {
+		return utils.UUID()
+	}
+	length := fs.IDLength
+	if length <= 0 {
+		length = len(utils.UUID())
+	}
+	if fs.IDAlphabet == "" {
+		return utils.UUIDN(length)
+	}
+	return utils.UUIDWithOptions(length, fs.IDAlphabet)
+}
+
 // NewFile returns a new file
-func (fs *FileSystem) NewFile(slug, data string) (f File) {
+func (fs *FileSystem) NewFile(slug, data string) (f File, err error) {
+	id, err := fs.NewID()
+	if err != nil {
+		return
+	}
 	f = File{
-		ID:       utils.UUID(),
+		ID:       id,
 		Slug:     slug,
 		Created:  time.Now().UTC(),
 		Modified: time.Now().UTC(),
@@ -177,8 +689,13 @@ func (fs *FileSystem) NewFile(slug, data string) (f File) {
 	return
 }
 
-// SaveBlob will save a blob
-func (fs *FileSystem) SaveBlob(id string, name string, blob []byte) (err error) {
+// SaveBlob will save a blob, gzip compressed, with the MIME type and size of its
+// uncompressed data. It returns a BlobTooLargeError if the size is larger than
+// MaxBlobBytes.
+func (fs *FileSystem) SaveBlob(id string, domain string, name string, mimetype string, size int, blob []byte) (err error) {
+	if fs.MaxBlobBytes > 0 && int64(size) > fs.MaxBlobBytes {
+		return &BlobTooLargeError{Size: int64(size), Max: fs.MaxBlobBytes}
+	}
 	fs.Lock()
 	defer fs.Unlock()
 
@@ -186,30 +703,39 @@ func (fs *FileSystem) SaveBlob(id string, name string, blob []byte) (err error)
 	if err != nil {
 		return errors.Wrap(err, "begin SaveBlob")
 	}
+	defer tx.Rollback()
 	stmt, err := tx.Prepare(`
 	INSERT OR REPLACE INTO
 		blobs
 	(
 		id,
 		name,
-		data
+		mimetype,
+		size,
+		domainid
 	) 
 		VALUES 	
 	(
 		?,
 		?,
-		?
+		?,
+		?,
+		(SELECT id FROM domains WHERE name = ?)
 	)`)
 	if err != nil {
 		return errors.Wrap(err, "stmt SaveBlob")
 	}
 	_, err = stmt.Exec(
-		id, name, blob,
+		id, name, mimetype, size, strings.ToLower(domain),
 	)
 	if err != nil {
 		return errors.Wrap(err, "exec SaveBlob")
 	}
 	defer stmt.Close()
+	err = saveBlobChunks(tx, id, blob)
+	if err != nil {
+		return errors.Wrap(err, "exec SaveBlob")
+	}
 	err = tx.Commit()
 	if err != nil {
 		return errors.Wrap(err, "commit SaveBlob")
@@ -217,8 +743,13 @@ func (fs *FileSystem) SaveBlob(id string, name string, blob []byte) (err error)
 	return
 }
 
-// ExportPosts will save posts to {{TIMESTAMP}}-posts.gz
-func (fs *FileSystem) ExportPosts() error {
+// ExportPosts will save posts to {{TIMESTAMP}}-posts.gz, with front matter
+// giving their dates in loc, or UTC if nil
+func (fs *FileSystem) ExportPosts(loc *time.Location) error {
+	if loc == nil {
+		loc = time.UTC
+	}
+
 	domains, err := fs.GetDomains()
 	if err != nil {
 		return err
@@ -227,7 +758,7 @@ func (fs *FileSystem) ExportPosts() error {
 	dir := os.TempDir()
 	postPaths := []string{}
 	for _, domain := range domains {
-		files, err := fs.GetAll(domain)
+		files, err := fs.GetAllFiltered(domain, true)
 		if err != nil {
 			return err
 		}
@@ -238,6 +769,7 @@ func (fs *FileSystem) ExportPosts() error {
 				return err
 			}
 			var buf bytes.Buffer
+			writeFrontMatter(&buf, file, loc)
 			_, err = buf.ReadFrom(r)
 			if err != nil {
 				return err
@@ -264,6 +796,18 @@ func (fs *FileSystem) ExportPosts() error {
 
 }
 
+// writeFrontMatter writes the YAML front matter of an exported post, which
+// static site generators read the title and dates from.
+func writeFrontMatter(buf *bytes.Buffer, f File, loc *time.Location) {
+	buf.WriteString("---\n")
+	fmt.Fprintf(buf, "title: %s\n", strconv.Quote(f.Title))
+	fmt.Fprintf(buf, "slug: %s\n", strconv.Quote(f.Slug))
+	fmt.Fprintf(buf, "id: %s\n", strconv.Quote(f.ID))
+	fmt.Fprintf(buf, "date: %s\n", f.Created.In(loc).Format(time.RFC3339))
+	fmt.Fprintf(buf, "lastmod: %s\n", f.Modified.In(loc).Format(time.RFC3339))
+	buf.WriteString("---\n\n")
+}
+
 // ExportUploads will save uploads to {{TIMESTAMP}}-uploads.gz
 func (fs *FileSystem) ExportUploads() error {
 	dir := os.TempDir()
@@ -281,17 +825,12 @@ func (fs *FileSystem) ExportUploads() error {
 		}
 		fname := fmt.Sprintf("%s-%s", id, name)
 
-		r, err := gzip.NewReader(bytes.NewReader(data))
+		data, err = gunzipBlob(data)
 		if err != nil {
-			return err
-		}
-		var buf bytes.Buffer
-		_, err = buf.ReadFrom(r)
-		if err != nil {
-			return err
+			return errors.Wrap(err, "blob "+id)
 		}
 		fpath := filepath.Join(dir, fname)
-		err = os.WriteFile(fpath, buf.Bytes(), os.ModePerm)
+		err = os.WriteFile(fpath, data, os.ModePerm)
 		if err != nil {
 			return err
 		}
@@ -307,15 +846,30 @@ func (fs *FileSystem) ExportUploads() error {
 	return nil
 }
 
+// gunzipBlob returns the uncompressed data of a blob, passing through blobs
+// that were stored without compression.
+func gunzipBlob(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		return data, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	_, err = buf.ReadFrom(r)
+	return buf.Bytes(), err
+}
+
 // GetBlobIDs will return a list of blob ids
 func (fs *FileSystem) GetBlobIDs() ([]string, error) {
 	fs.Lock()
 	defer fs.Unlock()
-	stmt, err := fs.DB.Prepare(`SELECT id FROM blobs`)
+	stmt, done, err := fs.prepare(`SELECT id FROM blobs`)
 	if err != nil {
 		return nil, err
 	}
-	defer stmt.Close()
+	defer done()
 
 	result := []string{}
 	rows, err := stmt.Query()
@@ -338,11 +892,11 @@ func (fs *FileSystem) GetBlobIDs() ([]string, error) {
 func (fs *FileSystem) GetDomains() ([]string, error) {
 	fs.Lock()
 	defer fs.Unlock()
-	stmt, err := fs.DB.Prepare(`SELECT name FROM domains`)
+	stmt, done, err := fs.prepare(`SELECT name FROM domains`)
 	if err != nil {
 		return nil, err
 	}
-	defer stmt.Close()
+	defer done()
 
 	result := []string{}
 	rows, err := stmt.Query()
@@ -361,6 +915,63 @@ func (fs *FileSystem) GetDomains() ([]string, error) {
 	return result, nil
 }
 
+// GetDomainsPage returns the summaries of limit domains, sorted by name,
+// starting at offset, and the total number of domains.
+func (fs *FileSystem) GetDomainsPage(offset, limit int) (domains []DomainSummary, total int, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	err = fs.DB.QueryRow(`SELECT COUNT(*) FROM domains`).Scan(&total)
+	if err != nil {
+		err = errors.Wrap(err, "count GetDomainsPage")
+		return
+	}
+
+	rows, err := fs.DB.Query(`SELECT domains.name, domains.ispublic, domains.created, COUNT(fs.id)
+	FROM domains LEFT JOIN fs ON fs.domainid = domains.id
+	GROUP BY domains.id ORDER BY domains.name LIMIT ? OFFSET ?`, limit, offset)
+	if err != nil {
+		err = errors.Wrap(err, "query GetDomainsPage")
+		return
+	}
+	defer rows.Close()
+	domains = []DomainSummary{}
+	for rows.Next() {
+		var d DomainSummary
+		var ispublic sql.NullInt64
+		var created sql.NullTime
+		err = rows.Scan(&d.Name, &ispublic, &created, &d.Pages)
+		if err != nil {
+			err = errors.Wrap(err, "scan GetDomainsPage")
+			return
+		}
+		d.Public = ispublic.Int64 == 1
+		d.Created = created.Time
+		domains = append(domains, d)
+	}
+	err = rows.Err()
+	if err != nil {
+		err = errors.Wrap(err, "rows GetDomainsPage")
+	}
+	return
+}
+
+// GetUsage returns the number of pages of the domain and the bytes taken by
+// them and by the files uploaded to it.
+func (fs *FileSystem) GetUsage(domain string) (usage DomainUsage, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	domain = strings.ToLower(domain)
+	err = fs.DB.QueryRow(`SELECT
+		(SELECT COUNT(*) FROM fs INNER JOIN domains ON fs.domainid = domains.id WHERE domains.name = ?),
+		(SELECT COALESCE(SUM(LENGTH(fts.data)), 0) FROM fs INNER JOIN fts ON fs.id = fts.id INNER JOIN domains ON fs.domainid = domains.id WHERE domains.name = ?),
+		(SELECT COALESCE(SUM(blobs.size), 0) FROM blobs INNER JOIN domains ON blobs.domainid = domains.id WHERE domains.name = ?)`,
+		domain, domain, domain).Scan(&usage.Pages, &usage.PageBytes, &usage.UploadBytes)
+	if err != nil {
+		err = errors.Wrap(err, "GetUsage")
+	}
+	return
+}
+
 // SaveResizedImage will save a resized image
 func (fs *FileSystem) SaveResizedImage(id string, name string, blob []byte) (err error) {
 	fs.Lock()
@@ -406,12 +1017,13 @@ func (fs *FileSystem) GetResizedImage(id string) (name string, data []byte, view
 	fs.Lock()
 	defer fs.Unlock()
 
-	stmt, err := fs.DB.Prepare("SELECT name,data,views FROM cached_images WHERE id = ?")
+	// read and count the view together, so concurrent views aren't lost
+	tx, err := fs.DB.Begin()
 	if err != nil {
 		return
 	}
-	defer stmt.Close()
-	err = stmt.QueryRow(id).Scan(&name, &data, &views)
+	defer tx.Rollback()
+	err = tx.QueryRow("SELECT name,data,views FROM cached_images WHERE id = ?", id).Scan(&name, &data, &views)
 	if err != nil {
 		return
 	}
@@ -419,21 +1031,77 @@ func (fs *FileSystem) GetResizedImage(id string) (name string, data []byte, view
 	log.Debugf("id :%s, views: %d", id, views)
 
 	// update the views
-	tx, err := fs.DB.Begin()
+	_, err = tx.Exec("UPDATE cached_images SET views = views + 1 WHERE id = ?", id)
 	if err != nil {
 		return
 	}
-	stmt, err = tx.Prepare("UPDATE blobs SET views=? WHERE id=?")
+	err = tx.Commit()
+
+	return
+}
+
+// GetSession returns the data of the session with the id and when it was last
+// saved, sql.ErrNoRows if there is none.
+func (fs *FileSystem) GetSession(id string) (data string, modified time.Time, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	err = fs.DB.QueryRow(`SELECT data, modified FROM sessions WHERE id = ?`, id).Scan(&data, &modified)
+	return
+}
+
+// SaveSession sets the data of the session with the id.
+func (fs *FileSystem) SaveSession(id, data string) (err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	_, err = fs.DB.Exec(`INSERT OR REPLACE INTO sessions (id, data, modified) VALUES (?, ?, ?)`, id, data, time.Now().UTC())
 	if err != nil {
-		return
+		err = errors.Wrap(err, "SaveSession")
 	}
-	defer stmt.Close()
-	_, err = stmt.Exec(views+1, id)
+	return
+}
+
+// DeleteSessionsBefore removes the sessions last saved before the time,
+// returning how many were removed.
+func (fs *FileSystem) DeleteSessionsBefore(before time.Time) (n int64, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	res, err := fs.DB.Exec(`DELETE FROM sessions WHERE modified < ?`, before.UTC())
 	if err != nil {
-		return
+		return 0, errors.Wrap(err, "DeleteSessionsBefore")
 	}
-	err = tx.Commit()
+	return res.RowsAffected()
+}
+
+// DeleteSession removes the session with the id.
+func (fs *FileSystem) DeleteSession(id string) (err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	_, err = fs.DB.Exec(`DELETE FROM sessions WHERE id = ?`, id)
+	if err != nil {
+		err = errors.Wrap(err, "DeleteSession")
+	}
+	return
+}
 
+// SaveRenderedHTML caches the HTML of the file with the id, rendered from its
+// contents as of modified.
+func (fs *FileSystem) SaveRenderedHTML(id string, modified time.Time, html []byte) (err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	_, err = fs.DB.Exec(`INSERT OR REPLACE INTO cached_html (id, modified, tr) VALUES (?, ?, ?)`, id, modified, html)
+	if err != nil {
+		err = errors.Wrap(err, "SaveRenderedHTML")
+	}
+	return
+}
+
+// GetRenderedHTML returns the HTML of the file with the id cached by
+// SaveRenderedHTML, and the modified time of the contents it was rendered from.
+// It returns sql.ErrNoRows if there is none.
+func (fs *FileSystem) GetRenderedHTML(id string) (html []byte, modified time.Time, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	err = fs.DB.QueryRow(`SELECT tr, modified FROM cached_html WHERE id = ?`, id).Scan(&html, &modified)
 	return
 }
 
@@ -442,12 +1110,30 @@ func (fs *FileSystem) GetBlob(id string) (name string, data []byte, views int, e
 	fs.Lock()
 	defer fs.Unlock()
 
-	stmt, err := fs.DB.Prepare("SELECT name,data,views FROM blobs WHERE id = ?")
+	stmt, done, err := fs.prepare("SELECT name,views FROM blobs WHERE id = ?")
 	if err != nil {
 		return
 	}
-	defer stmt.Close()
-	err = stmt.QueryRow(id).Scan(&name, &data, &views)
+	defer done()
+	err = stmt.QueryRow(id).Scan(&name, &views)
+	if err != nil {
+		return
+	}
+	rows, err := fs.DB.Query("SELECT data FROM blob_chunks WHERE id = ? ORDER BY n", id)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var chunk []byte
+		err = rows.Scan(&chunk)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		data = append(data, chunk...)
+	}
+	rows.Close()
+	err = rows.Err()
 	if err != nil {
 		return
 	}
@@ -473,13 +1159,178 @@ func (fs *FileSystem) GetBlob(id string) (name string, data []byte, views int, e
 	return
 }
 
+// blobChunkSize is the number of bytes of a blob stored in each of its rows of
+// blob_chunks, and read at a time by the readers of GetBlobReader.
+const blobChunkSize = 1 << 20
+
+// GetBlobReader returns the name of a blob and a reader of its data, which
+// reads it a chunk at a time instead of all at once like GetBlob, with the size
+// of the data in bytes. It counts a view like GetBlob.
+func (fs *FileSystem) GetBlobReader(id string) (name string, r io.ReadCloser, size int64, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	err = fs.DB.QueryRow(`SELECT name,
+	(SELECT COALESCE(SUM(LENGTH(data)), 0) FROM blob_chunks WHERE blob_chunks.id = blobs.id)
+	FROM blobs WHERE id = ?`, id).Scan(&name, &size)
+	if err != nil {
+		return
+	}
+	_, err = fs.DB.Exec("UPDATE blobs SET views = views + 1 WHERE id = ?", id)
+	if err != nil {
+		return
+	}
+	r = &blobReader{fs: fs, id: id, size: size}
+	return
+}
+
+// blobReader reads the data of a blob a row of blob_chunks at a time.
+type blobReader struct {
+	fs     *FileSystem
+	id     string
+	size   int64
+	offset int64
+	next   int
+	chunk  []byte
+}
+
+func (b *blobReader) Read(p []byte) (n int, err error) {
+	if len(b.chunk) == 0 {
+		if b.offset >= b.size {
+			return 0, io.EOF
+		}
+		b.fs.Lock()
+		err = b.fs.DB.QueryRow("SELECT data FROM blob_chunks WHERE id = ? AND n = ?", b.id, b.next).Scan(&b.chunk)
+		b.fs.Unlock()
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && len(b.chunk) == 0) {
+			// deleted while being read
+			return 0, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return 0, errors.Wrap(err, "read blob "+b.id)
+		}
+		b.offset += int64(len(b.chunk))
+		b.next++
+	}
+	n = copy(p, b.chunk)
+	b.chunk = b.chunk[n:]
+	return
+}
+
+func (b *blobReader) Close() error {
+	b.chunk = nil
+	b.offset = b.size
+	return nil
+}
+
+// GetBlobInfo returns the name, MIME type and size of a blob, without its data
+// or counting a view. The type is empty for blobs uploaded by older versions.
+func (fs *FileSystem) GetBlobInfo(id string) (info BlobInfo, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	var mimetype, domain sql.NullString
+	var size sql.NullInt64
+	err = fs.DB.QueryRow(`SELECT blobs.id,blobs.name,blobs.mimetype,blobs.size,domains.name
+	FROM blobs LEFT JOIN domains ON blobs.domainid = domains.id WHERE blobs.id = ?`, id).
+		Scan(&info.ID, &info.Name, &mimetype, &size, &domain)
+	info.MimeType = mimetype.String
+	info.Size = int(size.Int64)
+	info.Domain = domain.String
+	return
+}
+
+// DeleteBlob removes an upload along with its resized copies, returning
+// ErrBlobNotFound if there is no upload with the id.
+func (fs *FileSystem) DeleteBlob(id string) (err error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	tx, err := fs.DB.Begin()
+	if err != nil {
+		return errors.Wrap(err, "begin DeleteBlob")
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`DELETE FROM blobs WHERE id = ?`, id)
+	if err != nil {
+		return errors.Wrap(err, "exec DeleteBlob")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "exec DeleteBlob")
+	}
+	if n == 0 {
+		return ErrBlobNotFound
+	}
+	_, err = tx.Exec(`DELETE FROM blob_chunks WHERE id = ?`, id)
+	if err != nil {
+		return errors.Wrap(err, "exec DeleteBlob")
+	}
+	// resized copies are stored under the id followed by their format and width
+	_, err = tx.Exec(`DELETE FROM cached_images WHERE id = ? OR substr(id, 1, ?) = ?`, id, len(id)+1, id+".")
+	if err != nil {
+		return errors.Wrap(err, "exec DeleteBlob")
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "commit DeleteBlob")
+	}
+	return
+}
+
+// CheckPageSize returns a PageTooLargeError if data is larger than MaxPageBytes
+func (fs *FileSystem) CheckPageSize(data string) error {
+	if fs.MaxPageBytes > 0 && len(data) > fs.MaxPageBytes {
+		return &PageTooLargeError{Size: len(data), Max: fs.MaxPageBytes}
+	}
+	return nil
+}
+
 // Save a file to the file system. Will insert or ignore, and then update.
 func (fs *FileSystem) Save(f File) (err error) {
+	return fs.SaveContext(context.Background(), f)
+}
+
+// SaveContext is Save, giving up on the queries not yet done once ctx is done.
+func (fs *FileSystem) SaveContext(ctx context.Context, f File) (err error) {
+	err = fs.CheckPageSize(f.Data)
+	if err != nil {
+		return
+	}
+
 	fs.Lock()
 	defer fs.Unlock()
+	return fs.save(ctx, f)
+}
 
+// UpdateContext changes the page with the id with update and saves it, holding
+// the lock from reading the page to saving it so no other save is lost in
+// between. Nothing is saved if update returns an error, which is returned.
+func (fs *FileSystem) UpdateContext(ctx context.Context, id, domain string, update func(f *File) error) (err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	files, err := fs.get(ctx, id, domain)
+	if err != nil {
+		return
+	} else if len(files) != 1 {
+		return errors.New("no single page " + id)
+	}
+	f := files[0]
+	f.Domain = domain
+	err = update(&f)
+	if err != nil {
+		return
+	}
+	err = fs.CheckPageSize(f.Data)
+	if err != nil {
+		return
+	}
+	return fs.save(ctx, f)
+}
+
+// save is SaveContext, for callers holding the lock.
+func (fs *FileSystem) save(ctx context.Context, f File) (err error) {
 	// get current history and then update the history
-	files, _ := fs.get(f.ID, f.Domain)
+	files, _ := fs.get(ctx, f.ID, f.Domain)
 	if len(files) == 1 {
 		f.History = files[0].History
 		f.History.Update(f.Data)
@@ -488,19 +1339,19 @@ func (fs *FileSystem) Save(f File) (err error) {
 	}
 	// make sure domain exists
 	if f.Domain == "" {
-		f.Domain = "public"
+		f.Domain = fs.publicDomain
 	}
-	domainid, _, _, _, _ := fs.getDomainFromName(f.Domain)
+	domainid, _, _, _, _, _ := fs.getDomainFromName(f.Domain)
 	if domainid == 0 {
 		return errors.New("domain does not exist")
 	}
 
-	tx, err := fs.DB.Begin()
+	tx, err := fs.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return errors.Wrap(err, "begin Save")
 	}
 
-	stmt, err := tx.Prepare(`
+	stmt, err := tx.PrepareContext(ctx, `
 	INSERT OR IGNORE INTO
 		fs
 	(
@@ -509,7 +1360,9 @@ func (fs *FileSystem) Save(f File) (err error) {
 		slug,
 		created,
 		modified,
-		history
+		history,
+		summary,
+		title
 	) 
 		values 	
 	(
@@ -518,6 +1371,8 @@ func (fs *FileSystem) Save(f File) (err error) {
 		?,
 		?,
 		?,
+		?,
+		?,
 		?
 	)`)
 	if err != nil {
@@ -525,14 +1380,18 @@ func (fs *FileSystem) Save(f File) (err error) {
 	}
 
 	historyBytes, _ := json.Marshal(f.History)
+	f.Summary = markdown.PlainText(f.Data, fs.SummaryLength)
+	f.Title = pageTitle(f)
 
-	_, err = stmt.Exec(
+	_, err = stmt.ExecContext(ctx,
 		f.ID,
 		domainid,
 		f.Slug,
 		f.Created,
 		time.Now().UTC(),
 		string(historyBytes),
+		f.Summary,
+		f.Title,
 	)
 	if err != nil {
 		return errors.Wrap(err, "exec Save")
@@ -544,15 +1403,17 @@ func (fs *FileSystem) Save(f File) (err error) {
 	}
 
 	// if it was ignored
-	tx2, err := fs.DB.Begin()
+	tx2, err := fs.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return errors.Wrap(err, "begin Save")
 	}
-	stmt2, err := tx2.Prepare(`
+	stmt2, err := tx2.PrepareContext(ctx, `
 	UPDATE fs SET 
 		slug = ?,
 		modified = ?,
-		history = ?
+		history = ?,
+		summary = ?,
+		title = ?
 	WHERE
 		id = ?
 	`)
@@ -561,10 +1422,12 @@ func (fs *FileSystem) Save(f File) (err error) {
 	}
 	defer stmt2.Close()
 
-	_, err = stmt2.Exec(
+	_, err = stmt2.ExecContext(ctx,
 		f.Slug,
 		time.Now().UTC(),
 		string(historyBytes),
+		f.Summary,
+		f.Title,
 		f.ID,
 	)
 	if err != nil {
@@ -578,7 +1441,7 @@ func (fs *FileSystem) Save(f File) (err error) {
 	// check if exists in fts
 	sqlStmt := "INSERT INTO fts(data,id) VALUES (?,?)"
 	var ftsHasID bool
-	ftsHasID, err = fs.idExists(f.ID)
+	ftsHasID, err = fs.idExists(ctx, f.ID)
 	if err != nil {
 		return errors.Wrap(err, "doesExist")
 	}
@@ -587,23 +1450,27 @@ func (fs *FileSystem) Save(f File) (err error) {
 	}
 
 	// update the index
-	tx3, err := fs.DB.Begin()
+	tx3, err := fs.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return errors.Wrap(err, "begin virtual Save")
 	}
-	stmt3, err := tx3.Prepare(sqlStmt)
+	stmt3, err := tx3.PrepareContext(ctx, sqlStmt)
 	if err != nil {
 		return errors.Wrap(err, "stmt virtual update")
 	}
 	defer stmt3.Close()
 
-	_, err = stmt3.Exec(
+	_, err = stmt3.ExecContext(ctx,
 		f.Data,
 		f.ID,
 	)
 	if err != nil {
 		return errors.Wrap(err, "exec virtual update")
 	}
+	err = setTags(ctx, tx3, f.ID, f.Data)
+	if err != nil {
+		return
+	}
 	err = tx3.Commit()
 	if err != nil {
 		return errors.Wrap(err, "commit virtual update")
@@ -612,13 +1479,58 @@ func (fs *FileSystem) Save(f File) (err error) {
 
 }
 
+// PublicDomain returns the name of the public domain, empty if there is none
+func (fs *FileSystem) PublicDomain() string {
+	return fs.publicDomain
+}
+
 // Close will make sure that the lock file is closed
 func (fs *FileSystem) Close() (err error) {
+	fs.stmtsMu.Lock()
+	for query, stmt := range fs.stmts {
+		stmt.Close()
+		delete(fs.stmts, query)
+	}
+	fs.stmtsMu.Unlock()
 	return fs.DB.Close()
 }
 
+// maxCachedStatements bounds the statements prepare keeps.
+const maxCachedStatements = 256
+
+// prepare returns the statement of the query, prepared once and then reused.
+// done must be called when finished with the statement, which closes it only
+// if it couldn't be cached.
+func (fs *FileSystem) prepare(query string) (stmt *sql.Stmt, done func(), err error) {
+	fs.stmtsMu.Lock()
+	defer fs.stmtsMu.Unlock()
+	done = func() {}
+	if stmt = fs.stmts[query]; stmt != nil {
+		return
+	}
+	stmt, err = fs.DB.Prepare(query)
+	if err != nil {
+		return
+	}
+	if len(fs.stmts) >= maxCachedStatements {
+		done = func() { stmt.Close() }
+		return
+	}
+	if fs.stmts == nil {
+		fs.stmts = make(map[string]*sql.Stmt)
+	}
+	fs.stmts[query] = stmt
+	return
+}
+
 // SetKey will set the key of a domain, throws an error if it already exists
 func (fs *FileSystem) SetKey(domain, password string) (key string, err error) {
+	return fs.SetKeyWithTTL(domain, password, 0)
+}
+
+// SetKeyWithTTL returns a new key of a domain, given its password, which
+// CheckKey rejects once ttl has passed. The key never expires if ttl is zero.
+func (fs *FileSystem) SetKeyWithTTL(domain, password string, ttl time.Duration) (key string, err error) {
 	// first check if it is a domain
 	fs.Lock()
 	defer fs.Unlock()
@@ -634,13 +1546,17 @@ func (fs *FileSystem) SetKey(domain, password string) (key string, err error) {
 	if err != nil {
 		return
 	}
-	stmt, err := tx.Prepare("insert into keys(domainid,key,lastused) values(?, ?,?)")
+	stmt, err := tx.Prepare("insert into keys(domainid,key,lastused,expires) values(?, ?,?,?)")
 	if err != nil {
 		return
 	}
 	defer stmt.Close()
 	key = utils.UUID()
-	_, err = stmt.Exec(domainid, key, time.Now().UTC())
+	var expires sql.NullTime
+	if ttl > 0 {
+		expires = sql.NullTime{Time: time.Now().UTC().Add(ttl), Valid: true}
+	}
+	_, err = stmt.Exec(domainid, key, time.Now().UTC(), expires)
 	if err != nil {
 		return
 	}
@@ -648,6 +1564,75 @@ func (fs *FileSystem) SetKey(domain, password string) (key string, err error) {
 	return
 }
 
+// ListKeys returns the keys of a domain, given its password, the most recently
+// used first. The keys are masked, so the list is safe to show.
+func (fs *FileSystem) ListKeys(domain, password string) (keys []KeyInfo, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	domainid, _, err := fs.validateDomain(domain, password)
+	if err != nil {
+		return
+	}
+	rows, err := fs.DB.Query("SELECT id, key, lastused, expires FROM keys WHERE domainid = ? ORDER BY lastused DESC", domainid)
+	if err != nil {
+		return nil, errors.Wrap(err, "ListKeys")
+	}
+	defer rows.Close()
+	keys = []KeyInfo{}
+	for rows.Next() {
+		var k KeyInfo
+		var key string
+		var lastUsed, expires sql.NullTime
+		err = rows.Scan(&k.ID, &key, &lastUsed, &expires)
+		if err != nil {
+			return nil, errors.Wrap(err, "ListKeys")
+		}
+		k.Masked = maskKey(key)
+		k.LastUsed = lastUsed.Time
+		k.Expires = expires.Time
+		keys = append(keys, k)
+	}
+	err = rows.Err()
+	return
+}
+
+// maskKey hides all but the last 4 characters of a key.
+func maskKey(key string) string {
+	if len(key) <= 4 {
+		return strings.Repeat("*", len(key))
+	}
+	return strings.Repeat("*", len(key)-4) + key[len(key)-4:]
+}
+
+// RevokeKey deletes a key of a domain, given its password, so it no longer
+// signs in. It returns ErrKeyNotFound if the domain has no such key.
+func (fs *FileSystem) RevokeKey(domain, password, key string) (err error) {
+	return fs.revokeKey(domain, password, "key = ?", key)
+}
+
+// RevokeKeyID deletes the key of a domain with the id given by ListKeys, like
+// RevokeKey.
+func (fs *FileSystem) RevokeKeyID(domain, password string, id int) (err error) {
+	return fs.revokeKey(domain, password, "id = ?", id)
+}
+
+func (fs *FileSystem) revokeKey(domain, password, condition string, arg any) (err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	domainid, _, err := fs.validateDomain(domain, password)
+	if err != nil {
+		return
+	}
+	res, err := fs.DB.Exec("DELETE FROM keys WHERE domainid = ? AND "+condition, domainid, arg)
+	if err != nil {
+		return errors.Wrap(err, "revokeKey")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrKeyNotFound
+	}
+	return
+}
+
 func (fs *FileSystem) UpdateViews(f File) (err error) {
 	fs.Lock()
 	defer fs.Unlock()
@@ -670,13 +1655,14 @@ func (fs *FileSystem) UpdateViews(f File) (err error) {
 	return
 }
 
-// CheckKey checks that it is a valid key for a domain
+// CheckKey checks that it is a valid key for a domain, which hasn't expired.
+// Expired keys are deleted.
 func (fs *FileSystem) CheckKey(key string) (domainid int, domain string, err error) {
 	fs.Lock()
 	defer fs.Unlock()
-	stmt, err := fs.DB.Prepare(`
+	stmt, done, err := fs.prepare(`
 	SELECT 
-	domains.id, domains.name
+	domains.id, domains.name, keys.expires
 	FROM keys 
 	
 	INNER JOIN domains 
@@ -687,8 +1673,9 @@ func (fs *FileSystem) CheckKey(key string) (domainid int, domain string, err err
 	if err != nil {
 		return
 	}
-	defer stmt.Close()
-	err = stmt.QueryRow(key).Scan(&domainid, &domain)
+	defer done()
+	var expires sql.NullTime
+	err = stmt.QueryRow(key).Scan(&domainid, &domain, &expires)
 	if err != nil {
 		return
 	}
@@ -696,6 +1683,12 @@ func (fs *FileSystem) CheckKey(key string) (domainid int, domain string, err err
 		err = errors.New("no such key")
 		return
 	}
+	if expires.Valid && !time.Now().UTC().Before(expires.Time) {
+		if _, errDelete := fs.DB.Exec("DELETE FROM keys WHERE key = ?", key); errDelete != nil {
+			log.Warn(errDelete)
+		}
+		return 0, "", errors.New("key expired")
+	}
 
 	return
 }
@@ -729,11 +1722,22 @@ func (fs *FileSystem) SetDomain(domain, password string) (err error) {
 	// first check if it is a domain
 	fs.Lock()
 	defer fs.Unlock()
-	domainid, _, _, _, _ := fs.getDomainFromName(domain)
+	domainid, _, _, _, _, _ := fs.getDomainFromName(domain)
 	if domainid != 0 {
 		err = errors.New("domain already exists")
 		return
 	}
+	if fs.MaxDomains > 0 {
+		// the public domain is built in, not one of those created
+		var count int
+		err = fs.DB.QueryRow(`SELECT COUNT(*) FROM domains WHERE name != ?`, fs.publicDomain).Scan(&count)
+		if err != nil {
+			return errors.Wrap(err, "count domains")
+		}
+		if count >= fs.MaxDomains {
+			return ErrTooManyDomains
+		}
+	}
 	return fs.setDomain(domain, password)
 }
 
@@ -744,7 +1748,7 @@ func (fs *FileSystem) setDomain(domain, password string) (err error) {
 		return errors.Wrap(err, "begin Save")
 	}
 
-	stmt, err := tx.Prepare(`INSERT INTO domains (name, hashed_pass, ispublic) VALUES (?,?,?)`)
+	stmt, err := tx.Prepare(`INSERT INTO domains (name, hashed_pass, ispublic, options, created) VALUES (?,?,?,?,?)`)
 	if err != nil {
 		return errors.Wrap(err, "stmt Save")
 	}
@@ -753,7 +1757,11 @@ func (fs *FileSystem) setDomain(domain, password string) (err error) {
 	if err != nil {
 		return errors.Wrap(err, "can't hash password")
 	}
-	_, err = stmt.Exec(domain, hashedPassword, 0)
+	options, err := json.Marshal(fs.NewDomainOptions)
+	if err != nil {
+		return errors.Wrap(err, "can't marshal options")
+	}
+	_, err = stmt.Exec(domain, hashedPassword, 0, options, time.Now().UTC())
 	if err != nil {
 		return errors.Wrap(err, "exec Save")
 	}
@@ -770,7 +1778,7 @@ func (fs *FileSystem) UpdateDomain(domain, password string, ispublic bool, optio
 	defer fs.Unlock()
 
 	// first check if it is a domain
-	domainid, _, _, _, _ := fs.getDomainFromName(domain)
+	domainid, _, _, _, _, _ := fs.getDomainFromName(domain)
 	if domainid == 0 {
 		err = errors.New("domain does not exist")
 		return
@@ -823,6 +1831,11 @@ func (fs *FileSystem) UpdateDomain(domain, password string, ispublic bool, optio
 		}
 	}
 	defer stmt.Close()
+	// the pages may render differently with the new options
+	_, err = tx.Exec(`DELETE FROM cached_html WHERE id IN (SELECT id FROM fs WHERE domainid = ?)`, domainid)
+	if err != nil {
+		return errors.Wrap(err, "clearing cached_html")
+	}
 	err = tx.Commit()
 	if err != nil {
 		return errors.Wrap(err, "commit Save")
@@ -830,10 +1843,76 @@ func (fs *FileSystem) UpdateDomain(domain, password string, ispublic bool, optio
 	return
 }
 
-// ValidateDomain returns the domain id or an error if the password doesn't match or if the domain doesn't exist
+// AddToDictionary adds the words the CustomDictionary of the domain doesn't
+// have to it, and returns the dictionary.
+func (fs *FileSystem) AddToDictionary(domain string, words []string) (dictionary []string, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	domain = strings.ToLower(domain)
+	domainid, _, _, options, _, err := fs.getDomainFromName(domain)
+	if err != nil {
+		return
+	}
+	if domainid == 0 {
+		err = errors.New("domain does not exist")
+		return
+	}
+	known := make(map[string]bool)
+	for _, word := range options.CustomDictionary {
+		known[word] = true
+	}
+	for _, word := range words {
+		if !known[word] {
+			known[word] = true
+			options.CustomDictionary = append(options.CustomDictionary, word)
+		}
+	}
+	if len(options.CustomDictionary) > MaxDictionaryWords {
+		err = ErrDictionaryFull
+		return
+	}
+	bOptions, _ := json.Marshal(options)
+	_, err = fs.DB.Exec(`UPDATE domains SET options = ? WHERE id = ?`, bOptions, domainid)
+	if err != nil {
+		err = errors.Wrap(err, "AddToDictionary")
+		return
+	}
+	dictionary = options.CustomDictionary
+	return
+}
+
+// RenameDomain renames a domain, keeping its pages and keys, given its
+// password. The new name must not be taken, nor be that of the public domain.
+func (fs *FileSystem) RenameDomain(oldName, newName, password string) (err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	oldName = strings.ToLower(strings.TrimSpace(oldName))
+	newName = strings.ToLower(strings.TrimSpace(newName))
+	if newName == "" {
+		return errors.New("domain must have a name")
+	}
+	if newName == "public" || newName == fs.publicDomain || oldName == fs.publicDomain {
+		return errors.New("cannot rename to or from the public domain")
+	}
+	domainid, _, err := fs.validateDomain(oldName, password)
+	if err != nil {
+		return
+	}
+	existing, _, _, _, _, _ := fs.getDomainFromName(newName)
+	if existing != 0 {
+		return errors.New("domain " + newName + " already exists")
+	}
+	_, err = fs.DB.Exec(`UPDATE domains SET name = ? WHERE id = ?`, newName, domainid)
+	if err != nil {
+		err = errors.Wrap(err, "RenameDomain")
+	}
+	return
+}
+
+// validateDomain returns the domain id or an error if the password doesn't match or if the domain doesn't exist
 func (fs *FileSystem) validateDomain(domain, password string) (domainid int, options DomainOptions, err error) {
 	domain = strings.ToLower(domain)
-	domainid, hashedPassword, _, options, err := fs.getDomainFromName(domain)
+	domainid, hashedPassword, _, options, _, err := fs.getDomainFromName(domain)
 	if domainid == 0 {
 		err = errors.New("domain " + domain + " does not exist")
 		return
@@ -848,148 +1927,474 @@ func (fs *FileSystem) validateDomain(domain, password string) (domainid int, opt
 	return
 }
 
-// GetDomainFromName returns the domain id, throwing an error if it doesn't exist
-func (fs *FileSystem) GetDomainFromName(domain string) (domainid int, ispublic bool, options DomainOptions, err error) {
+// GetDomainFromName returns the domain id, throwing an error if it doesn't exist.
+// The created time is zero for domains created by older versions.
+func (fs *FileSystem) GetDomainFromName(domain string) (domainid int, ispublic bool, options DomainOptions, created time.Time, err error) {
 	fs.Lock()
 	defer fs.Unlock()
 	domain = strings.ToLower(domain)
 	var ispublicint int
-	domainid, _, ispublicint, options, err = fs.getDomainFromName(domain)
+	domainid, _, ispublicint, options, created, err = fs.getDomainFromName(domain)
 	if domainid == 0 {
 		err = errors.New("domain " + domain + " does not exist")
 	}
-	ispublic = ispublicint == 1
+	ispublic = ispublicint == 1
+	return
+}
+
+func (fs *FileSystem) getDomainFromName(domain string) (domainid int, hashedPassword string, ispublic int, options DomainOptions, created time.Time, err error) {
+	// prepare statement
+	query := "SELECT id,hashed_pass,ispublic,options,created FROM domains WHERE name = ?"
+	stmt, done, err := fs.prepare(query)
+	if err != nil {
+		err = errors.Wrap(err, "preparing query: "+query)
+		return
+	}
+	defer done()
+	rows, err := stmt.Query(domain)
+	if err != nil {
+		err = errors.Wrap(err, query)
+		return
+	}
+
+	// loop through rows
+	defer rows.Close()
+	options = DefaultDomainOptions()
+	for rows.Next() {
+		var an_int64 sql.NullInt64
+		var b []byte
+		var createdTime sql.NullTime
+		err = rows.Scan(&domainid, &hashedPassword, &an_int64, &b, &createdTime)
+		if err != nil {
+			err = errors.Wrap(err, "getRows")
+			return
+		}
+		ispublic = int(an_int64.Int64)
+		created = createdTime.Time
+		json.Unmarshal(b, &options)
+	}
+	err = rows.Err()
+	if err != nil {
+		err = errors.Wrap(err, "getRows")
+	}
+	return
+}
+
+// GetAll returns all the non-empty published files for a given domain, without
+// their contents, files in the trash only if includeTrashed is set
+func (fs *FileSystem) GetAll(domain string, includeTrashed bool, created ...bool) (files []File, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	q := newFileQuery().Columns(summaryColumns).InDomain(domain).Drafts(false).Trashed(includeTrashed).OrderByRecent(created)
+	files, err = fs.getAllFromPreparedQuery(q.String(), q.Args()...)
+	for i := range files {
+		files[i].Domain = domain
+	}
+	return
+}
+
+// GetAllFiltered returns all the files for a given domain, including the drafts
+// (empty pages, such as those created by "new", and unpublished pages) if
+// includeDrafts is set
+func (fs *FileSystem) GetAllFiltered(domain string, includeDrafts bool, created ...bool) (files []File, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	q := newFileQuery().InDomain(domain).Drafts(includeDrafts).Trashed(false).OrderByRecent(created)
+	files, err = fs.getAllFromPreparedQuery(q.String(), q.Args()...)
+	for i := range files {
+		files[i].Domain = domain
+	}
+	return
+}
+
+// GetPage returns limit of the non-empty published files of a domain, starting
+// at offset, in the same order as GetAll and like it without their contents
+func (fs *FileSystem) GetPage(domain string, offset, limit int, created ...bool) (files []File, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	q := newFileQuery().Columns(summaryColumns).InDomain(domain).Drafts(false).Trashed(false).OrderByRecent(created).Limit(limit).Offset(offset)
+	files, err = fs.getAllFromPreparedQuery(q.String(), q.Args()...)
+	for i := range files {
+		files[i].Domain = domain
+	}
+	return
+}
+
+// GetSitemapPage returns limit of the files GetAll returns for a domain, from
+// offset, the oldest first so adding pages doesn't move the others.
+func (fs *FileSystem) GetSitemapPage(domain string, offset, limit int) (files []File, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	q := newFileQuery().Columns(summaryColumns).InDomain(domain).Drafts(false).Trashed(false).OrderBy("fs.created, fs.id").Limit(limit).Offset(offset)
+	files, err = fs.getAllFromPreparedQuery(q.String(), q.Args()...)
+	for i := range files {
+		files[i].Domain = domain
+	}
+	return
+}
+
+// CountFiles returns the number of files GetAll returns for a domain
+func (fs *FileSystem) CountFiles(domain string) (count int, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	q := newFileQuery().Columns("COUNT(*)").InDomain(domain).Drafts(false).Trashed(false)
+	err = fs.DB.QueryRow(q.String(), q.Args()...).Scan(&count)
+	if err != nil {
+		err = errors.Wrap(err, "CountFiles")
+	}
+	return
+}
+
+// GetList returns a page of files for a given domain without their contents,
+// along with the total number of files in the domain
+func (fs *FileSystem) GetList(domain string, offset, limit int, created ...bool) (files []File, total int, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	q := newFileQuery().Columns("COUNT(*)").InDomain(domain).Drafts(false).Trashed(false)
+	err = fs.DB.QueryRow(q.String(), q.Args()...).Scan(&total)
+	if err != nil {
+		err = errors.Wrap(err, "count GetList")
+		return
+	}
+
+	q = newFileQuery().Columns(listColumns).
+		InDomain(domain).Drafts(false).Trashed(false).OrderByRecent(created).Limit(limit).Offset(offset)
+	files, err = fs.getList(domain, q)
+	return
+}
+
+// GetListSince returns up to limit files of a domain without their contents,
+// changed after since or at since with an id after afterID, the least
+// recently changed first, see File.Changed. Files in the trash are listed
+// too if includeTrashed is set. Paging with the time changed and id of the
+// last file returned doesn't skip or repeat files when the domain changes, a
+// file changed meanwhile comes again on a later page.
+func (fs *FileSystem) GetListSince(domain string, since time.Time, afterID string, limit int, includeTrashed bool) (files []File, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	q := newFileQuery().Columns(listColumns).InDomain(domain).Drafts(false).Trashed(includeTrashed).
+		Where("("+changedColumn+" > ? OR ("+changedColumn+" = ? AND fs.id > ?))", since.UTC(), since.UTC(), afterID).
+		OrderBy(changedColumn + ", fs.id").Limit(limit)
+	return fs.getList(domain, q)
+}
+
+// DomainLastModified returns when a file of the domain was last changed, see
+// File.Changed, zero if it has no files.
+func (fs *FileSystem) DomainLastModified(domain string) (lastModified time.Time, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	q := newFileQuery().Columns("fs.modified, fs.deleted, fs.publish_at").InDomain(domain).OrderBy(changedColumn + " DESC").Limit(1)
+	var f File
+	var deleted, publishAt sql.NullTime
+	err = fs.DB.QueryRow(q.String(), q.Args()...).Scan(&f.Modified, &deleted, &publishAt)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	} else if err != nil {
+		err = errors.Wrap(err, "DomainLastModified")
+		return
+	}
+	f.Deleted = deleted.Time
+	f.PublishAt = publishAt.Time
+	return f.Changed(), nil
+}
+
+// changedColumn is File.Changed in SQL. Times are stored as text in UTC, which
+// sort as the times do, and the scheduled publishing time counts once it is
+// past the current time in the same format.
+const changedColumn = "MAX(fs.modified, IFNULL(fs.deleted, fs.modified), " +
+	"IFNULL(CASE WHEN fs.publish_at <= strftime('%Y-%m-%d %H:%M:%f+00:00', 'now') THEN fs.publish_at END, fs.modified))"
+
+// listColumns are the columns scanned by getList.
+const listColumns = "fs.id,fs.slug,fs.created,fs.modified,fs.views,fs.title,fs.deleted,fs.publish_at"
+
+// getList returns the files of a domain selected by a query of listColumns.
+func (fs *FileSystem) getList(domain string, q *fileQuery) (files []File, err error) {
+	rows, err := fs.DB.Query(q.String(), q.Args()...)
+	if err != nil {
+		err = errors.Wrap(err, q.String())
+		return
+	}
+	defer rows.Close()
+	files = []File{}
+	for rows.Next() {
+		f := File{Domain: domain}
+		var title sql.NullString
+		var deleted, publishAt sql.NullTime
+		err = rows.Scan(&f.ID, &f.Slug, &f.Created, &f.Modified, &f.Views, &title, &deleted, &publishAt)
+		if err != nil {
+			err = errors.Wrap(err, "get rows of file")
+			return
+		}
+		f.Title = title.String
+		f.Deleted = deleted.Time
+		f.PublishAt = publishAt.Time
+		files = append(files, f)
+	}
+	err = rows.Err()
+	if err != nil {
+		err = errors.Wrap(err, "getRows")
+	}
+	return
+}
+
+// GetTopX returns the info from a file, without its contents, files in the
+// trash only if includeTrashed is set
+func (fs *FileSystem) GetTopX(domain string, num int, includeTrashed bool, created ...bool) (files []File, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	q := newFileQuery().Columns(summaryColumns).InDomain(domain).Drafts(false).Trashed(includeTrashed).OrderByRecent(created).Limit(num)
+	return fs.getAllFromPreparedQuery(q.String(), q.Args()...)
+}
+
+// GetTopX returns the info from a file, without its contents
+func (fs *FileSystem) GetTopXMostViews(domain string, num int) (files []File, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	q := newFileQuery().Columns(summaryColumns).InDomain(domain).Drafts(false).Trashed(false).OrderBy("fs.views DESC").Limit(num)
+	return fs.getAllFromPreparedQuery(q.String(), q.Args()...)
+}
+
+// GetBacklinks returns the published pages of a domain that link to the page
+// with the slug, by a link to /domain/slug or to slug or by a wikilink, most
+// recent first, without their contents.
+func (fs *FileSystem) GetBacklinks(domain, slug string) (files []File, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	links := []string{"](/" + domain + "/" + slug + ")", "](" + slug + ")", "[[" + slug + "]]", "[[" + slug + "|", "[[" + slug + "#"}
+	conditions := make([]string, len(links))
+	args := make([]any, len(links))
+	for i, link := range links {
+		conditions[i] = "instr(fts.data, ?) > 0"
+		args[i] = link
+	}
+	q := newFileQuery().Columns(summaryColumns).InDomain(domain).Drafts(false).Trashed(false).
+		Where("fs.slug IS NOT ?", slug).
+		Where("("+strings.Join(conditions, " OR ")+")", args...).
+		OrderBy("fs.modified DESC")
+	return fs.getAllFromPreparedQuery(q.String(), q.Args()...)
+}
+
+// RenameTag renames the #tag old of the pages of a domain to new, returning how
+// many pages changed. See MergeTags.
+func (fs *FileSystem) RenameTag(domain, old, new string) (int, error) {
+	return fs.MergeTags(domain, []string{old}, new)
+}
+
+// MergeTags replaces the #tags from of the pages of a domain, whatever their
+// case, by the tag to in lower case, returning how many pages changed. Pages in
+// the trash and drafts are changed too, all of them in a single transaction.
+func (fs *FileSystem) MergeTags(domain string, from []string, to string) (changed int, err error) {
+	to = strings.ToLower(strings.TrimPrefix(to, "#"))
+	if !markdown.ValidTag(to) {
+		return 0, errors.New("invalid tag '" + to + "'")
+	}
+	merged := make(map[string]bool)
+	for _, tag := range from {
+		tag = strings.ToLower(strings.TrimPrefix(tag, "#"))
+		if tag != to {
+			merged[tag] = true
+		}
+	}
+	if len(merged) == 0 {
+		return
+	}
+
+	fs.Lock()
+	defer fs.Unlock()
+	q := newFileQuery().InDomain(domain)
+	files, err := fs.getAllFromPreparedQuery(q.String(), q.Args()...)
+	if err != nil {
+		return
+	}
+
+	tx, err := fs.DB.Begin()
+	if err != nil {
+		return 0, errors.Wrap(err, "begin MergeTags")
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			changed = 0
+		}
+	}()
+	now := time.Now().UTC()
+	for _, f := range files {
+		data := markdown.ReplaceTags(f.Data, func(tag string) (string, bool) {
+			return to, merged[tag]
+		})
+		if data == f.Data {
+			continue
+		}
+		f.Data = data
+		f.History.Update(data)
+		historyBytes, _ := json.Marshal(f.History)
+		_, err = tx.Exec(`UPDATE fs SET modified = ?, history = ?, summary = ?, title = ? WHERE id = ?`,
+			now, string(historyBytes), markdown.PlainText(data, fs.SummaryLength), pageTitle(f), f.ID)
+		if err != nil {
+			return 0, errors.Wrap(err, "update MergeTags")
+		}
+		var res sql.Result
+		res, err = tx.Exec(`UPDATE fts SET data = ? WHERE id = ?`, data, f.ID)
+		if err != nil {
+			return 0, errors.Wrap(err, "update fts MergeTags")
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			_, err = tx.Exec(`INSERT INTO fts(data,id) VALUES (?,?)`, data, f.ID)
+			if err != nil {
+				return 0, errors.Wrap(err, "insert fts MergeTags")
+			}
+		}
+		err = setTags(context.Background(), tx, f.ID, data)
+		if err != nil {
+			return 0, err
+		}
+		changed++
+	}
+	err = errors.Wrap(tx.Commit(), "commit MergeTags")
 	return
 }
 
-func (fs *FileSystem) getDomainFromName(domain string) (domainid int, hashedPassword string, ispublic int, options DomainOptions, err error) {
-	// prepare statement
-	query := "SELECT id,hashed_pass,ispublic,options FROM domains WHERE name = ?"
-	stmt, err := fs.DB.Prepare(query)
-	if err != nil {
-		err = errors.Wrap(err, "preparing query: "+query)
-		return
-	}
+// taggedPages restricts a query of tags joined with fs to the pages of a domain
+// that fileQuery's Drafts(false).Trashed(false) keeps, pages with #tags not
+// being empty. Its arguments are the domain and the current time.
+const taggedPages = `fs.domainid = (SELECT id FROM domains WHERE name = ?)
+		AND fs.published = 1 AND (fs.publish_at IS NULL OR fs.publish_at <= ?)
+		AND fs.deleted IS NULL`
 
-	defer stmt.Close()
-	rows, err := stmt.Query(domain)
+// GetTags returns the #tags of the published pages of a domain, with how many
+// pages use each.
+func (fs *FileSystem) GetTags(domain string) (tags map[string]int, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	rows, err := fs.DB.Query(`SELECT tags.tag, COUNT(*) FROM tags
+	INNER JOIN fs ON fs.id=tags.id
+	WHERE `+taggedPages+`
+	GROUP BY tags.tag`, domain, time.Now().UTC())
 	if err != nil {
-		err = errors.Wrap(err, query)
-		return
+		return nil, errors.Wrap(err, "query GetTags")
 	}
-
-	// loop through rows
 	defer rows.Close()
+	tags = make(map[string]int)
 	for rows.Next() {
-		var an_int64 sql.NullInt64
-		var b []byte
-		err = rows.Scan(&domainid, &hashedPassword, &an_int64, &b)
+		var tag string
+		var count int
+		err = rows.Scan(&tag, &count)
 		if err != nil {
-			err = errors.Wrap(err, "getRows")
-			return
+			return nil, errors.Wrap(err, "scan GetTags")
 		}
-		ispublic = int(an_int64.Int64)
-		json.Unmarshal(b, &options)
-	}
-	err = rows.Err()
-	if err != nil {
-		err = errors.Wrap(err, "getRows")
+		tags[tag] = count
 	}
+	err = errors.Wrap(rows.Err(), "rows GetTags")
 	return
 }
 
-// GetAll returns all the files for a given domain
-func (fs *FileSystem) GetAll(domain string, created ...bool) (files []File, err error) {
+// GetTagged returns the published pages of a domain using the #tag, whatever
+// its case, in the same order as GetAll and like it without their contents.
+func (fs *FileSystem) GetTagged(domain, tag string, created ...bool) (files []File, err error) {
+	tag = strings.ToLower(strings.TrimPrefix(tag, "#"))
 	fs.Lock()
 	defer fs.Unlock()
-	q := `SELECT fs.id,fs.slug,fs.created,fs.modified,fts.data,fs.history,fs.views FROM fs 
-	INNER JOIN fts ON fs.id=fts.id 
-	INNER JOIN domains ON fs.domainid=domains.id
-	WHERE 
-		domains.name = ?
-		AND LENGTH(fts.data) > 0
-	`
-	if len(created) > 0 && created[0] {
-		q += "ORDER BY fs.created DESC"
-	} else {
-		q += "ORDER BY fs.modified DESC"
-	}
-	files, err = fs.getAllFromPreparedQuery(q, domain)
+	// the unary + keeps SQLite from going through every page of the domain
+	// by fsmodified, instead of only those with the tag
+	q := newFileQuery().Columns(summaryColumns).Where("fs.id IN (SELECT id FROM tags WHERE tag = ?)", tag).
+		Where("+fs.domainid = (SELECT id FROM domains WHERE name = ?)", domain).
+		Drafts(false).Trashed(false).OrderByRecent(created)
+	files, err = fs.getAllFromPreparedQuery(q.String(), q.Args()...)
 	for i := range files {
 		files[i].Domain = domain
 	}
 	return
 }
 
-// GetTopX returns the info from a file
-func (fs *FileSystem) GetTopX(domain string, num int, created ...bool) (files []File, err error) {
-	fs.Lock()
-	defer fs.Unlock()
-	q := `
-	SELECT fs.id,fs.slug,fs.created,fs.modified,fts.data,fs.history,fs.views FROM fs 
-	INNER JOIN fts ON fs.id=fts.id 
-	INNER JOIN domains ON fs.domainid=domains.id
-	WHERE 
-		domains.name = ?
-		AND LENGTH(fts.data) > 0
-
-		`
-	if len(created) > 0 && created[0] {
-		q += "ORDER BY fs.created DESC"
-	} else {
-		q += "ORDER BY fs.modified DESC"
+// relatedTerms is the number of words of a page searched for by GetRelated.
+const relatedTerms = 10
+
+// GetRelated returns up to limit published pages of a domain related to the
+// page with the id, as chosen by DomainOptions.RelatedPages, sharing #tags with
+// it if none is.
+func (fs *FileSystem) GetRelated(id, domain string, limit int) (files []File, err error) {
+	_, _, options, _, err := fs.GetDomainFromName(domain)
+	if err != nil {
+		return
+	}
+	pages, err := fs.Get(id, domain)
+	if err != nil {
+		return
+	} else if len(pages) != 1 {
+		return nil, errors.New("no single page " + id)
+	}
+	page := pages[0]
+
+	if options.RelatedPages == RelatedByContent {
+		query := RelatedFTSQuery(markdown.PlainText(page.Data, len(page.Data)), relatedTerms)
+		if query == "" {
+			return []File{}, nil
+		}
+		fs.Lock()
+		defer fs.Unlock()
+		q := newFileQuery().Match(query).InDomain(domain).Drafts(false).Trashed(false).
+			Where("fs.id != ?", page.ID).
+			OrderBy("bm25(fts)").
+			Limit(limit)
+		return fs.getAllFromPreparedQuery(q.String(), q.Args()...)
 	}
-	q += " LIMIT ?"
-	return fs.getAllFromPreparedQuery(q, domain, num)
-}
 
-// GetTopX returns the info from a file
-func (fs *FileSystem) GetTopXMostViews(domain string, num int) (files []File, err error) {
 	fs.Lock()
 	defer fs.Unlock()
-	return fs.getAllFromPreparedQuery(`
-	SELECT fs.id,fs.slug,fs.created,fs.modified,fts.data,fs.history,fs.views FROM fs 
-	INNER JOIN fts ON fs.id=fts.id 
-	INNER JOIN domains ON fs.domainid=domains.id
-	WHERE 
-		domains.name = ?
-		AND LENGTH(fts.data) > 0
-	ORDER BY fs.views DESC LIMIT ?`, domain, num)
+	// the most recent first among those sharing as many tags, the CROSS JOIN
+	// starting from the pages with the tags rather than those of the domain
+	ids, err := fs.getAllFromPreparedQuerySingleString(`SELECT tags.id FROM tags
+	CROSS JOIN fs ON fs.id=tags.id
+	WHERE tags.tag IN (SELECT tag FROM tags WHERE id = ?) AND tags.id != ?
+		AND `+taggedPages+`
+	GROUP BY tags.id
+	ORDER BY COUNT(*) DESC, fs.modified DESC
+	LIMIT ?`, page.ID, page.ID, domain, time.Now().UTC(), limit)
+	if err != nil || len(ids) == 0 {
+		return []File{}, err
+	}
+	in := make([]any, len(ids))
+	rank := make(map[string]int, len(ids))
+	for i, id := range ids {
+		in[i] = id
+		rank[id] = i
+	}
+	q := newFileQuery().Where("fs.id IN (?"+strings.Repeat(",?", len(ids)-1)+")", in...)
+	files, err = fs.getAllFromPreparedQuery(q.String(), q.Args()...)
+	sort.Slice(files, func(i, j int) bool {
+		return rank[files[i].ID] < rank[files[j].ID]
+	})
+	return
 }
 
 // Get returns the info from a file
 func (fs *FileSystem) Get(id string, domain string) (files []File, err error) {
+	return fs.GetContext(context.Background(), id, domain)
+}
+
+// GetContext is Get, giving up on the query once ctx is done.
+func (fs *FileSystem) GetContext(ctx context.Context, id string, domain string) (files []File, err error) {
 	fs.Lock()
 	defer fs.Unlock()
-	return fs.get(id, domain)
+	return fs.get(ctx, id, domain)
 }
 
-func (fs *FileSystem) get(id string, domain string) (files []File, err error) {
-	haveID, err := fs.isID(id)
+func (fs *FileSystem) get(ctx context.Context, id string, domain string) (files []File, err error) {
+	haveID, err := fs.isID(ctx, id)
 	if err != nil {
 		err = errors.Wrap(err, "isID")
 		return
 	}
 	if haveID {
-		files, err = fs.getAllFromPreparedQuery(`
-		SELECT fs.id,fs.slug,fs.created,fs.modified,fts.data,fs.history,fs.views FROM fs 
-		INNER JOIN fts ON fs.id=fts.id 
-		WHERE fs.id = ? LIMIT 1`, id)
+		q := newFileQuery().Where("fs.id = ?", id).Limit(1)
+		files, err = fs.getAllFromPreparedQueryContext(ctx, q.String(), q.Args()...)
 		if err != nil {
 			err = errors.Wrap(err, "get from id")
 			return
 		}
 	} else {
-		files, err = fs.getAllFromPreparedQuery(`
-		SELECT fs.id,fs.slug,fs.created,fs.modified,fts.data,fs.history,fs.views
-		FROM fs 
-		INNER JOIN fts ON fs.id=fts.id 
-		INNER JOIN domains ON fs.domainid=domains.id
-		WHERE 
-			fs.id IN (SELECT id FROM fs WHERE slug=?) 
-			AND
-			domains.name = ?
-			ORDER BY modified DESC`, id, domain)
+		q := newFileQuery().Where("fs.slug = ?", id).InDomain(domain).OrderBy("fs.modified DESC")
+		files, err = fs.getAllFromPreparedQueryContext(ctx, q.String(), q.Args()...)
 		if err != nil {
 			err = errors.Wrap(err, "get from slug")
 			return
@@ -1007,13 +2412,12 @@ func (fs *FileSystem) get(id string, domain string) (files []File, err error) {
 func (fs *FileSystem) LastModified() (lastModified time.Time, err error) {
 	// prepare statement
 	query := "SELECT modified FROM fs ORDER BY modified DESC LIMIT 1"
-	stmt, err := fs.DB.Prepare(query)
+	stmt, done, err := fs.prepare(query)
 	if err != nil {
 		err = errors.Wrap(err, "preparing query: "+query)
 		return
 	}
-
-	defer stmt.Close()
+	defer done()
 	rows, err := stmt.Query()
 	if err != nil {
 		err = errors.Wrap(err, query)
@@ -1036,24 +2440,211 @@ func (fs *FileSystem) LastModified() (lastModified time.Time, err error) {
 	return
 }
 
-// Find returns the info from a file
-func (fs *FileSystem) Find(text string, domain string) (files []File, err error) {
+// Find returns the info from the files matching the search text, sanitized by
+// SanitizeFTSQuery, the most relevant first if byRelevance is set and the most
+// recently modified first otherwise, files in the trash only if includeTrashed
+// is set
+func (fs *FileSystem) Find(text string, domain string, byRelevance bool, includeTrashed ...bool) (files []File, err error) {
+	return fs.FindContext(context.Background(), text, domain, byRelevance, includeTrashed...)
+}
+
+// FindContext is Find, giving up on the query once ctx is done.
+func (fs *FileSystem) FindContext(ctx context.Context, text string, domain string, byRelevance bool, includeTrashed ...bool) (files []File, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	text = SanitizeFTSQuery(text)
+	if text == "" {
+		files = []File{}
+		return
+	}
+	orderBy := "fs.modified DESC"
+	if byRelevance {
+		orderBy = "bm25(fts)"
+	}
+	q := newFileQuery().Columns("fs.id,fs.slug,fs.created,fs.modified,snippet(fts, 1, '<b>', '</b>', '...', 30),fs.history,fs.views,fs.published,fs.publish_at,fs.summary,fs.title,fs.deleted,-bm25(fts)").
+		Match(text).InDomain(domain).Published().Trashed(len(includeTrashed) > 0 && includeTrashed[0]).OrderBy(orderBy)
+	files, err = fs.getAllFromPreparedQueryContext(ctx, q.String(), q.Args()...)
+	return
+}
+
+// RecentlyModified returns the pages of a domain changed within since, the
+// most recent first, with their Previous contents from before the changes.
+// Pages created within since have no previous contents.
+func (fs *FileSystem) RecentlyModified(domain string, since time.Duration) (files []File, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	cutoff := time.Now().UTC().Add(-since)
+	q := newFileQuery().InDomain(domain).Trashed(false).Where("fs.modified > ?", cutoff).OrderBy("fs.modified DESC")
+	files, err = fs.getAllFromPreparedQuery(q.String(), q.Args()...)
+	if err != nil {
+		return
+	}
+	for i := range files {
+		files[i].Domain = domain
+		snapshots := files[i].History.GetSnapshots()
+		if files[i].Created.After(cutoff) || (len(snapshots) > 0 && snapshots[0] > cutoff.UnixNano()) {
+			// it was empty before
+			continue
+		} else if len(snapshots) == 0 {
+			files[i].Previous = files[i].Data
+			continue
+		}
+		files[i].Previous, err = files[i].History.GetPreviousByTimestamp(cutoff.UnixNano())
+		if err != nil {
+			err = errors.Wrap(err, "RecentlyModified "+files[i].ID)
+			return
+		}
+	}
+	return
+}
+
+// GetActivity returns the latest limit creations, modifications and deletions
+// of the published pages of a domain, the most recent first. Only the last
+// modification of each page is listed, and none of pages in the trash.
+func (fs *FileSystem) GetActivity(domain string, limit int) (activity []ActivityEntry, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	now := time.Now().UTC()
+	rows, err := fs.DB.Query(`SELECT 'created', fs.created, fs.id, fs.slug, fs.title
+	FROM fs INNER JOIN domains ON fs.domainid = domains.id
+	WHERE domains.name = ? AND fs.published = 1 AND (fs.publish_at IS NULL OR fs.publish_at <= ?)
+		AND fs.deleted IS NULL
+	UNION ALL
+	SELECT 'modified', fs.modified, fs.id, fs.slug, fs.title
+	FROM fs INNER JOIN domains ON fs.domainid = domains.id
+	WHERE domains.name = ? AND fs.published = 1 AND (fs.publish_at IS NULL OR fs.publish_at <= ?)
+		AND fs.deleted IS NULL AND julianday(fs.modified) > julianday(fs.created) + 1.0/86400
+	UNION ALL
+	SELECT 'deleted', fs.deleted, fs.id, fs.slug, fs.title
+	FROM fs INNER JOIN domains ON fs.domainid = domains.id
+	WHERE domains.name = ? AND fs.published = 1 AND fs.deleted IS NOT NULL
+	ORDER BY 2 DESC LIMIT ?`, domain, now, domain, now, domain, limit)
+	if err != nil {
+		err = errors.Wrap(err, "query GetActivity")
+		return
+	}
+	defer rows.Close()
+	activity = []ActivityEntry{}
+	for rows.Next() {
+		var e ActivityEntry
+		var slug, title sql.NullString
+		err = rows.Scan(&e.Kind, &e.Time, &e.ID, &slug, &title)
+		if err != nil {
+			err = errors.Wrap(err, "scan GetActivity")
+			return
+		}
+		e.Slug = slug.String
+		e.Title = title.String
+		activity = append(activity, e)
+	}
+	err = rows.Err()
+	if err != nil {
+		err = errors.Wrap(err, "rows GetActivity")
+	}
+	return
+}
+
+// TrashFile moves a page to the trash, hiding it from the listings and search
+// results of its domain until it is restored.
+func (fs *FileSystem) TrashFile(id, domain string) error {
+	now := time.Now().UTC()
+	return fs.setDeleted(id, domain, &now, nil)
+}
+
+// RestoreFile takes a page out of the trash, which counts as modifying it so
+// GetListSince lists it again.
+func (fs *FileSystem) RestoreFile(id, domain string) error {
+	now := time.Now().UTC()
+	return fs.setDeleted(id, domain, nil, &now)
+}
+
+// setDeleted sets when the page was trashed, and when it was modified unless
+// modified is nil.
+func (fs *FileSystem) setDeleted(id, domain string, deleted, modified *time.Time) (err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	res, err := fs.DB.Exec(`UPDATE fs SET deleted = ?, modified = COALESCE(?, modified)
+	WHERE id = ? AND domainid IN (SELECT id FROM domains WHERE name = ?)`, deleted, modified, id, domain)
+	if err != nil {
+		return errors.Wrap(err, "setDeleted")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "setDeleted")
+	}
+	if n == 0 {
+		return errors.New("no file with that id")
+	}
+	return
+}
+
+// GetTrash returns the pages of a domain in the trash, the most recently
+// trashed first, without their contents.
+func (fs *FileSystem) GetTrash(domain string) (files []File, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	q := newFileQuery().Columns(summaryColumns).InDomain(domain).Where("fs.deleted IS NOT NULL").OrderBy("fs.deleted DESC")
+	files, err = fs.getAllFromPreparedQuery(q.String(), q.Args()...)
+	for i := range files {
+		files[i].Domain = domain
+	}
+	return
+}
+
+// Publish shows a page in the listings and search results of its domain
+func (fs *FileSystem) Publish(id, domain string) error {
+	return fs.setPublished(id, domain, true, nil)
+}
+
+// Unpublish hides a page from the listings and search results of its domain,
+// it can still be viewed and edited by the owner
+func (fs *FileSystem) Unpublish(id, domain string) error {
+	return fs.setPublished(id, domain, false, nil)
+}
+
+// SchedulePublish publishes a page once the time is past
+func (fs *FileSystem) SchedulePublish(id, domain string, at time.Time) error {
+	at = at.UTC()
+	return fs.setPublished(id, domain, true, &at)
+}
+
+// GetScheduled returns the files of a domain which are scheduled to be
+// published, the soonest first, without their contents
+func (fs *FileSystem) GetScheduled(domain string) (files []File, err error) {
 	fs.Lock()
 	defer fs.Unlock()
+	q := newFileQuery().Columns(summaryColumns).InDomain(domain).Trashed(false).Where("fs.published = 1").
+		Where("fs.publish_at > ?", time.Now().UTC()).OrderBy("fs.publish_at")
+	files, err = fs.getAllFromPreparedQuery(q.String(), q.Args()...)
+	for i := range files {
+		files[i].Domain = domain
+	}
+	return
+}
 
-	files, err = fs.getAllFromPreparedQuery(`
-		SELECT fs.id,fs.slug,fs.created,fs.modified,snippet(fts, 1, '<b>', '</b>', '...', 30),fs.history,fs.views FROM fts 
-			INNER JOIN fs ON fs.id=fts.id 
-			INNER JOIN domains ON fs.domainid=domains.id
-			WHERE fts.data MATCH ?
-			AND domains.name = ?
-			ORDER BY modified DESC`, text, domain)
+func (fs *FileSystem) setPublished(id, domain string, published bool, at *time.Time) (err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	// a modified page is listed again by GetListSince
+	res, err := fs.DB.Exec(`UPDATE fs SET published = ?, publish_at = ?, modified = ?
+	WHERE id = ? AND domainid IN (SELECT id FROM domains WHERE name = ?)`, published, at, time.Now().UTC(), id, domain)
+	if err != nil {
+		return errors.Wrap(err, "update published")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "update published")
+	}
+	if n == 0 {
+		err = errors.New("no files with that id")
+	}
 	return
 }
 
 // Exists returns whether specified ID exists exists
-func (fs *FileSystem) idExists(id string) (exists bool, err error) {
-	files, err := fs.getAllFromPreparedQuerySingleString(`
+func (fs *FileSystem) idExists(ctx context.Context, id string) (exists bool, err error) {
+	files, err := fs.getAllFromPreparedQuerySingleStringContext(ctx, `
 		SELECT id FROM fts WHERE id = ?`, id)
 	if err != nil {
 		err = errors.Wrap(err, "Exists")
@@ -1065,8 +2656,8 @@ func (fs *FileSystem) idExists(id string) (exists bool, err error) {
 }
 
 // isID returns whether specified ID exists exists
-func (fs *FileSystem) isID(id string) (exists bool, err error) {
-	files, err := fs.getAllFromPreparedQuerySingleString(`
+func (fs *FileSystem) isID(ctx context.Context, id string) (exists bool, err error) {
+	files, err := fs.getAllFromPreparedQuerySingleStringContext(ctx, `
 		SELECT id FROM fs WHERE id = ?`, id)
 	if err != nil {
 		err = errors.Wrap(err, "Exists")
@@ -1079,11 +2670,6 @@ func (fs *FileSystem) isID(id string) (exists bool, err error) {
 
 // Exists returns whether specified id or slug exists
 func (fs *FileSystem) Exists(id string, domain string) (trueID string, many bool, err error) {
-	// timeStart := time.Now().UTC()
-	// defer func() {
-	// 	log.Debugf("checked exists %s/%s in %s", domain, id, time.Since(timeStart))
-	// }()
-
 	// fs.Lock()
 	// defer fs.Unlock()
 
@@ -1114,21 +2700,227 @@ func (fs *FileSystem) Exists(id string, domain string) (trueID string, many bool
 	return
 }
 
+// FindDuplicateSlugs returns the slugs shared by several pages of a domain,
+// with the ids of those pages, which make Get by slug ambiguous.
+func (fs *FileSystem) FindDuplicateSlugs(domain string) (duplicates map[string][]string, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	rows, err := fs.DB.Query(`SELECT fs.slug, fs.id FROM fs
+	INNER JOIN domains ON fs.domainid = domains.id
+	WHERE domains.name = ? AND fs.slug != '' AND fs.slug IN (
+		SELECT slug FROM fs WHERE domainid = domains.id GROUP BY slug HAVING COUNT(*) > 1
+	)
+	ORDER BY fs.slug, fs.created`, domain)
+	if err != nil {
+		err = errors.Wrap(err, "query FindDuplicateSlugs")
+		return
+	}
+	defer rows.Close()
+	duplicates = make(map[string][]string)
+	for rows.Next() {
+		var slug, id string
+		err = rows.Scan(&slug, &id)
+		if err != nil {
+			err = errors.Wrap(err, "scan FindDuplicateSlugs")
+			return
+		}
+		duplicates[slug] = append(duplicates[slug], id)
+	}
+	err = rows.Err()
+	if err != nil {
+		err = errors.Wrap(err, "rows FindDuplicateSlugs")
+	}
+	return
+}
+
+// Ping checks that the database can be reached and queried.
+func (fs *FileSystem) Ping(ctx context.Context) (err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	err = fs.DB.PingContext(ctx)
+	if err != nil {
+		return errors.Wrap(err, "ping")
+	}
+	var one int
+	err = fs.DB.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+	return errors.Wrap(err, "SELECT 1")
+}
+
+// Stats returns the size of the database and the number of rows of its tables.
+func (fs *FileSystem) Stats() (stats DBStats, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	for pragma, v := range map[string]*int64{
+		"page_count":     &stats.PageCount,
+		"page_size":      &stats.PageSize,
+		"freelist_count": &stats.FreelistCount,
+	} {
+		err = fs.DB.QueryRow("PRAGMA " + pragma).Scan(v)
+		if err != nil {
+			return stats, errors.Wrap(err, pragma)
+		}
+	}
+	// the index of fts is in blocks of its shadow table
+	err = fs.DB.QueryRow("SELECT COALESCE(SUM(LENGTH(block)), 0) FROM fts_data").Scan(&stats.FTSBytes)
+	if err != nil {
+		return stats, errors.Wrap(err, "fts size")
+	}
+
+	tables, err := fs.getAllFromPreparedQuerySingleString(`SELECT name FROM sqlite_master
+	WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name`)
+	if err != nil {
+		return stats, errors.Wrap(err, "tables")
+	}
+	stats.Tables = make(map[string]int64, len(tables))
+	for _, table := range tables {
+		var rows int64
+		err = fs.DB.QueryRow(`SELECT COUNT(*) FROM "` + table + `"`).Scan(&rows)
+		if err != nil {
+			return stats, errors.Wrap(err, "count "+table)
+		}
+		stats.Tables[table] = rows
+	}
+	return
+}
+
+// ExplainQueries returns the query plans of the main queries reading the
+// pages of the domain, to see which indexes they use.
+func (fs *FileSystem) ExplainQueries(domain string) (plans []QueryPlan, err error) {
+	const limit = 10
+	queries := []struct {
+		name string
+		q    *fileQuery
+	}{
+		{"get by slug", newFileQuery().Where("fs.slug = ?", "slug").InDomain(domain).OrderBy("fs.modified DESC")},
+		{"list by modified", newFileQuery().Columns(listColumns).InDomain(domain).Drafts(false).Trashed(false).OrderByRecent(nil).Limit(limit)},
+		{"list by created", newFileQuery().Columns(listColumns).InDomain(domain).Drafts(false).Trashed(false).OrderByRecent([]bool{true}).Limit(limit)},
+		{"most viewed", newFileQuery().InDomain(domain).Drafts(false).Trashed(false).OrderBy("fs.views DESC").Limit(limit)},
+		{"count", newFileQuery().Columns("COUNT(*)").InDomain(domain).Drafts(false).Trashed(false)},
+		{"changed since", newFileQuery().Columns(listColumns).InDomain(domain).Drafts(false).
+			Where("("+changedColumn+" > ? OR ("+changedColumn+" = ? AND fs.id > ?))", time.Time{}, time.Time{}, "").
+			OrderBy(changedColumn + ", fs.id").Limit(limit)},
+		{"search", newFileQuery().Match(SanitizeFTSQuery("text")).InDomain(domain).Published().Trashed(false).OrderBy("bm25(fts)")},
+	}
+
+	fs.Lock()
+	defer fs.Unlock()
+	for _, query := range queries {
+		plan := QueryPlan{Name: query.name, Query: query.q.String()}
+		plan.Plan, err = fs.explain(plan.Query, query.q.Args()...)
+		if err != nil {
+			return nil, errors.Wrap(err, "explain "+query.name)
+		}
+		plans = append(plans, plan)
+	}
+	return
+}
+
+// explain returns the steps of EXPLAIN QUERY PLAN, indented by depth.
+func (fs *FileSystem) explain(query string, args ...any) (plan []string, err error) {
+	rows, err := fs.DB.Query("EXPLAIN QUERY PLAN "+query, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	depths := make(map[int]int)
+	for rows.Next() {
+		var id, parent, notUsed int
+		var detail string
+		err = rows.Scan(&id, &parent, &notUsed, &detail)
+		if err != nil {
+			return
+		}
+		depths[id] = depths[parent] + 1
+		plan = append(plan, strings.Repeat("  ", depths[id]-1)+detail)
+	}
+	err = rows.Err()
+	return
+}
+
+// VerifyConsistency returns the ids of files present in only one of the fs and
+// fts tables, which Save leaves behind when it is interrupted. Files missing
+// from fts, which no listing shows, are put back in it from their history.
+func (fs *FileSystem) VerifyConsistency() (ids []string, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+	ids, err = fs.getAllFromPreparedQuerySingleString(`
+	SELECT fs.id FROM fs WHERE fs.id NOT IN (SELECT id FROM fts)
+	UNION
+	SELECT fts.id FROM fts WHERE fts.id NOT IN (SELECT id FROM fs)`)
+	if err != nil || len(ids) == 0 {
+		return
+	}
+
+	rows, err := fs.DB.Query(`SELECT id, history FROM fs WHERE id NOT IN (SELECT id FROM fts)`)
+	if err != nil {
+		return ids, errors.Wrap(err, "query VerifyConsistency")
+	}
+	files := []File{}
+	for rows.Next() {
+		var f File
+		var history sql.NullString
+		err = rows.Scan(&f.ID, &history)
+		if err != nil {
+			rows.Close()
+			return ids, errors.Wrap(err, "scan VerifyConsistency")
+		}
+		if history.Valid {
+			err = json.Unmarshal([]byte(history.String), &f.History)
+			if err != nil {
+				rows.Close()
+				return ids, errors.Wrap(err, "could not parse history")
+			}
+		}
+		files = append(files, f)
+	}
+	rows.Close()
+	if len(files) == 0 {
+		return
+	}
+
+	tx, err := fs.DB.Begin()
+	if err != nil {
+		return ids, errors.Wrap(err, "begin VerifyConsistency")
+	}
+	defer tx.Rollback()
+	for _, f := range files {
+		data := f.History.GetCurrent()
+		_, err = tx.Exec(`INSERT INTO fts(data,id) VALUES (?,?)`, data, f.ID)
+		if err != nil {
+			return ids, errors.Wrap(err, "insert fts VerifyConsistency")
+		}
+		err = setTags(context.Background(), tx, f.ID, data)
+		if err != nil {
+			return
+		}
+	}
+	log.Infof("put %d pages back in fts from their history", len(files))
+	return ids, errors.Wrap(tx.Commit(), "commit VerifyConsistency")
+}
+
+// logSlowQuery logs the query if it took longer than SlowQuery since start.
+func (fs *FileSystem) logSlowQuery(query string, start time.Time) {
+	if fs.SlowQuery <= 0 {
+		return
+	}
+	if took := time.Since(start); took > fs.SlowQuery {
+		log.Warnf("slow query in %s: %s", took, strings.Join(strings.Fields(query), " "))
+	}
+}
+
 func (fs *FileSystem) getAllFromPreparedQuery(query string, args ...any) (files []File, err error) {
-	// timeStart := time.Now().UTC()
-	// defer func() {
-	// 	log.Debugf("getAllFromPreparedQuery %s in %s", query, time.Since(timeStart))
-	// }()
+	return fs.getAllFromPreparedQueryContext(context.Background(), query, args...)
+}
 
+func (fs *FileSystem) getAllFromPreparedQueryContext(ctx context.Context, query string, args ...any) (files []File, err error) {
 	// prepare statement
-	stmt, err := fs.DB.Prepare(query)
+	stmt, done, err := fs.prepare(query)
 	if err != nil {
 		err = errors.Wrap(err, "preparing query: "+query)
 		return
 	}
-
-	defer stmt.Close()
-	rows, err := stmt.Query(args...)
+	defer done()
+	rows, err := stmt.QueryContext(ctx, args...)
 	if err != nil {
 		err = errors.Wrap(err, query)
 		return
@@ -1136,19 +2928,38 @@ func (fs *FileSystem) getAllFromPreparedQuery(query string, args ...any) (files
 
 	// loop through rows
 	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		err = errors.Wrap(err, "get columns")
+		return
+	}
 	files = []File{}
 	for rows.Next() {
 		var f File
+		var data sql.NullString
 		var history sql.NullString
-		err = rows.Scan(
+		var publishAt sql.NullTime
+		var summary, title sql.NullString
+		var deleted sql.NullTime
+		dest := []any{
 			&f.ID,
 			&f.Slug,
 			&f.Created,
 			&f.Modified,
-			&f.Data,
+			&data,
 			&history,
 			&f.Views,
-		)
+			&f.Published,
+			&publishAt,
+			&summary,
+			&title,
+			&deleted,
+		}
+		// the rank follows fileColumns in search queries
+		if len(columns) > len(dest) {
+			dest = append(dest, &f.Rank)
+		}
+		err = rows.Scan(dest...)
 		if err != nil {
 			err = errors.Wrap(err, "get rows of file")
 			return
@@ -1160,6 +2971,11 @@ func (fs *FileSystem) getAllFromPreparedQuery(query string, args ...any) (files
 				return
 			}
 		}
+		f.Data = data.String
+		f.PublishAt = publishAt.Time
+		f.Summary = summary.String
+		f.Title = title.String
+		f.Deleted = deleted.Time
 		f.DataHTML = template.HTML(f.Data)
 		files = append(files, f)
 	}
@@ -1171,20 +2987,18 @@ func (fs *FileSystem) getAllFromPreparedQuery(query string, args ...any) (files
 }
 
 func (fs *FileSystem) getAllFromPreparedQuerySingleString(query string, args ...interface{}) (s []string, err error) {
-	// timeStart := time.Now().UTC()
-	// defer func() {
-	// 	log.Debugf("getAllFromPreparedQuerySingleString %s in %s", query, time.Since(timeStart))
-	// }()
+	return fs.getAllFromPreparedQuerySingleStringContext(context.Background(), query, args...)
+}
 
+func (fs *FileSystem) getAllFromPreparedQuerySingleStringContext(ctx context.Context, query string, args ...interface{}) (s []string, err error) {
 	// prepare statement
-	stmt, err := fs.DB.Prepare(query)
+	stmt, done, err := fs.prepare(query)
 	if err != nil {
 		err = errors.Wrap(err, "preparing query: "+query)
 		return
 	}
-
-	defer stmt.Close()
-	rows, err := stmt.Query(args...)
+	defer done()
+	rows, err := stmt.QueryContext(ctx, args...)
 	if err != nil {
 		err = errors.Wrap(err, query)
 		return
@@ -1212,19 +3026,13 @@ func (fs *FileSystem) getAllFromPreparedQuerySingleString(query string, args ...
 }
 
 func (fs *FileSystem) getAllFromPreparedQuerySingleTimestamp(query string, args ...interface{}) (s []time.Time, err error) {
-	// timeStart := time.Now().UTC()
-	// defer func() {
-	// 	log.Debugf("getAllFromPreparedQuerySingleTimestamp %s in %s", query, time.Since(timeStart))
-	// }()
-
 	// prepare statement
-	stmt, err := fs.DB.Prepare(query)
+	stmt, done, err := fs.prepare(query)
 	if err != nil {
 		err = errors.Wrap(err, "preparing query: "+query)
 		return
 	}
-
-	defer stmt.Close()
+	defer done()
 	rows, err := stmt.Query(args...)
 	if err != nil {
 		err = errors.Wrap(err, query)
@@ -1290,10 +3098,8 @@ func SetLogLevel(level string) (err error) {
 	return
 }
 
+// formattedDate formats t in the time zone utcOffset minutes behind UTC, as
+// given by getTimezoneOffset in browsers, so zones like UTC+5:30 are right.
 func formattedDate(t time.Time, utcOffset int) string {
-	loc, err := time.LoadLocation(fmt.Sprintf("Etc/GMT%+d", utcOffset))
-	if err != nil {
-		return t.Format("3:04pm Jan 2 2006")
-	}
-	return t.In(loc).Format("3:04pm Jan 2 2006")
+	return t.In(time.FixedZone("", -utcOffset*60)).Format("3:04pm Jan 2 2006")
 }
@@ -0,0 +1,793 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/cihub/seelog"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newTestFileSystem returns a FileSystem on an empty in-memory database, with
+// the domains "test" and "other".
+func newTestFileSystem(t testing.TB) *FileSystem {
+	t.Helper()
+	fs, err := New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fs.Close() })
+	for _, domain := range []string{"test", "other"} {
+		if err = fs.SetDomain(domain, "password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return fs
+}
+
+// savePage saves a new page of the domain, created at the time.
+func savePage(t testing.TB, fs *FileSystem, domain, slug, data string, created time.Time) File {
+	t.Helper()
+	f, err := fs.NewFile(slug, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Domain = domain
+	f.Created = created
+	if err = fs.Save(f); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func ids(files []File) []string {
+	ids := make([]string, len(files))
+	for i, f := range files {
+		ids[i] = f.ID
+	}
+	return ids
+}
+
+func checkIDs(t *testing.T, name string, files []File, err error, want ...File) {
+	t.Helper()
+	if err != nil {
+		t.Errorf("%s: %v", name, err)
+		return
+	}
+	if got := ids(files); !reflect.DeepEqual(got, ids(want)) {
+		t.Errorf("%s = %v, want %v", name, got, ids(want))
+	}
+}
+
+// testPages saves pages of the test domain modified in the order first,
+// second, third, but created in the order second, third, first, an empty page
+// and a page of the other domain.
+func testPages(t *testing.T, fs *FileSystem) (first, second, third File) {
+	t.Helper()
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	first = savePage(t, fs, "test", "first", "the first page", day.Add(3*time.Hour))
+	second = savePage(t, fs, "test", "second", "the second page", day.Add(1*time.Hour))
+	third = savePage(t, fs, "test", "third", "the third page", day.Add(2*time.Hour))
+	savePage(t, fs, "test", "empty", "", day)
+	savePage(t, fs, "other", "other", "a page of another domain", day)
+	return
+}
+
+func TestGetAll(t *testing.T) {
+	fs := newTestFileSystem(t)
+	first, second, third := testPages(t, fs)
+
+	files, err := fs.GetAll("test", false)
+	checkIDs(t, "GetAll", files, err, third, second, first)
+	files, err = fs.GetAll("test", false, true)
+	checkIDs(t, "GetAll created", files, err, first, third, second)
+	for _, f := range files {
+		if f.Domain != "test" {
+			t.Errorf("GetAll: %s has domain %q", f.ID, f.Domain)
+		}
+	}
+
+	if err := fs.TrashFile(second.ID, "test"); err != nil {
+		t.Fatal(err)
+	}
+	files, err = fs.GetAll("test", false)
+	checkIDs(t, "GetAll without the trash", files, err, third, first)
+	files, err = fs.GetAll("test", true)
+	checkIDs(t, "GetAll with the trash", files, err, third, second, first)
+}
+
+func TestGetTopX(t *testing.T) {
+	fs := newTestFileSystem(t)
+	first, second, third := testPages(t, fs)
+
+	files, err := fs.GetTopX("test", 1, false)
+	checkIDs(t, "GetTopX", files, err, third)
+	files, err = fs.GetTopX("test", 2, false, true)
+	checkIDs(t, "GetTopX created", files, err, first, third)
+
+	if err := fs.TrashFile(third.ID, "test"); err != nil {
+		t.Fatal(err)
+	}
+	files, err = fs.GetTopX("test", 1, false)
+	checkIDs(t, "GetTopX without the trash", files, err, second)
+	files, err = fs.GetTopX("test", 1, true)
+	checkIDs(t, "GetTopX with the trash", files, err, third)
+}
+
+func TestGetTopXMostViews(t *testing.T) {
+	fs := newTestFileSystem(t)
+	first, second, third := testPages(t, fs)
+	for views, f := range []File{third, first, second} {
+		// UpdateViews counts one view more than those of f
+		f.Views = views * 10
+		if err := fs.UpdateViews(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := fs.GetTopXMostViews("test", 2)
+	checkIDs(t, "GetTopXMostViews", files, err, second, first)
+	if err == nil && files[0].Views != 21 {
+		t.Errorf("GetTopXMostViews: %s has %d views, want 21", files[0].ID, files[0].Views)
+	}
+}
+
+func TestGet(t *testing.T) {
+	fs := newTestFileSystem(t)
+	first, _, _ := testPages(t, fs)
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	again := savePage(t, fs, "test", "first", "another first page", day)
+	savePage(t, fs, "other", "first", "the first page of another domain", day)
+
+	files, err := fs.Get(first.ID, "test")
+	checkIDs(t, "Get id", files, err, first)
+	if err == nil && files[0].Data != first.Data {
+		t.Errorf("Get id: data is %q, want %q", files[0].Data, first.Data)
+	}
+	files, err = fs.Get("first", "test")
+	checkIDs(t, "Get slug", files, err, again, first)
+	if _, err = fs.Get("missing", "test"); err == nil {
+		t.Error("Get missing slug: want an error")
+	}
+}
+
+func TestFind(t *testing.T) {
+	fs := newTestFileSystem(t)
+	first, second, third := testPages(t, fs)
+
+	files, err := fs.Find("second", "test", false)
+	checkIDs(t, "Find second", files, err, second)
+	files, err = fs.Find("page", "test", false)
+	checkIDs(t, "Find page", files, err, third, second, first)
+	files, err = fs.Find("another", "test", false)
+	checkIDs(t, "Find another", files, err)
+
+	many := savePage(t, fs, "test", "many", "page after page after page", time.Now())
+	files, err = fs.Find("page", "test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 4 || files[0].ID != many.ID {
+		t.Errorf("Find by relevance = %v, want %s first of 4", ids(files), many.ID)
+	}
+}
+
+func TestMemoryDB(t *testing.T) {
+	fs := newTestFileSystem(t)
+	if conns := fs.DB.Stats().MaxOpenConnections; conns != 1 {
+		t.Errorf("MaxOpenConnections = %d, want 1", conns)
+	}
+
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := savePage(t, fs, "test", "memory", "kept in memory", day)
+	f.Data = "still kept in memory"
+	if err := fs.Save(f); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := fs.Get("memory", "test")
+	checkIDs(t, "Get", files, err, f)
+	if err == nil && files[0].Data != f.Data {
+		t.Errorf("Get: data is %q, want %q", files[0].Data, f.Data)
+	}
+	files, err = fs.Find("still", "test", false)
+	checkIDs(t, "Find", files, err, f)
+}
+
+func TestIsMemoryDB(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{":memory:", true},
+		{"file::memory:", true},
+		{"file::memory:?cache=shared", true},
+		{"file:test.db?mode=memory", true},
+		{"file:test.db?cache=shared&mode=memory", true},
+		{"rwtxt.db", false},
+		{"file:rwtxt.db", false},
+		{"file:rwtxt.db?mode=ro", false},
+		{"memory.db", false},
+	}
+	for _, tt := range tests {
+		if got := isMemoryDB(tt.name); got != tt.want {
+			t.Errorf("isMemoryDB(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryDBNames(t *testing.T) {
+	for _, name := range []string{":memory:", "file::memory:", "file:test.db?mode=memory"} {
+		fs, err := New(name)
+		if err != nil {
+			t.Fatalf("New(%q): %v", name, err)
+		}
+		defer fs.Close()
+		if err = fs.SetDomain("test", "password"); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		f := savePage(t, fs, "test", "memory", "kept in memory", time.Now())
+
+		files, err := fs.Get(f.ID, "test")
+		checkIDs(t, name, files, err, f)
+	}
+}
+
+// queryPlan returns the details of the steps of the query plan of q.
+func queryPlan(t testing.TB, fs *FileSystem, q *fileQuery) string {
+	t.Helper()
+	rows, err := fs.DB.Query("EXPLAIN QUERY PLAN "+q.String(), q.Args()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var plan []string
+	for rows.Next() {
+		var id, parent, notUsed int
+		var detail string
+		if err = rows.Scan(&id, &parent, &notUsed, &detail); err != nil {
+			t.Fatal(err)
+		}
+		plan = append(plan, detail)
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(plan, "\n")
+}
+
+func TestListingsScanFTSOnce(t *testing.T) {
+	fs := newTestFileSystem(t)
+	tests := []struct {
+		name string
+		q    *fileQuery
+	}{
+		{"GetTopX", newFileQuery().InDomain("test").Drafts(false).Trashed(false).OrderByRecent(nil).Limit(10)},
+		{"GetTopX created", newFileQuery().InDomain("test").Drafts(false).Trashed(false).OrderByRecent([]bool{true}).Limit(10)},
+		{"GetTopXMostViews", newFileQuery().InDomain("test").Drafts(false).Trashed(false).OrderBy("fs.views DESC").Limit(10)},
+		{"GetList", newFileQuery().Columns(listColumns).InDomain("test").Drafts(false).Trashed(false).OrderByRecent(nil).Limit(10).Offset(10)},
+		{"get by slug", newFileQuery().Where("fs.slug = ?", "slug").InDomain("test").OrderBy("fs.modified DESC")},
+	}
+	for _, tt := range tests {
+		plan := queryPlan(t, fs, tt.q)
+		// the loop over fts must be the outer one, which runs once
+		ftsLoop := strings.Index(plan, "fts VIRTUAL TABLE")
+		fsLoop := strings.Index(plan, " fs ")
+		if ftsLoop < 0 || fsLoop < 0 || ftsLoop > fsLoop || strings.Contains(plan, "LEFT-JOIN") {
+			t.Errorf("%s scans fts for every file:\n%s", tt.name, plan)
+		}
+	}
+}
+
+// BenchmarkListings lists pages of a domain of 2,500 pages, in a database of
+// 5,000.
+func BenchmarkListings(b *testing.B) {
+	fs := newTestFileSystem(b)
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 2500; i++ {
+		for _, domain := range []string{"test", "other"} {
+			f := savePage(b, fs, domain, fmt.Sprintf("page%d", i), fmt.Sprintf("page %d of %s", i, domain), day.Add(time.Duration(i)*time.Minute))
+			if i%10 == 0 {
+				f.Views = i
+				if err := fs.UpdateViews(f); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+
+	benchmarks := []struct {
+		name string
+		list func() ([]File, error)
+	}{
+		{"GetTopX", func() ([]File, error) { return fs.GetTopX("test", 10, false) }},
+		{"GetTopX created", func() ([]File, error) { return fs.GetTopX("test", 10, false, true) }},
+		{"GetTopXMostViews", func() ([]File, error) { return fs.GetTopXMostViews("test", 10) }},
+		{"GetPage", func() ([]File, error) { return fs.GetPage("test", 100, 10) }},
+		{"Get", func() ([]File, error) { return fs.Get("page1234", "test") }},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := bm.list(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestFileQueryLimitPlaceholders(t *testing.T) {
+	page1 := newFileQuery().InDomain("test").OrderByRecent(nil).Limit(10)
+	page3 := newFileQuery().InDomain("test").OrderByRecent(nil).Limit(20).Offset(40)
+	if page1.String() != page3.String() {
+		t.Errorf("queries differ by their limits:\n%s\n%s", page1, page3)
+	}
+	if got, want := page3.Args(), []any{"test", 20, 40}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Args() = %v, want %v", got, want)
+	}
+
+	fs := newTestFileSystem(t)
+	first, second, third := testPages(t, fs)
+	files, err := fs.GetPage("test", 1, 1)
+	checkIDs(t, "GetPage", files, err, second)
+	files, err = fs.GetPage("test", 0, 10)
+	checkIDs(t, "GetPage all", files, err, third, second, first)
+}
+
+func TestTags(t *testing.T) {
+	fs := newTestFileSystem(t)
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	first := savePage(t, fs, "test", "first", "#go and #db", day)
+	second := savePage(t, fs, "test", "second", "only #Go", day)
+	third := savePage(t, fs, "test", "third", "#go #db #web", day)
+	draft := savePage(t, fs, "test", "draft", "a draft about #go", day)
+	if err := fs.Unpublish(draft.ID, "test"); err != nil {
+		t.Fatal(err)
+	}
+	trashed := savePage(t, fs, "test", "trashed", "trashed #db", day)
+	if err := fs.TrashFile(trashed.ID, "test"); err != nil {
+		t.Fatal(err)
+	}
+	savePage(t, fs, "other", "other", "#go elsewhere", day)
+
+	checkTags := func(name string, want map[string]int) {
+		t.Helper()
+		tags, err := fs.GetTags("test")
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if !reflect.DeepEqual(tags, want) {
+			t.Errorf("%s = %v, want %v", name, tags, want)
+		}
+	}
+	checkTags("GetTags", map[string]int{"go": 3, "db": 2, "web": 1})
+
+	files, err := fs.GetTagged("test", "#GO")
+	checkIDs(t, "GetTagged", files, err, third, second, first)
+	files, err = fs.GetTagged("test", "web")
+	checkIDs(t, "GetTagged web", files, err, third)
+	files, err = fs.GetRelated(first.ID, "test", 10)
+	checkIDs(t, "GetRelated", files, err, third, second)
+	files, err = fs.GetRelated(first.ID, "test", 1)
+	checkIDs(t, "GetRelated limit", files, err, third)
+
+	first.Data = "now only #web"
+	if err = fs.Save(first); err != nil {
+		t.Fatal(err)
+	}
+	checkTags("GetTags after Save", map[string]int{"go": 2, "db": 1, "web": 2})
+	if _, err = fs.MergeTags("test", []string{"web", "db"}, "www"); err != nil {
+		t.Fatal(err)
+	}
+	checkTags("GetTags after MergeTags", map[string]int{"go": 2, "www": 2})
+	// a tag merged into itself in another case is left alone
+	if n, err := fs.MergeTags("test", []string{"go"}, "#GO"); err != nil || n != 0 {
+		t.Errorf("MergeTags into the same tag = %d, %v, want 0 pages changed", n, err)
+	}
+
+	// databases of older versions have their tags listed when opened
+	if _, err = fs.DB.Exec("DROP TABLE tags"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.InitializeDB(); err != nil {
+		t.Fatal(err)
+	}
+	checkTags("GetTags after backfill", map[string]int{"go": 2, "www": 2})
+}
+
+func TestVerifyConsistency(t *testing.T) {
+	fs := newTestFileSystem(t)
+	first, second, third := testPages(t, fs)
+	if _, err := fs.DB.Exec("DELETE FROM fts WHERE id = ?", second.ID); err != nil {
+		t.Fatal(err)
+	}
+	files, err := fs.GetAll("test", false)
+	checkIDs(t, "GetAll missing from fts", files, err, third, first)
+
+	ids, err := fs.VerifyConsistency()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []string{second.ID}) {
+		t.Errorf("VerifyConsistency = %v, want %v", ids, []string{second.ID})
+	}
+	files, err = fs.GetAll("test", false)
+	checkIDs(t, "GetAll repaired", files, err, third, second, first)
+	if files, err = fs.Get(second.ID, "test"); err != nil || len(files) != 1 || files[0].Data != second.Data {
+		t.Errorf("repaired page is %v, %v, want %q", files, err, second.Data)
+	}
+	if ids, err = fs.VerifyConsistency(); err != nil || len(ids) != 0 {
+		t.Errorf("VerifyConsistency after repair = %v, %v", ids, err)
+	}
+}
+
+func TestUpdateContext(t *testing.T) {
+	fs := newTestFileSystem(t)
+	first, _, _ := testPages(t, fs)
+	ctx := context.Background()
+
+	err := fs.UpdateContext(ctx, first.ID, "test", func(f *File) error {
+		f.Data += ", updated"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := fmt.Errorf("refused")
+	err = fs.UpdateContext(ctx, first.ID, "test", func(f *File) error {
+		f.Data = "lost"
+		return refused
+	})
+	if err != refused {
+		t.Errorf("UpdateContext = %v, want %v", err, refused)
+	}
+	files, err := fs.Get(first.ID, "test")
+	checkIDs(t, "Get", files, err, first)
+	if want := first.Data + ", updated"; err == nil && files[0].Data != want {
+		t.Errorf("Get: data is %q, want %q", files[0].Data, want)
+	}
+	if err = fs.UpdateContext(ctx, "missing", "test", func(*File) error { return nil }); err == nil {
+		t.Error("UpdateContext of a missing page: want an error")
+	}
+}
+
+func TestPublishingChangesPages(t *testing.T) {
+	fs := newTestFileSystem(t)
+	first, _, _ := testPages(t, fs)
+	before := time.Now().UTC()
+	if err := fs.Unpublish(first.ID, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Publish(first.ID, "test"); err != nil {
+		t.Fatal(err)
+	}
+	files, err := fs.GetListSince("test", before, "", 10, false)
+	checkIDs(t, "GetListSince published", files, err, first)
+
+	// published at its scheduled time, an hour after it was last modified
+	now := time.Now().UTC()
+	publishAt := now.Add(-time.Hour)
+	_, err = fs.DB.Exec("UPDATE fs SET modified = ?, publish_at = ?", now.Add(-2*time.Hour), publishAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err = fs.GetListSince("test", publishAt.Add(-time.Minute), "", 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 || !files[0].Changed().Equal(publishAt) {
+		t.Errorf("GetListSince scheduled = %v, want 3 files changed at %s", ids(files), publishAt)
+	}
+	lastModified, err := fs.DomainLastModified("test")
+	if err != nil || !lastModified.Equal(publishAt) {
+		t.Errorf("DomainLastModified = %s, %v, want %s", lastModified, err, publishAt)
+	}
+}
+
+func TestDeleteSessionsBefore(t *testing.T) {
+	fs := newTestFileSystem(t)
+	for _, id := range []string{"old", "new"} {
+		if err := fs.SaveSession(id, "{}"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fs.DB.Exec("UPDATE sessions SET modified = ? WHERE id = 'old'", time.Now().UTC().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	n, err := fs.DeleteSessionsBefore(time.Now().Add(-time.Minute))
+	if err != nil || n != 1 {
+		t.Errorf("DeleteSessionsBefore = %d, %v, want 1", n, err)
+	}
+	if _, _, err = fs.GetSession("old"); err != sql.ErrNoRows {
+		t.Errorf("GetSession removed = %v, want %v", err, sql.ErrNoRows)
+	}
+	if _, modified, err := fs.GetSession("new"); err != nil || time.Since(modified) > time.Minute {
+		t.Errorf("GetSession = %s, %v", modified, err)
+	}
+}
+
+func TestBlobChunks(t *testing.T) {
+	fs := newTestFileSystem(t)
+	data := bytes.Repeat([]byte("0123456789"), blobChunkSize/4)
+	if err := fs.SaveBlob("big", "test", "big.txt", "text/plain", len(data), data); err != nil {
+		t.Fatal(err)
+	}
+	var chunks int
+	if err := fs.DB.QueryRow("SELECT COUNT(*) FROM blob_chunks WHERE id = 'big'").Scan(&chunks); err != nil || chunks != 3 {
+		t.Errorf("saved %d chunks, %v, want 3", chunks, err)
+	}
+
+	name, r, size, err := fs.GetBlobReader("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || name != "big.txt" || size != int64(len(data)) || !bytes.Equal(read, data) {
+		t.Errorf("GetBlobReader = %q, %d, %d bytes read, %v", name, size, len(read), err)
+	}
+	if _, got, views, err := fs.GetBlob("big"); err != nil || views != 1 || !bytes.Equal(got, data) {
+		t.Errorf("GetBlob = %d bytes, %d views, %v", len(got), views, err)
+	}
+
+	if err = fs.DeleteBlob("big"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.DB.QueryRow("SELECT COUNT(*) FROM blob_chunks").Scan(&chunks); err != nil || chunks != 0 {
+		t.Errorf("%d chunks left after DeleteBlob, %v", chunks, err)
+	}
+}
+
+func TestChunkBlobs(t *testing.T) {
+	fs := newTestFileSystem(t)
+	data := bytes.Repeat([]byte{1}, blobChunkSize+1)
+	// as saved by older versions
+	if _, err := fs.DB.Exec("INSERT INTO blobs (id, name, data) VALUES ('old', 'old.bin', ?)", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.chunkBlobs(); err != nil {
+		t.Fatal(err)
+	}
+	if _, got, _, err := fs.GetBlob("old"); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("GetBlob = %d bytes, %v, want %d", len(got), err, len(data))
+	}
+	var left int
+	if err := fs.DB.QueryRow("SELECT COUNT(*) FROM blobs WHERE data IS NOT NULL").Scan(&left); err != nil || left != 0 {
+		t.Errorf("%d blobs left with data, %v", left, err)
+	}
+}
+
+func TestSlowQueriesAreLogged(t *testing.T) {
+	fs := newTestFileSystem(t)
+	savePage(t, fs, "test", "tagged", "#go", time.Now())
+	var buf bytes.Buffer
+	logger, err := log.LoggerFromWriterWithMinLevelAndFormat(&buf, log.WarnLvl, "%Msg%n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := log.Current
+	log.UseLogger(logger)
+	defer log.UseLogger(old)
+
+	fs.SlowQuery = time.Nanosecond
+	if _, err = fs.GetTags("test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.CountFiles("test"); err != nil {
+		t.Fatal(err)
+	}
+	fs.SlowQuery = 0
+	logger.Flush()
+	for _, query := range []string{"FROM tags", "SELECT COUNT("} {
+		if !strings.Contains(buf.String(), query) {
+			t.Errorf("no slow query with %q logged in:\n%s", query, buf.String())
+		}
+	}
+}
+
+func TestFormattedDate(t *testing.T) {
+	at := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		utcOffset int
+		want      string
+	}{
+		{"UTC", 0, "12:00pm Jan 1 2020"},
+		{"behind UTC", 300, "7:00am Jan 1 2020"},
+		{"ahead of UTC by half an hour", -330, "5:30pm Jan 1 2020"},
+		{"ahead of UTC by a quarter", -345, "5:45pm Jan 1 2020"},
+	}
+	for _, tt := range tests {
+		if got := formattedDate(at, tt.utcOffset); got != tt.want {
+			t.Errorf("%s: formattedDate(%d) = %q, want %q", tt.name, tt.utcOffset, got, tt.want)
+		}
+	}
+}
+
+func TestListingsLeaveOutContents(t *testing.T) {
+	fs := newTestFileSystem(t)
+	testPages(t, fs)
+	listings := []struct {
+		name string
+		list func() ([]File, error)
+	}{
+		{"GetAll", func() ([]File, error) { return fs.GetAll("test", false) }},
+		{"GetPage", func() ([]File, error) { return fs.GetPage("test", 0, 10) }},
+		{"GetTopX", func() ([]File, error) { return fs.GetTopX("test", 10, false) }},
+		{"GetTopXMostViews", func() ([]File, error) { return fs.GetTopXMostViews("test", 10) }},
+		{"GetSitemapPage", func() ([]File, error) { return fs.GetSitemapPage("test", 0, 10) }},
+	}
+	for _, l := range listings {
+		files, err := l.list()
+		if err != nil || len(files) == 0 {
+			t.Errorf("%s = %d files, %v", l.name, len(files), err)
+			continue
+		}
+		for _, f := range files {
+			if f.Data != "" || f.Summary == "" {
+				t.Errorf("%s: %s has %d bytes of data, summary %q", l.name, f.ID, len(f.Data), f.Summary)
+			}
+		}
+	}
+}
+
+func TestGetListTies(t *testing.T) {
+	fs := newTestFileSystem(t)
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 6; i++ {
+		savePage(t, fs, "test", fmt.Sprintf("page%d", i), "a page", day)
+	}
+	// all of them modified and created at the same time
+	if _, err := fs.DB.Exec("UPDATE fs SET modified = ?", day); err != nil {
+		t.Fatal(err)
+	}
+	for _, created := range []bool{false, true} {
+		seen := make(map[string]bool)
+		var listed []string
+		for offset := 0; offset < 6; offset += 2 {
+			files, _, err := fs.GetList("test", offset, 2, created)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range files {
+				if seen[f.ID] {
+					t.Errorf("created %v: %s listed twice", created, f.ID)
+				}
+				seen[f.ID] = true
+				listed = append(listed, f.ID)
+			}
+		}
+		if len(seen) != 6 || !sort.SliceIsSorted(listed, func(i, j int) bool { return listed[i] > listed[j] }) {
+			t.Errorf("created %v: listed %v, want all 6 by id descending", created, listed)
+		}
+	}
+}
+
+func TestAddToDictionaryCap(t *testing.T) {
+	fs := newTestFileSystem(t)
+	words := make([]string, MaxDictionaryWords)
+	for i := range words {
+		words[i] = fmt.Sprintf("word%d", i)
+	}
+	dictionary, err := fs.AddToDictionary("test", words)
+	if err != nil || len(dictionary) != MaxDictionaryWords {
+		t.Fatalf("AddToDictionary = %d words, %v, want %d", len(dictionary), err, MaxDictionaryWords)
+	}
+	// words already in it are not counted again
+	if dictionary, err = fs.AddToDictionary("test", words[:10]); err != nil || len(dictionary) != MaxDictionaryWords {
+		t.Errorf("AddToDictionary known words = %d words, %v, want %d", len(dictionary), err, MaxDictionaryWords)
+	}
+	if _, err = fs.AddToDictionary("test", []string{"more"}); err != ErrDictionaryFull {
+		t.Errorf("AddToDictionary past the cap = %v, want %v", err, ErrDictionaryFull)
+	}
+	_, _, options, _, err := fs.GetDomainFromName("test")
+	if err != nil || len(options.CustomDictionary) != MaxDictionaryWords {
+		t.Errorf("dictionary has %d words, %v, want %d", len(options.CustomDictionary), err, MaxDictionaryWords)
+	}
+}
+
+func TestMaxDomains(t *testing.T) {
+	fs, err := New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	fs.MaxDomains = 2
+	// the public domain doesn't count
+	for _, domain := range []string{"one", "two"} {
+		if err = fs.SetDomain(domain, "password"); err != nil {
+			t.Fatalf("SetDomain(%q) = %v", domain, err)
+		}
+	}
+	if err = fs.SetDomain("three", "password"); err != ErrTooManyDomains {
+		t.Errorf("SetDomain past MaxDomains = %v, want %v", err, ErrTooManyDomains)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	fs := newTestFileSystem(t)
+	old, err := fs.SetKey("test", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := fs.SetKey("test", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.UpdateKeys([]string{key}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = fs.ListKeys("test", "wrong"); err == nil {
+		t.Error("ListKeys with the wrong password succeeded")
+	}
+	keys, err := fs.ListKeys("test", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("ListKeys = %+v, want 2 keys", keys)
+	}
+	// the most recently used first, masked but for their last 4 characters
+	for i, want := range []string{key, old} {
+		if keys[i].Masked != strings.Repeat("*", len(want)-4)+want[len(want)-4:] {
+			t.Errorf("ListKeys[%d] = %q, want %s masked", i, keys[i].Masked, want)
+		}
+		if !keys[i].Expires.IsZero() {
+			t.Errorf("ListKeys[%d] expires %s, want never", i, keys[i].Expires)
+		}
+	}
+	if keys, err = fs.ListKeys("other", "password"); err != nil || len(keys) != 0 {
+		t.Errorf("ListKeys of another domain = %+v, %v, want none", keys, err)
+	}
+
+	if err = fs.RevokeKey("test", "password", old); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = fs.CheckKey(old); err == nil {
+		t.Error("CheckKey accepted a revoked key")
+	}
+	if _, domain, err := fs.CheckKey(key); err != nil || domain != "test" {
+		t.Errorf("CheckKey = %q, %v, want test", domain, err)
+	}
+	if err = fs.RevokeKey("test", "password", old); err != ErrKeyNotFound {
+		t.Errorf("RevokeKey revoked = %v, want %v", err, ErrKeyNotFound)
+	}
+	if keys, err = fs.ListKeys("test", "password"); err != nil || len(keys) != 1 {
+		t.Errorf("ListKeys after RevokeKey = %+v, %v, want 1 key", keys, err)
+	}
+}
+
+func TestExpiredKey(t *testing.T) {
+	fs := newTestFileSystem(t)
+	key, err := fs.SetKeyWithTTL("test", "password", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := fs.ListKeys("test", "password")
+	if err != nil || len(keys) != 1 || time.Until(keys[0].Expires) <= 0 || time.Until(keys[0].Expires) > time.Hour {
+		t.Fatalf("ListKeys = %+v, %v, want 1 key expiring within the hour", keys, err)
+	}
+	if _, domain, err := fs.CheckKey(key); err != nil || domain != "test" {
+		t.Errorf("CheckKey = %q, %v, want test", domain, err)
+	}
+
+	if _, err = fs.DB.Exec("UPDATE keys SET expires = ? WHERE key = ?", time.Now().UTC().Add(-time.Minute), key); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = fs.CheckKey(key); err == nil {
+		t.Error("CheckKey accepted an expired key")
+	}
+	// and deleted it
+	if keys, err = fs.ListKeys("test", "password"); err != nil || len(keys) != 0 {
+		t.Errorf("ListKeys after expiry = %+v, %v, want none", keys, err)
+	}
+}
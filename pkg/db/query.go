@@ -0,0 +1,255 @@
+package db
+
+import (
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// fileColumns are the columns scanned by getAllFromPreparedQuery.
+const fileColumns = "fs.id,fs.slug,fs.created,fs.modified,fts.data,fs.history,fs.views,fs.published,fs.publish_at,fs.summary,fs.title,fs.deleted"
+
+// summaryColumns are fileColumns without the contents and history of the
+// files, for listings which only show their titles and summaries.
+const summaryColumns = "fs.id,fs.slug,fs.created,fs.modified,NULL,NULL,fs.views,fs.published,fs.publish_at,fs.summary,fs.title,fs.deleted"
+
+// fileQuery builds a SELECT over files joined with their contents, composing
+// the common base with optional WHERE, ORDER BY and LIMIT clauses. Files
+// missing from the full text search table, after an interrupted Save, aren't
+// listed until VerifyConsistency puts them back.
+type fileQuery struct {
+	columns string
+	where   []string
+	args    []any
+	orderBy string
+	limit   int
+	offset  int
+}
+
+// newFileQuery returns a query selecting fileColumns from all files.
+func newFileQuery() *fileQuery {
+	return &fileQuery{columns: fileColumns, limit: -1}
+}
+
+// Columns replaces the selected columns.
+func (q *fileQuery) Columns(columns string) *fileQuery {
+	q.columns = columns
+	return q
+}
+
+// InDomain restricts the query to files of the named domain. The id of the
+// domain is a constant of the query, so the indexes on fs(domainid,...) give
+// files in order instead of them being sorted.
+func (q *fileQuery) InDomain(domain string) *fileQuery {
+	return q.Where("fs.domainid = (SELECT id FROM domains WHERE name = ?)", domain)
+}
+
+// NonEmpty hides files without any content.
+func (q *fileQuery) NonEmpty() *fileQuery {
+	return q.Where("LENGTH(fts.data) > 0")
+}
+
+// Match restricts the query to files whose contents match the full text
+// search query.
+func (q *fileQuery) Match(text string) *fileQuery {
+	return q.Where("fts.data MATCH ?", text)
+}
+
+// Published hides unpublished files, and those scheduled to be published later.
+func (q *fileQuery) Published() *fileQuery {
+	return q.Where("fs.published = 1").
+		Where("(fs.publish_at IS NULL OR fs.publish_at <= ?)", time.Now().UTC())
+}
+
+// Drafts hides empty and unpublished files, unless includeDrafts is set.
+func (q *fileQuery) Drafts(includeDrafts bool) *fileQuery {
+	if includeDrafts {
+		return q
+	}
+	return q.NonEmpty().Published()
+}
+
+// Trashed hides files in the trash, unless includeTrashed is set.
+func (q *fileQuery) Trashed(includeTrashed bool) *fileQuery {
+	if includeTrashed {
+		return q
+	}
+	return q.Where("fs.deleted IS NULL")
+}
+
+// Where adds a condition, all conditions must match.
+func (q *fileQuery) Where(condition string, args ...any) *fileQuery {
+	q.where = append(q.where, condition)
+	q.args = append(q.args, args...)
+	return q
+}
+
+// OrderBy sets the ORDER BY clause.
+func (q *fileQuery) OrderBy(orderBy string) *fileQuery {
+	q.orderBy = orderBy
+	return q
+}
+
+// OrderByRecent orders by the most recently created or modified files first,
+// then by id so files changed at the same time keep their order across pages.
+func (q *fileQuery) OrderByRecent(created []bool) *fileQuery {
+	if len(created) > 0 && created[0] {
+		return q.OrderBy("fs.created DESC, fs.id DESC")
+	}
+	return q.OrderBy("fs.modified DESC, fs.id DESC")
+}
+
+// Limit sets the maximum number of rows returned, a negative limit means no
+// limit.
+func (q *fileQuery) Limit(limit int) *fileQuery {
+	q.limit = limit
+	return q
+}
+
+// Offset sets the number of rows skipped, it only applies with a Limit.
+func (q *fileQuery) Offset(offset int) *fileQuery {
+	q.offset = offset
+	return q
+}
+
+// String returns the SQL of the query.
+func (q *fileQuery) String() string {
+	var b strings.Builder
+	b.WriteString("SELECT " + q.columns + " FROM fs")
+	// an inner join scans fts once, a left join scans it for every file
+	b.WriteString("\n\tINNER JOIN fts ON fs.id=fts.id")
+	if len(q.where) > 0 {
+		b.WriteString("\n\tWHERE " + strings.Join(q.where, "\n\t\tAND "))
+	}
+	if q.orderBy != "" {
+		b.WriteString("\n\tORDER BY " + q.orderBy)
+	}
+	if q.limit >= 0 {
+		// placeholders keep the query the same whatever the page, so its
+		// prepared statement is reused
+		b.WriteString("\n\tLIMIT ? OFFSET ?")
+	}
+	return b.String()
+}
+
+// Args returns the arguments for the placeholders of the query, the limit and
+// offset last.
+func (q *fileQuery) Args() []any {
+	if q.limit < 0 {
+		return q.args
+	}
+	return append(q.args[:len(q.args):len(q.args)], q.limit, q.offset)
+}
+
+// SanitizeFTSQuery turns a search typed by a user into a full text search query
+// that can't be a syntax error. It keeps "quoted phrases", the AND, OR and NOT
+// operators between terms, and term* prefixes, and quotes everything else, so
+// stray characters are searched for as text. Operators without terms on both
+// sides are dropped.
+func SanitizeFTSQuery(raw string) string {
+	var tokens []string
+	for len(raw) > 0 {
+		raw = strings.TrimLeft(raw, " \t\r\n")
+		if raw == "" {
+			break
+		}
+		if raw[0] == '"' {
+			// a phrase, up to the closing quote or the end
+			end := strings.IndexByte(raw[1:], '"')
+			phrase := raw[1:]
+			raw = ""
+			if end >= 0 {
+				phrase, raw = phrase[:end], phrase[end+1:]
+			}
+			prefix := strings.HasPrefix(raw, "*")
+			raw = strings.TrimPrefix(raw, "*")
+			if strings.TrimSpace(phrase) != "" {
+				tokens = append(tokens, ftsString(phrase, prefix))
+			}
+			continue
+		}
+		end := strings.IndexAny(raw, " \t\r\n\"")
+		if end < 0 {
+			end = len(raw)
+		}
+		word := raw[:end]
+		raw = raw[end:]
+		switch word {
+		case "AND", "OR", "NOT":
+			// only between terms
+			if len(tokens) > 0 && !isFTSOperator(tokens[len(tokens)-1]) {
+				tokens = append(tokens, word)
+			}
+			continue
+		}
+		prefix := strings.HasSuffix(word, "*")
+		word = strings.Trim(word, "*")
+		if word != "" {
+			tokens = append(tokens, ftsString(word, prefix))
+		}
+	}
+	if len(tokens) > 0 && isFTSOperator(tokens[len(tokens)-1]) {
+		tokens = tokens[:len(tokens)-1]
+	}
+	return strings.Join(tokens, " ")
+}
+
+// ftsString quotes s as a full text search string, a prefix if prefix is set.
+func ftsString(s string, prefix bool) string {
+	s = `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+	if prefix {
+		s += "*"
+	}
+	return s
+}
+
+// stopWords are common English words that say nothing about what a page is
+// about.
+var stopWords = map[string]bool{
+	"about": true, "after": true, "also": true, "because": true, "been": true,
+	"before": true, "being": true, "could": true, "does": true, "each": true,
+	"from": true, "have": true, "here": true, "into": true, "just": true,
+	"like": true, "more": true, "most": true, "much": true, "only": true,
+	"other": true, "over": true, "same": true, "should": true, "some": true,
+	"such": true, "than": true, "that": true, "their": true, "them": true,
+	"then": true, "there": true, "these": true, "they": true, "this": true,
+	"those": true, "very": true, "were": true, "what": true, "when": true,
+	"where": true, "which": true, "while": true, "will": true, "with": true,
+	"would": true, "your": true,
+}
+
+// RelatedFTSQuery returns a full text search query matching any of the n words
+// of text used the most, leaving out short words and stop words, or an empty
+// query if text has no such words.
+func RelatedFTSQuery(text string, n int) string {
+	counts := make(map[string]int)
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		if len([]rune(word)) >= 4 && !stopWords[word] {
+			counts[word]++
+		}
+	}
+	words := make([]string, 0, len(counts))
+	for word := range counts {
+		words = append(words, word)
+	}
+	sort.Slice(words, func(i, j int) bool {
+		if counts[words[i]] != counts[words[j]] {
+			return counts[words[i]] > counts[words[j]]
+		}
+		return words[i] < words[j]
+	})
+	if len(words) > n {
+		words = words[:n]
+	}
+	for i, word := range words {
+		words[i] = ftsString(word, false)
+	}
+	return strings.Join(words, " OR ")
+}
+
+func isFTSOperator(token string) bool {
+	return token == "AND" || token == "OR" || token == "NOT"
+}
@@ -0,0 +1,166 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// openTimed opens the database like sql.Open, with every query it runs timed
+// by logSlowQuery: those run directly, in transactions or by prepared
+// statements. The time of a query ends when its rows are closed, so it includes
+// reading them.
+func (fs *FileSystem) openTimed(driverName, dsn string) (*sql.DB, error) {
+	// the driver is registered by the callers, see New
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	d := db.Driver()
+	db.Close()
+	return sql.OpenDB(&timedConnector{fs: fs, driver: d, dsn: dsn}), nil
+}
+
+type timedConnector struct {
+	fs     *FileSystem
+	driver driver.Driver
+	dsn    string
+}
+
+func (c *timedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &timedConn{Conn: conn, fs: c.fs}, nil
+}
+
+func (c *timedConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// timedConn passes everything on to the connection of the driver, timing the
+// queries. Exec and Query are passed on as they are rather than prepared, as
+// SQLite runs every statement of them and a prepared statement only the first.
+type timedConn struct {
+	driver.Conn
+	fs *FileSystem
+}
+
+func (c *timedConn) PrepareContext(ctx context.Context, query string) (stmt driver.Stmt, err error) {
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = p.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return
+	}
+	return &timedStmt{Stmt: stmt, fs: c.fs, query: query}, nil
+}
+
+func (c *timedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *timedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (res driver.Result, err error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	defer c.fs.logSlowQuery(query, time.Now())
+	return e.ExecContext(ctx, query, args)
+}
+
+func (c *timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := q.QueryContext(ctx, query, args)
+	if err != nil {
+		c.fs.logSlowQuery(query, start)
+		return nil, err
+	}
+	return &timedRows{Rows: rows, fs: c.fs, query: query, start: start}, nil
+}
+
+func (c *timedConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+type timedStmt struct {
+	driver.Stmt
+	fs    *FileSystem
+	query string
+}
+
+func (s *timedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	defer s.fs.logSlowQuery(s.query, time.Now())
+	if e, ok := s.Stmt.(driver.StmtExecContext); ok {
+		return e.ExecContext(ctx, args)
+	}
+	values, err := namedValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return s.Stmt.Exec(values)
+}
+
+func (s *timedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (rows driver.Rows, err error) {
+	start := time.Now()
+	if q, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = q.QueryContext(ctx, args)
+	} else {
+		var values []driver.Value
+		values, err = namedValues(args)
+		if err == nil {
+			rows, err = s.Stmt.Query(values)
+		}
+	}
+	if err != nil {
+		s.fs.logSlowQuery(s.query, start)
+		return nil, err
+	}
+	return &timedRows{Rows: rows, fs: s.fs, query: s.query, start: start}, nil
+}
+
+// namedValues returns the values of args, for drivers without contexts which
+// take no names.
+func namedValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("sql: driver does not support the use of Named Parameters")
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
+
+// timedRows logs the query once the rows are closed, after they are read.
+type timedRows struct {
+	driver.Rows
+	fs    *FileSystem
+	query string
+	start time.Time
+}
+
+func (r *timedRows) Close() error {
+	defer r.fs.logSlowQuery(r.query, r.start)
+	return r.Rows.Close()
+}
@@ -2,40 +2,215 @@ package db
 
 import (
 	"database/sql"
+	"fmt"
 	"html/template"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"argc.in/scratch/pkg/markdown"
+	"github.com/pkg/errors"
 	"github.com/schollz/versionedtext"
 )
 
 type FileSystem struct {
 	Name string
 	DB   *sql.DB
+	// MaxPageBytes is the largest page Save will accept, zero means no limit.
+	MaxPageBytes int
+	// MaxBlobBytes is the largest uncompressed blob SaveBlob will accept, zero
+	// means no limit.
+	MaxBlobBytes int64
+	// SummaryLength is the maximum length of the plain text summaries of
+	// pages, computed by Save.
+	SummaryLength int
+	// IDLength and IDAlphabet configure the ids of new pages, which are
+	// those of utils.UUID if zero.
+	IDLength   int
+	IDAlphabet string
+	// MaxDomains is the most domains SetDomain creates, not counting the public
+	// domain, zero means no limit.
+	MaxDomains int
+	// NewDomainOptions are the options of domains when they are created.
+	NewDomainOptions DomainOptions
+	// SlowQuery is how long a query takes before it is logged, zero means
+	// queries are never logged.
+	SlowQuery time.Duration
 	sync.RWMutex
+
+	publicDomain string
+
+	// pragmas are set on every connection, see WithPragmas.
+	pragmas map[string]string
+
+	// stmts caches prepared statements by query, guarded by stmtsMu as some
+	// queries run without holding the lock of the FileSystem.
+	stmts   map[string]*sql.Stmt
+	stmtsMu sync.Mutex
+}
+
+// PageTooLargeError is returned by Save when a page exceeds MaxPageBytes.
+type PageTooLargeError struct {
+	Size int
+	Max  int
+}
+
+func (e *PageTooLargeError) Error() string {
+	return fmt.Sprintf("page is %d bytes, larger than the maximum of %d bytes", e.Size, e.Max)
+}
+
+// BlobTooLargeError is returned by SaveBlob when a blob exceeds MaxBlobBytes.
+type BlobTooLargeError struct {
+	Size int64
+	Max  int64
 }
 
+func (e *BlobTooLargeError) Error() string {
+	return fmt.Sprintf("upload is %d bytes, larger than the maximum of %d bytes", e.Size, e.Max)
+}
+
+// ErrTooManyDomains is returned by SetDomain when there are MaxDomains domains.
+var ErrTooManyDomains = errors.New("no more domains can be created")
+
+// ErrKeyNotFound is returned by RevokeKey when the domain has no such key.
+var ErrKeyNotFound = errors.New("no such key")
+
+// ErrBlobNotFound is returned by DeleteBlob when there is no upload with the id.
+var ErrBlobNotFound = errors.New("no upload with that id")
+
+// MaxDictionaryWords is the most words a custom dictionary can have.
+const MaxDictionaryWords = 5000
+
+// ErrDictionaryFull is returned by AddToDictionary when the dictionary would
+// have more than MaxDictionaryWords words.
+var ErrDictionaryFull = fmt.Errorf("dictionaries can't have more than %d words", MaxDictionaryWords)
+
 // File is the basic unit that is saved
 type File struct {
-	ID       string                      `json:"id"`
-	Slug     string                      `json:"slug"`
-	Created  time.Time                   `json:"created"`
-	Modified time.Time                   `json:"modified"`
-	Data     string                      `json:"data"`
-	Domain   string                      `json:"domain"`
-	History  versionedtext.VersionedText `json:"history"`
-	DataHTML template.HTML               `json:"data_html,omitempty"`
-	Views    int                         `json:"views"`
+	ID        string                      `json:"id"`
+	Slug      string                      `json:"slug"`
+	Created   time.Time                   `json:"created"`
+	Modified  time.Time                   `json:"modified"`
+	Data      string                      `json:"data"`
+	Domain    string                      `json:"domain"`
+	History   versionedtext.VersionedText `json:"history"`
+	DataHTML  template.HTML               `json:"data_html,omitempty"`
+	Views     int                         `json:"views"`
+	Published bool                        `json:"published"`
+	PublishAt time.Time                   `json:"publish_at,omitempty"`
+	Summary   string                      `json:"summary"`
+	Title     string                      `json:"title"`
+	Previous  string                      `json:"previous,omitempty"` // set by RecentlyModified
+	Deleted   time.Time                   `json:"deleted,omitempty"`  // zero unless in the trash
+	Rank      float64                     `json:"rank,omitempty"`     // set by Find, higher is more relevant
 }
 
+// CreatedDate formats when the file was created in the time zone utcOffset
+// minutes behind UTC.
 func (f File) CreatedDate(utcOffset int) string {
 	return formattedDate(f.Created, utcOffset)
 }
 
+// ModifiedDate formats when the file was modified like CreatedDate.
 func (f File) ModifiedDate(utcOffset int) string {
 	return formattedDate(f.Modified, utcOffset)
 }
 
+// PublishDate formats when the file is published like CreatedDate.
+func (f File) PublishDate(utcOffset int) string {
+	return formattedDate(f.PublishAt, utcOffset)
+}
+
+// Changed returns when the file was last modified, moved to the trash or
+// published at its scheduled time, if that is past.
+func (f File) Changed() time.Time {
+	changed := f.Modified
+	if f.Deleted.After(changed) {
+		changed = f.Deleted
+	}
+	if f.PublishAt.After(changed) && !f.PublishAt.After(time.Now()) {
+		changed = f.PublishAt
+	}
+	return changed
+}
+
+// IsPublished reports whether the file is published and its scheduled
+// publishing time, if any, is past.
+func (f File) IsPublished() bool {
+	return f.Published && !f.PublishAt.After(time.Now())
+}
+
+// BlobInfo describes an uploaded file.
+type BlobInfo struct {
+	ID       string
+	Name     string
+	MimeType string
+	Size     int
+	Domain   string // empty for uploads of older versions
+}
+
+// KeyInfo describes a key of a domain without revealing it.
+type KeyInfo struct {
+	ID       int
+	Masked   string // the last 4 characters of the key, the others masked
+	LastUsed time.Time
+	Expires  time.Time // zero if the key never expires
+}
+
+// DomainSummary describes a domain in listings of all domains.
+type DomainSummary struct {
+	Name    string
+	Public  bool
+	Pages   int
+	Created time.Time // zero for domains created by older versions
+}
+
+// ActivityEntry is a page being created or modified, in the activity of a
+// domain.
+type ActivityEntry struct {
+	Kind  string // "created" or "modified"
+	Time  time.Time
+	ID    string
+	Slug  string
+	Title string
+}
+
+// Date formats the time of the entry in the time zone utcOffset minutes behind
+// UTC.
+func (e ActivityEntry) Date(utcOffset int) string {
+	return formattedDate(e.Time, utcOffset)
+}
+
+// DomainUsage is the storage taken by a domain.
+type DomainUsage struct {
+	Pages       int
+	PageBytes   int64
+	UploadBytes int64
+}
+
+// Bytes is the total storage taken by the domain.
+func (u DomainUsage) Bytes() int64 {
+	return u.PageBytes + u.UploadBytes
+}
+
+// DBStats is the size of the database.
+type DBStats struct {
+	PageCount     int64            `json:"page_count"`     // pages of the database file
+	PageSize      int64            `json:"page_size"`      // bytes of each page
+	FreelistCount int64            `json:"freelist_count"` // unused pages
+	FTSBytes      int64            `json:"fts_bytes"`      // size of the full text search index
+	Tables        map[string]int64 `json:"tables"`         // rows of each table
+}
+
+// QueryPlan is how SQLite runs a query, from EXPLAIN QUERY PLAN, with a line
+// for each step indented under its parent.
+type QueryPlan struct {
+	Name  string   `json:"name"`
+	Query string   `json:"query"`
+	Plan  []string `json:"plan"`
+}
+
 type DomainOptions struct {
 	MostEdited  int
 	MostRecent  int
@@ -44,4 +219,134 @@ type DomainOptions struct {
 	CustomIntro string
 	CustomTitle string
 	ShowSearch  bool
+	LockEditing bool
+
+	// EmbedOrigins are the space separated origins allowed to embed pages.
+	EmbedOrigins string
+
+	// NewPageTemplate is the initial text of new pages, with {{date}},
+	// {{slug}} and {{id}} replaced. New pages are empty if it is empty.
+	NewPageTemplate string
+
+	// ExpandVariables replaces {{date}}, {{views}}, {{backlinks}} and the
+	// names of Variables in pages with their values when they are shown.
+	ExpandVariables bool
+
+	// Variables are the values of variables of the domain, by name.
+	Variables map[string]string
+
+	// Language is the language tag of the pages, like en or pt-BR, set as
+	// the lang of their HTML. Unset if empty.
+	Language string
+
+	// AllowIndexing lets search engines index the domain if it is public,
+	// the server wide setting applies if nil.
+	AllowIndexing *bool `json:",omitempty"`
+
+	// LogoBlobID and FaviconBlobID are the ids of uploads of the domain shown
+	// as its logo and favicon, the site wide ones are used if they are empty.
+	LogoBlobID    string
+	FaviconBlobID string
+
+	// HighlightStyle is the chroma style of code blocks, the server wide
+	// style applies if empty.
+	HighlightStyle string
+
+	// LineNumbers numbers the lines of highlighted code blocks.
+	LineNumbers bool
+
+	// CopyCodeButtons shows a button copying each code block.
+	CopyCodeButtons bool
+
+	// HeadingAnchors shows a # linking to each heading when hovering it.
+	HeadingAnchors bool
+
+	// AutoDetectCode highlights code blocks without a language in the
+	// language markdown.DetectLanguage finds, which can be wrong.
+	AutoDetectCode bool
+
+	// EditorFont is the CSS font-family of the editor, like "Fira Code,
+	// monospace". The monospace font of the browser if empty.
+	EditorFont string
+
+	// CodeEditor numbers the lines of the editor, which then don't wrap,
+	// indents and unindents the selected lines with tab and shift+tab and
+	// keeps the indentation of new lines.
+	CodeEditor bool
+
+	// CustomDictionary are the words, like names and jargon, spellchecking
+	// the pages of the domain shouldn't flag.
+	CustomDictionary []string `json:",omitempty"`
+
+	// Markdown are the extensions of markdown the pages are rendered with.
+	Markdown markdown.Extensions
+
+	// AllowedUploadTypes are the space separated MIME types, like image/*,
+	// of files that can be uploaded. The server wide types apply if empty.
+	AllowedUploadTypes string
+
+	// RelatedPages shows the pages related to each page below it, found by
+	// RelatedByTags or RelatedByContent. None are shown if empty.
+	RelatedPages string
+
+	// AllowAnonymousCreate and AllowAnonymousEdit control whether visitors
+	// that are not signed in can create and edit pages in the public domain.
+	AllowAnonymousCreate bool
+	AllowAnonymousEdit   bool
+}
+
+// The ways GetRelated finds the pages related to a page.
+const (
+	RelatedByTags    = "tags"    // pages sharing the most #tags
+	RelatedByContent = "content" // pages using the same words
+)
+
+// DefaultDomainOptions returns the options of a domain which hasn't set them.
+func DefaultDomainOptions() DomainOptions {
+	return DomainOptions{
+		AllowAnonymousCreate: true,
+		AllowAnonymousEdit:   true,
+		Markdown:             markdown.AllExtensions,
+		LineNumbers:          true,
+	}
+}
+
+// ParserOptions are the options of the markdown.Parser rendering the pages.
+// Code blocks keep the classes of the stylesheet of the HighlightStyle, so
+// their cached HTML doesn't depend on it.
+func (o DomainOptions) ParserOptions() markdown.ParserOptions {
+	return markdown.ParserOptions{
+		Extensions:  o.Markdown,
+		LineNumbers: o.LineNumbers,
+	}
+}
+
+// IndexingChoice returns "on" or "off" if the domain allows or disallows
+// indexing, and "" if the server wide setting applies.
+func (o DomainOptions) IndexingChoice() string {
+	if o.AllowIndexing == nil {
+		return ""
+	} else if *o.AllowIndexing {
+		return "on"
+	}
+	return "off"
+}
+
+// DictionaryText returns the CustomDictionary, a word per line.
+func (o DomainOptions) DictionaryText() string {
+	return strings.Join(o.CustomDictionary, "\n")
+}
+
+// VariablesText returns the Variables as "name = value" lines, sorted by name.
+func (o DomainOptions) VariablesText() string {
+	names := make([]string, 0, len(o.Variables))
+	for name := range o.Variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := make([]string, len(names))
+	for i, name := range names {
+		lines[i] = name + " = " + o.Variables[name]
+	}
+	return strings.Join(lines, "\n")
 }
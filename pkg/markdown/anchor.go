@@ -0,0 +1,54 @@
+package markdown
+
+import (
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/util"
+)
+
+// HeadingAnchorExtension ends headings with an id with a link to them, of the
+// class heading-anchor, for stylesheets to show or hide.
+func HeadingAnchorExtension() goldmark.Extender {
+	return headingAnchorExtension{}
+}
+
+type headingAnchorExtension struct{}
+
+func (headingAnchorExtension) Extend(m goldmark.Markdown) {
+	// before the heading renderer of goldmark, at 1000
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(headingAnchorRenderer{}, 500),
+	))
+}
+
+type headingAnchorRenderer struct{}
+
+func (r headingAnchorRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindHeading, r.renderHeading)
+}
+
+func (headingAnchorRenderer) renderHeading(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	n := node.(*ast.Heading)
+	if entering {
+		_, _ = w.WriteString("<h")
+		_ = w.WriteByte("0123456"[n.Level])
+		if n.Attributes() != nil {
+			html.RenderAttributes(w, node, html.HeadingAttributeFilter)
+		}
+		_ = w.WriteByte('>')
+		return ast.WalkContinue, nil
+	}
+	if id, ok := n.AttributeString("id"); ok {
+		if id, ok := id.([]byte); ok {
+			_, _ = w.WriteString(`<a class="heading-anchor" href="#`)
+			_, _ = w.Write(util.EscapeHTML(id))
+			_, _ = w.WriteString(`" aria-label="Link to this section">#</a>`)
+		}
+	}
+	_, _ = w.WriteString("</h")
+	_ = w.WriteByte("0123456"[n.Level])
+	_, _ = w.WriteString(">\n")
+	return ast.WalkContinue, nil
+}
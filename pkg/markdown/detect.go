@@ -0,0 +1,82 @@
+package markdown
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/alecthomas/chroma"
+	"github.com/alecthomas/chroma/lexers"
+)
+
+// minDetectScore is the least score of a chroma analyser trusted to name the
+// language of a code block, lower scores are mere hints.
+const minDetectScore = 0.5
+
+// shebang matches the interpreter of a #! line, like python3 in
+// #!/usr/bin/env python3.
+var shebang = regexp.MustCompile(`^#!\s*(?:\S*/)?(?:env\s+)?([A-Za-z][\w.+-]*)`)
+
+// DetectLanguage returns the name of the language of code, from its #! line or
+// the analysers of chroma, or "" if it isn't clear.
+func DetectLanguage(code string) string {
+	if m := shebang.FindStringSubmatch(code); m != nil {
+		if lexer := lexers.Get(m[1]); lexer != nil {
+			return lexerName(lexer)
+		}
+	}
+	var best chroma.Lexer
+	var highest float32
+	for _, lexer := range lexers.Registry.Lexers {
+		if analyser, ok := lexer.(chroma.Analyser); ok {
+			if score := analyser.AnalyseText(code); score > highest {
+				best, highest = lexer, score
+			}
+		}
+	}
+	if best == nil || highest < minDetectScore {
+		return ""
+	}
+	return lexerName(best)
+}
+
+// lexerName returns the name to give a code block for chroma to use the lexer.
+func lexerName(lexer chroma.Lexer) string {
+	if aliases := lexer.Config().Aliases; len(aliases) > 0 {
+		return aliases[0]
+	}
+	return strings.ToLower(lexer.Config().Name)
+}
+
+// LabelCodeBlocks names the language of the fenced code blocks of data that
+// have none, when DetectLanguage finds it.
+func LabelCodeBlocks(data string) string {
+	lines := strings.SplitAfter(data, "\n")
+	for i := 0; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		if !strings.HasPrefix(trimmed, "```") && !strings.HasPrefix(trimmed, "~~~") {
+			continue
+		}
+		info := strings.TrimLeft(trimmed, trimmed[:1])
+		fence := trimmed[:len(trimmed)-len(info)]
+		labeled := info != ""
+		start := i
+		var code strings.Builder
+		for i++; i < len(lines) && !closesFence(lines[i], fence); i++ {
+			code.WriteString(lines[i])
+		}
+		if labeled {
+			continue
+		}
+		if language := DetectLanguage(code.String()); language != "" {
+			lines[start] = strings.TrimRight(lines[start], " \t\r\n") + language + "\n"
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// closesFence reports whether line closes a code block opened by fence: a fence
+// of the same character at least as long, with nothing after it.
+func closesFence(line, fence string) bool {
+	trimmed := strings.TrimSpace(line)
+	return strings.HasPrefix(trimmed, fence) && strings.TrimLeft(trimmed, fence[:1]) == ""
+}
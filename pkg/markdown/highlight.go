@@ -0,0 +1,46 @@
+package markdown
+
+import (
+	"bytes"
+	"sync"
+
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/styles"
+)
+
+// DefaultHighlightStyle is the chroma style of code blocks unless set
+// otherwise.
+const DefaultHighlightStyle = "friendly"
+
+// highlightFormatOptions are those of the stylesheets, which style code
+// blocks with and without line numbers.
+var highlightFormatOptions = []chromahtml.Option{
+	chromahtml.WithClasses(true),
+	chromahtml.WithLineNumbers(true),
+}
+
+var highlightCSS sync.Map // style name to stylesheet
+
+// HighlightStyleExists reports whether chroma has a style of the name.
+func HighlightStyleExists(name string) bool {
+	_, ok := styles.Registry[name]
+	return ok
+}
+
+// HighlightCSS returns the stylesheet coloring code blocks in the named style,
+// or the default style if there is no such style.
+func HighlightCSS(name string) ([]byte, error) {
+	if !HighlightStyleExists(name) {
+		name = DefaultHighlightStyle
+	}
+	if css, ok := highlightCSS.Load(name); ok {
+		return css.([]byte), nil
+	}
+	var buf bytes.Buffer
+	err := chromahtml.New(highlightFormatOptions...).WriteCSS(&buf, styles.Get(name))
+	if err != nil {
+		return nil, err
+	}
+	highlightCSS.Store(name, buf.Bytes())
+	return buf.Bytes(), nil
+}
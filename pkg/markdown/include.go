@@ -0,0 +1,83 @@
+package markdown
+
+import (
+	"regexp"
+	"strings"
+)
+
+// MaxIncludeDepth is how deep included pages can include other pages.
+const MaxIncludeDepth = 3
+
+// MaxIncludes and MaxIncludeBytes bound how many pages are included in a page,
+// at any depth, and how many bytes they add to it, so pages including pages
+// that include many pages each don't cost a render without end.
+const (
+	MaxIncludes     = 100
+	MaxIncludeBytes = 1 << 20
+)
+
+// include matches ![[page]], ignoring any label or fragment after the page.
+var include = regexp.MustCompile(`!\[\[([^\]|#]+)[^\]]*\]\]`)
+
+// ExpandIncludes replaces each ![[page]] in data, the contents of the page
+// named page, outside of code with the contents get returns for the page. These
+// can include other pages in turn, up to MaxIncludeDepth deep, and get is
+// called once for each page. Includes of pages get doesn't return, of pages
+// that include themselves, of pages too deep and those past MaxIncludes or
+// MaxIncludeBytes are replaced with a note instead.
+func ExpandIncludes(data, page string, get func(page string) (string, bool)) string {
+	e := &includeExpander{get: get, pages: make(map[string]includedPage)}
+	return e.expand(data, []string{page})
+}
+
+// includeExpander expands the includes of a page, counting them.
+type includeExpander struct {
+	get      func(page string) (string, bool)
+	pages    map[string]includedPage
+	includes int
+	bytes    int
+}
+
+// includedPage is what get returned for a page.
+type includedPage struct {
+	contents string
+	ok       bool
+}
+
+func (e *includeExpander) expand(data string, parents []string) string {
+	return outsideCode(data, func(s string) string {
+		return include.ReplaceAllStringFunc(s, func(m string) string {
+			page := strings.TrimSpace(include.FindStringSubmatch(m)[1])
+			for _, parent := range parents {
+				if parent == page {
+					return brokenInclude(page, "includes itself")
+				}
+			}
+			if len(parents) > MaxIncludeDepth {
+				return brokenInclude(page, "is included too deep")
+			}
+			if e.includes >= MaxIncludes {
+				return brokenInclude(page, "is included once too many")
+			}
+			e.includes++
+			included, seen := e.pages[page]
+			if !seen {
+				included.contents, included.ok = e.get(page)
+				e.pages[page] = included
+			}
+			if !included.ok {
+				return brokenInclude(page, "not found")
+			}
+			if e.bytes+len(included.contents) > MaxIncludeBytes {
+				return brokenInclude(page, "makes the page too large")
+			}
+			e.bytes += len(included.contents)
+			return e.expand(included.contents, append(parents, page))
+		})
+	})
+}
+
+// brokenInclude is the note shown in place of the include of page.
+func brokenInclude(page, reason string) string {
+	return "**[[" + page + "]] " + reason + "**"
+}
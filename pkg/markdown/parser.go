@@ -2,36 +2,216 @@ package markdown
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"html/template"
+	"sync"
 
 	chromahtml "github.com/alecthomas/chroma/formatters/html"
 	"github.com/yuin/goldmark"
 	"github.com/yuin/goldmark-emoji"
 	"github.com/yuin/goldmark-highlighting"
+	"github.com/yuin/goldmark/ast"
 	"github.com/yuin/goldmark/extension"
 	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
 	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/util"
 )
 
+// Extensions are the extensions of markdown, on top of CommonMark, a Parser
+// understands.
+type Extensions struct {
+	GFM          bool // tables, task lists, strikethrough and bare links
+	Footnotes    bool
+	Emoji        bool // :shortcodes: of emoji
+	WikiLinks    bool // [[page]] links
+	Highlighting bool // of the code in code blocks
+}
+
+// AllExtensions are the extensions of NewParser.
+var AllExtensions = Extensions{
+	GFM:          true,
+	Footnotes:    true,
+	Emoji:        true,
+	WikiLinks:    true,
+	Highlighting: true,
+}
+
+// ParserOptions are the options of a Parser.
+type ParserOptions struct {
+	Extensions Extensions
+
+	// HighlightStyle, if set, colors highlighted code blocks inline in the
+	// chroma style, for HTML shown without the stylesheet of HighlightCSS,
+	// like in feeds. DefaultHighlightStyle is used if there's no such style.
+	// Code blocks only get the classes of the stylesheet if it is empty.
+	HighlightStyle string
+
+	// LineNumbers numbers the lines of highlighted code blocks.
+	LineNumbers bool
+}
+
+// DefaultParserOptions are the options of NewParser.
+var DefaultParserOptions = ParserOptions{
+	Extensions:  AllExtensions,
+	LineNumbers: true,
+}
+
+// NewParser returns a Parser with the DefaultParserOptions.
 func NewParser() *Parser {
+	return NewParserWithOptions(DefaultParserOptions)
+}
+
+// NewParserWith returns a Parser with the extensions and the other
+// DefaultParserOptions.
+func NewParserWith(ext Extensions) *Parser {
+	opts := DefaultParserOptions
+	opts.Extensions = ext
+	return NewParserWithOptions(opts)
+}
+
+// NewParserWithOptions returns a Parser with the options.
+func NewParserWithOptions(opts ParserOptions) *Parser {
+	ext := opts.Extensions
+	extensions := []goldmark.Extender{HeadingAnchorExtension()}
+	if ext.GFM {
+		extensions = append(extensions, extension.GFM)
+	}
+	if ext.Footnotes {
+		extensions = append(extensions, extension.Footnote)
+	}
+	if ext.Emoji {
+		extensions = append(extensions, emoji.Emoji)
+	}
+	if ext.Highlighting {
+		extensions = append(extensions, highlighting.NewHighlighting(highlightOptions(opts)...))
+	} else {
+		extensions = append(extensions, plainCodeBlocks{})
+	}
+	if ext.WikiLinks {
+		extensions = append(extensions, WikiLinkExtension())
+	}
 	return &Parser{
 		md: goldmark.New(
-			goldmark.WithExtensions(
-				extension.GFM,
-				extension.Footnote,
-				emoji.Emoji,
-				highlighting.NewHighlighting(
-					highlighting.WithStyle("friendly"),
-					highlighting.WithFormatOptions(chromahtml.WithLineNumbers(true)),
-				),
-				WikiLinkExtension(),
-			),
+			goldmark.WithExtensions(extensions...),
 			goldmark.WithParserOptions(parser.WithAutoHeadingID()),
 			goldmark.WithRendererOptions(html.WithHardWraps()),
 		),
 	}
 }
 
+// highlightOptions are the options highlighting code blocks as opts say.
+func highlightOptions(opts ParserOptions) []highlighting.Option {
+	options := []highlighting.Option{
+		highlighting.WithFormatOptions(
+			chromahtml.WithClasses(opts.HighlightStyle == ""),
+			chromahtml.WithLineNumbers(opts.LineNumbers),
+		),
+		highlighting.WithWrapperRenderer(codeBlockWrapper),
+	}
+	if opts.HighlightStyle != "" {
+		style := opts.HighlightStyle
+		if !HighlightStyleExists(style) {
+			style = DefaultHighlightStyle
+		}
+		options = append(options, highlighting.WithStyle(style))
+	}
+	return options
+}
+
+// Parsers keeps a Parser for each combination of options, as they are
+// costly to make.
+type Parsers struct {
+	sync.Mutex
+	parsers map[ParserOptions]*Parser
+}
+
+func NewParsers() *Parsers {
+	return &Parsers{parsers: make(map[ParserOptions]*Parser)}
+}
+
+// Get returns the Parser with the options, making it the first time.
+func (p *Parsers) Get(opts ParserOptions) *Parser {
+	p.Lock()
+	defer p.Unlock()
+	parser, ok := p.parsers[opts]
+	if !ok {
+		parser = NewParserWithOptions(opts)
+		p.parsers[opts] = parser
+	}
+	return parser
+}
+
+// codeBlockWrapper puts code blocks in a div with a button copying them, which
+// stays hidden unless static/js/copycode.js shows it.
+func codeBlockWrapper(w util.BufWriter, c highlighting.CodeBlockContext, entering bool) {
+	if entering {
+		_, _ = w.WriteString(`<div class="code-block"><button type="button" class="copy-code" aria-label="Copy code" hidden>Copy</button>`)
+		if !c.Highlighted() {
+			_, _ = w.WriteString("<pre><code")
+			if language, ok := c.Language(); ok {
+				_, _ = w.WriteString(` class="language-`)
+				_, _ = w.Write(util.EscapeHTML(language))
+				_ = w.WriteByte('"')
+			}
+			_ = w.WriteByte('>')
+		}
+		return
+	}
+	if !c.Highlighted() {
+		_, _ = w.WriteString("</code></pre>")
+	}
+	_, _ = w.WriteString("</div>\n")
+}
+
+// plainCodeBlocks renders fenced code blocks without highlighting, in the
+// same div as highlighted ones so they get a copy button too.
+type plainCodeBlocks struct{}
+
+func (plainCodeBlocks) Extend(m goldmark.Markdown) {
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(plainCodeBlocks{}, 200),
+	))
+}
+
+func (plainCodeBlocks) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindFencedCodeBlock, func(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		n := node.(*ast.FencedCodeBlock)
+		c := plainCodeBlockContext{language: n.Language(source)}
+		codeBlockWrapper(w, c, true)
+		lines := n.Lines()
+		for i := 0; i < lines.Len(); i++ {
+			line := lines.At(i)
+			_, _ = w.Write(util.EscapeHTML(line.Value(source)))
+		}
+		codeBlockWrapper(w, c, false)
+		return ast.WalkSkipChildren, nil
+	})
+}
+
+// plainCodeBlockContext is the highlighting.CodeBlockContext of a code block
+// which isn't highlighted.
+type plainCodeBlockContext struct {
+	language []byte
+}
+
+func (c plainCodeBlockContext) Language() ([]byte, bool) {
+	return c.language, c.language != nil
+}
+
+func (c plainCodeBlockContext) Highlighted() bool {
+	return false
+}
+
+func (c plainCodeBlockContext) Attributes() highlighting.ImmutableAttributes {
+	return nil
+}
+
 type Parser struct {
 	md goldmark.Markdown
 }
@@ -45,3 +225,54 @@ func (p *Parser) Convert(data string) (template.HTML, error) {
 
 	return template.HTML(buf.String()), nil
 }
+
+// ErrRenderTimeout is returned by ConvertContext when the deadline of the
+// context passes before the conversion finishes.
+var ErrRenderTimeout = errors.New("render took too long")
+
+// ConvertContext converts data like Convert, but gives up once ctx is done,
+// with ErrRenderTimeout if its deadline passed and with its error wrapped if
+// it was cancelled. goldmark cannot be interrupted, so an abandoned
+// conversion keeps running in the background until it finishes.
+func (p *Parser) ConvertContext(ctx context.Context, data string) (template.HTML, error) {
+	return p.ConvertContextRelease(ctx, data, func() {})
+}
+
+// ConvertContextRelease is ConvertContext, calling release once the conversion
+// is over. When ConvertContext gives up on ctx that is after it returns, as
+// the conversion goes on, so a slot limiting the conversions running at once
+// is only freed once it really is free.
+func (p *Parser) ConvertContextRelease(ctx context.Context, data string, release func()) (template.HTML, error) {
+	if err := ctx.Err(); err != nil {
+		release()
+		return "", contextError(err)
+	}
+
+	type result struct {
+		html template.HTML
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		defer release()
+		html, err := p.Convert(data)
+		done <- result{html, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.html, res.err
+	case <-ctx.Done():
+		return "", contextError(ctx.Err())
+	}
+}
+
+// contextError returns the error of ConvertContext for the error of its
+// context.
+func contextError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrRenderTimeout
+	}
+	return fmt.Errorf("render aborted: %w", err)
+}
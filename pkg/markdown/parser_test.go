@@ -0,0 +1,329 @@
+package markdown
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHighlightingUsesClasses(t *testing.T) {
+	tests := []struct {
+		name        string
+		markdown    string
+		highlighted bool
+	}{
+		{"go", "```go\npackage main\n\nfunc main() {\n\tprintln(\"hello\")\n}\n```\n", true},
+		{"python", "```python\ndef main():\n    print('hello')\n```\n", true},
+		{"html", "```html\n<p class=\"x\">hello</p>\n```\n", true},
+		{"unknown language", "```nosuchlanguage\nhello\n```\n", false},
+		{"no language", "```\nhello\n```\n", false},
+	}
+	p := NewParser()
+	for _, tt := range tests {
+		html, err := p.Convert(tt.markdown)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if strings.Contains(string(html), "style=") {
+			t.Errorf("%s: inline style in %s", tt.name, html)
+		}
+		if tt.highlighted && !strings.Contains(string(html), `class="chroma"`) {
+			t.Errorf("%s: no chroma class in %s", tt.name, html)
+		}
+	}
+}
+
+func TestHighlightLineNumbers(t *testing.T) {
+	const code = "```go\npackage main\n```\n"
+	tests := []struct {
+		name        string
+		lineNumbers bool
+	}{
+		{"line numbers", true},
+		{"no line numbers", false},
+	}
+	parsers := NewParsers()
+	for _, tt := range tests {
+		html, err := parsers.Get(ParserOptions{Extensions: AllExtensions, LineNumbers: tt.lineNumbers}).Convert(code)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if strings.Contains(string(html), "style=") {
+			t.Errorf("%s: inline style in %s", tt.name, html)
+		}
+		if got := strings.Contains(string(html), `class="ln"`); got != tt.lineNumbers {
+			t.Errorf("%s: line numbers %v in %s", tt.name, got, html)
+		}
+	}
+}
+
+func TestHighlightStyle(t *testing.T) {
+	const code = "```go\npackage main\n```\n"
+	tests := []struct {
+		name       string
+		style      string
+		background string // of the style, or empty for classes only
+	}{
+		{"classes", "", ""},
+		{"style", "monokai", "#272822"},
+		{"unknown style", "nosuchstyle", "#f0f0f0"}, // DefaultHighlightStyle
+	}
+	parsers := NewParsers()
+	for _, tt := range tests {
+		html, err := parsers.Get(ParserOptions{Extensions: AllExtensions, HighlightStyle: tt.style}).Convert(code)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := strings.Contains(string(html), "style="); got != (tt.background != "") {
+			t.Errorf("%s: inline style %v in %s", tt.name, got, html)
+		}
+		if tt.background != "" && !strings.Contains(string(html), tt.background) {
+			t.Errorf("%s: no background %s in %s", tt.name, tt.background, html)
+		}
+	}
+}
+
+func TestTaskListExtensions(t *testing.T) {
+	const tasks = "- [ ] to do\n- [x] done\n"
+	tests := []struct {
+		name       string
+		ext        Extensions
+		checkboxes bool
+	}{
+		{"all", AllExtensions, true},
+		{"gfm", Extensions{GFM: true}, true},
+		{"commonmark", Extensions{}, false},
+		{"no gfm", Extensions{Footnotes: true, Emoji: true, WikiLinks: true, Highlighting: true}, false},
+	}
+	parsers := NewParsers()
+	for _, tt := range tests {
+		html, err := parsers.Get(ParserOptions{Extensions: tt.ext}).Convert(tasks)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		checkboxes := strings.Count(string(html), `type="checkbox"`)
+		literal := strings.Contains(string(html), "[ ] to do") && strings.Contains(string(html), "[x] done")
+		if tt.checkboxes && (checkboxes != 2 || literal) {
+			t.Errorf("%s: want 2 checkboxes in %s", tt.name, html)
+		}
+		if !tt.checkboxes && (checkboxes != 0 || !literal) {
+			t.Errorf("%s: want the tasks as text in %s", tt.name, html)
+		}
+	}
+}
+
+func TestConvertContext(t *testing.T) {
+	p := NewParser()
+	html, err := p.ConvertContext(context.Background(), "*hello*")
+	if err != nil || !strings.Contains(string(html), "<em>hello</em>") {
+		t.Errorf("ConvertContext = %q, %v", html, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = p.ConvertContext(ctx, "*hello*")
+	if !errors.Is(err, context.Canceled) || errors.Is(err, ErrRenderTimeout) {
+		t.Errorf("cancelled: err = %v, want context.Canceled", err)
+	}
+
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	_, err = p.ConvertContext(ctx, "*hello*")
+	if !errors.Is(err, ErrRenderTimeout) {
+		t.Errorf("past deadline: err = %v, want ErrRenderTimeout", err)
+	}
+}
+
+func TestConvertContextRelease(t *testing.T) {
+	p := NewParser()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, done := range []bool{false, true} {
+		if done {
+			cancel()
+		}
+		released := make(chan struct{}, 2)
+		_, _ = p.ConvertContextRelease(ctx, "*hello*", func() { released <- struct{}{} })
+		select {
+		case <-released:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("done %v: not released", done)
+		}
+		select {
+		case <-released:
+			t.Errorf("done %v: released twice", done)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestToggleTask(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name    string
+		data    string
+		n       int
+		checked *bool
+		want    string
+		found   bool
+	}{
+		{"check", "- [ ] a\n- [x] b\n", 0, nil, "- [x] a\n- [x] b\n", true},
+		{"uncheck", "- [ ] a\n- [x] b\n", 1, nil, "- [ ] a\n- [ ] b\n", true},
+		{"set checked", "- [ ] a\n- [x] b\n", 1, &yes, "- [ ] a\n- [x] b\n", true},
+		{"set unchecked", "- [X] a\n", 0, &no, "- [ ] a\n", true},
+		{"no such task", "- [ ] a\n", 1, nil, "- [ ] a\n", false},
+		{"ordered", "1. [ ] one\n2) [ ] two\n", 0, nil, "1. [x] one\n2) [ ] two\n", true},
+		{"nested", "- a\n  - [ ] b\n", 0, nil, "- a\n  - [x] b\n", true},
+		{"blockquote", "> - [ ] quoted\n", 0, nil, "> - [x] quoted\n", true},
+		{"fence", "```\n- [ ] code\n```\n- [ ] a\n", 0, nil, "```\n- [ ] code\n```\n- [x] a\n", true},
+		{"longer fence", "````\n```\n- [ ] code\n````\n- [ ] a\n", 0, nil, "````\n```\n- [ ] code\n````\n- [x] a\n", true},
+		{"fence in blockquote", "> ```\n> - [ ] code\n> ```\n\n- [ ] a\n", 0, nil, "> ```\n> - [ ] code\n> ```\n\n- [x] a\n", true},
+		{"indented code", "    - [ ] code\n\n- [ ] a\n", 0, nil, "    - [ ] code\n\n- [x] a\n", true},
+		{"not a task", "[ ] a\n", 0, nil, "[ ] a\n", false},
+	}
+	p := NewParser()
+	for _, tt := range tests {
+		got, found := p.ToggleTask(tt.data, tt.n, tt.checked)
+		if got != tt.want || found != tt.found {
+			t.Errorf("%s: ToggleTask(%q, %d) = %q, %v, want %q, %v", tt.name, tt.data, tt.n, got, found, tt.want, tt.found)
+		}
+	}
+}
+
+// checkbox matches the checkboxes of tasks, capturing their attributes.
+var checkbox = regexp.MustCompile(`<input([^>]*)type="checkbox"`)
+
+// checkboxStates returns whether each checkbox of the HTML is checked.
+func checkboxStates(html string) []bool {
+	states := []bool{}
+	for _, m := range checkbox.FindAllStringSubmatch(html, -1) {
+		states = append(states, strings.Contains(m[1], "checked"))
+	}
+	return states
+}
+
+func TestToggleTaskMatchesRendering(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"code", "- [ ] a\n\n```\n- [ ] code\n```\n\n    - [x] indented\n\n- [x] b\n"},
+		{"blockquote", "> ```\n> - [ ] code\n> ```\n> - [ ] quoted\n\n- [ ] a\n"},
+		{"no space", "- [x]foo\n- [ ] a\n"},
+		{"loose", "- [ ] a\n\n- [x] b\n\n  more of b\n"},
+	}
+	p := NewParser()
+	for _, tt := range tests {
+		html, err := p.Convert(tt.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		states := checkboxStates(string(html))
+		if _, found := p.ToggleTask(tt.data, len(states), nil); found {
+			t.Errorf("%s: a task more than the %d checkboxes", tt.name, len(states))
+		}
+		for i := range states {
+			data, found := p.ToggleTask(tt.data, i, nil)
+			if !found {
+				t.Errorf("%s: no task %d of %d checkboxes", tt.name, i, len(states))
+				continue
+			}
+			toggled, err := p.Convert(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := append([]bool{}, states...)
+			want[i] = !want[i]
+			if got := checkboxStates(string(toggled)); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: toggling %d gives %v, want %v", tt.name, i, got, want)
+			}
+		}
+	}
+}
+
+func TestExpandIncludes(t *testing.T) {
+	pages := map[string]string{
+		"a":    "A ![[b]]",
+		"b":    "B",
+		"self": "![[self]]",
+		"deep": "![[deep1]]",
+		"big":  strings.Repeat("x", MaxIncludeBytes/2+1),
+	}
+	for i := 1; i <= MaxIncludeDepth+1; i++ {
+		pages["deep"+strconv.Itoa(i)] = "![[deep" + strconv.Itoa(i+1) + "]]"
+	}
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"include", "![[a]]", "A B"},
+		{"label", "![[b|the b]] and ![[b#part]]", "B and B"},
+		{"code", "`![[b]]`", "`![[b]]`"},
+		{"missing", "![[missing]]", brokenInclude("missing", "not found")},
+		{"itself", "![[self]]", brokenInclude("self", "includes itself")},
+		{"too deep", "![[deep]]", brokenInclude("deep"+strconv.Itoa(MaxIncludeDepth), "is included too deep")},
+		{"too large", "![[big]]![[big]]", pages["big"] + brokenInclude("big", "makes the page too large")},
+	}
+	for _, tt := range tests {
+		got := ExpandIncludes(tt.data, "page", func(page string) (string, bool) {
+			data, ok := pages[page]
+			return data, ok
+		})
+		if got != tt.want {
+			t.Errorf("%s: ExpandIncludes(%q) = %.100q, want %.100q", tt.name, tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestExpandIncludesFanOut(t *testing.T) {
+	// a page including 100 pages each including 100 pages
+	pages := map[string]string{"page": strings.Repeat("![[fan]]\n", 100)}
+	pages["fan"] = strings.Repeat("![[leaf]]\n", 100)
+	pages["leaf"] = "LEAF"
+	gets := 0
+	got := ExpandIncludes(pages["page"], "page", func(page string) (string, bool) {
+		gets++
+		data, ok := pages[page]
+		return data, ok
+	})
+	if gets != 2 {
+		t.Errorf("get called %d times, want once for each page", gets)
+	}
+	if n := strings.Count(got, "LEAF"); n > MaxIncludes {
+		t.Errorf("%d pages included, want at most %d", n, MaxIncludes)
+	}
+	if !strings.Contains(got, "once too many") {
+		t.Errorf("no note of the includes left out in %.200q", got)
+	}
+}
+
+func TestLabelCodeBlocks(t *testing.T) {
+	script := "#!/usr/bin/env python3\nprint(1)\n"
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"unlabeled", "```\n" + script + "```\n", "```python\n" + script + "```\n"},
+		{"labeled", "```sh\n" + script + "```\n", "```sh\n" + script + "```\n"},
+		{"tildes", "~~~\n" + script + "~~~\n", "~~~python\n" + script + "~~~\n"},
+		// the block holding a shorter fence ends at the fence as long as its own,
+		// not at the shorter one opening another block at its end
+		{"longer fence", "````\n```\n````\n" + script, "````\n```\n````\n" + script},
+	}
+	for _, tt := range tests {
+		if got := LabelCodeBlocks(tt.data); got != tt.want {
+			t.Errorf("%s: LabelCodeBlocks(%q) = %q, want %q", tt.name, tt.data, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package markdown
+
+import (
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/text"
+)
+
+// plain only parses, so it doesn't need the rendering extensions of Parser.
+var plain = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+// PlainText returns the text of the document without its markdown, code blocks
+// and HTML, shortened to at most n characters at a word boundary.
+func PlainText(data string, n int) string {
+	src := []byte(data)
+	doc := plain.Parser().Parse(text.NewReader(src))
+
+	var b strings.Builder
+	ast.Walk(doc, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch node := node.(type) {
+		case *ast.CodeBlock, *ast.FencedCodeBlock, *ast.HTMLBlock, *ast.RawHTML:
+			return ast.WalkSkipChildren, nil
+		case *ast.Text:
+			b.Write(node.Segment.Value(src))
+			if node.SoftLineBreak() || node.HardLineBreak() {
+				b.WriteByte(' ')
+			}
+		case *ast.String:
+			b.Write(node.Value)
+		}
+		if node.Type() == ast.TypeBlock {
+			b.WriteByte(' ')
+		}
+		return ast.WalkContinue, nil
+	})
+
+	return shorten(strings.Join(strings.Fields(b.String()), " "), n)
+}
+
+// shorten cuts s to at most n characters, at the last space if there is one,
+// marking the cut with an ellipsis.
+func shorten(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	s = string(runes[:n])
+	if i := strings.LastIndex(s, " "); i > 0 {
+		s = s[:i]
+	}
+	return s + "…"
+}
+
+// Title returns the text of the first heading of the document, empty if it
+// has none.
+func Title(data string) (title string) {
+	src := []byte(data)
+	doc := plain.Parser().Parse(text.NewReader(src))
+
+	ast.Walk(doc, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		heading, ok := node.(*ast.Heading)
+		if !ok || !entering {
+			return ast.WalkContinue, nil
+		}
+		title = strings.TrimSpace(string(heading.Text(src)))
+		return ast.WalkStop, nil
+	})
+	return
+}
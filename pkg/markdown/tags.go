@@ -0,0 +1,47 @@
+package markdown
+
+import (
+	"regexp"
+	"strings"
+)
+
+// tag matches a #tag at the start of a line or after a space, so headings,
+// links to #anchors and issue numbers like #12 are not tags.
+var tag = regexp.MustCompile(`(^|\s)#(\pL[\pL\pN_/-]*)`)
+
+// validTag matches a tag, without its #.
+var validTag = regexp.MustCompile(`^\pL[\pL\pN_/-]*$`)
+
+// ValidTag returns whether the tag, without its #, can be written as a #tag.
+func ValidTag(tag string) bool {
+	return validTag.MatchString(tag)
+}
+
+// Tags returns the #tags of data outside of code, lower cased and without
+// their #, each once in the order they first appear.
+func Tags(data string) (tags []string) {
+	seen := make(map[string]bool)
+	ReplaceTags(data, func(tag string) (string, bool) {
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+		return "", false
+	})
+	return
+}
+
+// ReplaceTags replaces the #tags of data outside of code for which replace,
+// given the lower cased tag without its #, returns a replacement and true.
+func ReplaceTags(data string, replace func(tag string) (string, bool)) string {
+	return outsideCode(data, func(s string) string {
+		return tag.ReplaceAllStringFunc(s, func(m string) string {
+			match := tag.FindStringSubmatch(m)
+			replacement, ok := replace(strings.ToLower(match[2]))
+			if !ok {
+				return m
+			}
+			return match[1] + "#" + replacement
+		})
+	})
+}
@@ -0,0 +1,57 @@
+package markdown
+
+import (
+	"github.com/yuin/goldmark/ast"
+	extast "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/text"
+)
+
+// ToggleTask checks or unchecks the task n of data, counting from 0 the
+// checkboxes p renders in the order they appear, and returns data with whether
+// it had task n. The task is flipped when checked is nil, and set to *checked
+// otherwise.
+func (p *Parser) ToggleTask(data string, n int, checked *bool) (string, bool) {
+	src := []byte(data)
+	doc := p.md.Parser().Parse(text.NewReader(src))
+
+	at := -1
+	ast.Walk(doc, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if _, ok := node.(*extast.TaskCheckBox); !ok || !entering {
+			return ast.WalkContinue, nil
+		}
+		if n > 0 {
+			n--
+			return ast.WalkContinue, nil
+		}
+		at = taskPosition(node)
+		return ast.WalkStop, nil
+	})
+	// the [ ] of the task, as a check that it was found where it is
+	if at < 0 || at+2 >= len(src) || src[at] != '[' || src[at+2] != ']' {
+		return data, false
+	}
+
+	check := src[at+1] == ' '
+	if checked != nil {
+		check = *checked
+	}
+	state := " "
+	if check {
+		state = "x"
+	}
+	return data[:at+1] + state + data[at+2:], true
+}
+
+// taskPosition returns the offset in the source of the [ ] of the checkbox,
+// which is not kept by the node: it is right after the text before it, or at
+// the start of the text of the list item.
+func taskPosition(checkbox ast.Node) int {
+	if prev, ok := checkbox.PreviousSibling().(*ast.Text); ok {
+		return prev.Segment.Stop
+	}
+	parent := checkbox.Parent()
+	if parent == nil || parent.Lines().Len() == 0 {
+		return -1
+	}
+	return parent.Lines().At(0).Start
+}
@@ -0,0 +1,55 @@
+package markdown
+
+import (
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/text"
+)
+
+// Heading is an entry of the table of contents of a document.
+type Heading struct {
+	Text     string     `json:"text"`
+	Level    int        `json:"level"`
+	ID       string     `json:"id"`
+	Children []*Heading `json:"children"`
+}
+
+// TOC returns the table of contents of the document, as a tree of its
+// headings. The IDs match the anchors of the headings rendered by Convert.
+func (p *Parser) TOC(data string) []*Heading {
+	src := []byte(data)
+	doc := p.md.Parser().Parse(text.NewReader(src))
+
+	toc := []*Heading{}
+	var stack []*Heading
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		heading, ok := n.(*ast.Heading)
+		if !ok || !entering {
+			return ast.WalkContinue, nil
+		}
+
+		h := &Heading{
+			Text:     string(heading.Text(src)),
+			Level:    heading.Level,
+			Children: []*Heading{},
+		}
+		if id, ok := heading.AttributeString("id"); ok {
+			if b, ok := id.([]byte); ok {
+				h.ID = string(b)
+			}
+		}
+
+		// nest under the closest heading of a higher level
+		for len(stack) > 0 && stack[len(stack)-1].Level >= h.Level {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			toc = append(toc, h)
+		} else {
+			parent := stack[len(stack)-1]
+			parent.Children = append(parent.Children, h)
+		}
+		stack = append(stack, h)
+		return ast.WalkSkipChildren, nil
+	})
+	return toc
+}
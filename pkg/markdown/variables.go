@@ -0,0 +1,65 @@
+package markdown
+
+import (
+	"regexp"
+	"strings"
+)
+
+// variable matches {{name}}, or {{{name}}} to write {{name}} literally.
+var variable = regexp.MustCompile(`\{\{\{([a-z][a-z0-9_]*)\}\}\}|\{\{([a-z][a-z0-9_]*)\}\}`)
+
+// ExpandVariables replaces each {{name}} in data with the value of the variable
+// of the name, leaving code blocks and code spans alone. Values are computed
+// once, when first used, and not expanded themselves, so variables can't
+// recurse. Unknown names are left as they are.
+func ExpandVariables(data string, vars map[string]func() string) string {
+	values := make(map[string]string)
+	expand := func(s string) string {
+		return variable.ReplaceAllStringFunc(s, func(m string) string {
+			match := variable.FindStringSubmatch(m)
+			if match[1] != "" {
+				return "{{" + match[1] + "}}"
+			}
+			name := match[2]
+			value, ok := values[name]
+			if !ok {
+				f, found := vars[name]
+				if !found {
+					return m
+				}
+				value = f()
+				values[name] = value
+			}
+			return value
+		})
+	}
+
+	return outsideCode(data, expand)
+}
+
+// outsideCode returns data with replace applied to the text outside of fenced
+// code blocks and code spans.
+func outsideCode(data string, replace func(string) string) string {
+	lines := strings.SplitAfter(data, "\n")
+	fence := ""
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if fence != "" {
+			if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+			}
+			continue
+		}
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			fence = trimmed[:3]
+			continue
+		}
+		// even parts are outside of code spans
+		parts := strings.Split(line, "`")
+		for j := 0; j < len(parts); j += 2 {
+			parts[j] = replace(parts[j])
+		}
+		lines[i] = strings.Join(parts, "`")
+	}
+	return strings.Join(lines, "")
+}
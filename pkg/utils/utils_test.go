@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUUID(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		id := UUID()
+		if len(id) != 10 || strings.Trim(id, letterBytes) != "" {
+			t.Fatalf("UUID() = %q, want 10 characters of [a-z0-9]", id)
+		}
+	}
+}
+
+func TestUUIDWithOptions(t *testing.T) {
+	tests := []struct {
+		length   int
+		alphabet string
+	}{
+		{10, ""},
+		{10, "abcdefghijkmnpqrstuvwxyz23456789"},
+		{16, "abcdefghijkmnpqrstuvwxyz23456789"},
+		{6, "0123456789"},
+		{8, "ab"},
+		{4, "x"},
+	}
+	for _, tt := range tests {
+		alphabet := tt.alphabet
+		if alphabet == "" {
+			alphabet = letterBytes
+		}
+		for i := 0; i < 1000; i++ {
+			id := UUIDWithOptions(tt.length, tt.alphabet)
+			if len(id) != tt.length || strings.Trim(id, alphabet) != "" {
+				t.Fatalf("UUIDWithOptions(%d, %q) = %q", tt.length, tt.alphabet, id)
+			}
+		}
+	}
+}
+
+func TestUUIDWithOptionsDistribution(t *testing.T) {
+	const (
+		alphabet = "abcdefghijkmnpqrstuvwxyz23456789"
+		n        = 100000
+		length   = 10
+	)
+	seen := make(map[string]bool, n)
+	counts := make(map[rune]int, len(alphabet))
+	for i := 0; i < n; i++ {
+		id := UUIDWithOptions(length, alphabet)
+		if seen[id] {
+			t.Fatalf("UUIDWithOptions gave %q twice in %d ids", id, i+1)
+		}
+		seen[id] = true
+		for _, c := range id {
+			counts[c]++
+		}
+	}
+
+	// each character is expected n*length/32 = 31250 times, with a standard
+	// deviation of about 174
+	want := n * length / len(alphabet)
+	for _, c := range alphabet {
+		if got := counts[c]; got < want*95/100 || got > want*105/100 {
+			t.Errorf("%q is used %d times, want about %d", c, got, want)
+		}
+	}
+}
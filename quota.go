@@ -0,0 +1,174 @@
+package rwtxt
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"argc.in/scratch/pkg/db"
+)
+
+// quotaError is returned when a write is refused by the limits of its domain.
+type quotaError struct {
+	reason     string
+	status     int
+	retryAfter time.Duration // until the rate limit allows another write.
+	quota      string        // name of the exceeded quota, Pages or Bytes.
+	remaining  int64         // left of the exceeded quota.
+}
+
+func (e *quotaError) Error() string {
+	return e.reason
+}
+
+// checkQuota checks the write rate of the domain, and that it has room for
+// another page if newPage, and for grow more bytes.
+func (rwt *RWTxt) checkQuota(domain string, newPage bool, grow int64) (err error) {
+	if rwt.domainWrites != nil {
+		if ok, retryAfter := rwt.domainWrites.allow(domain); !ok {
+			return &quotaError{
+				reason:     "too many writes to " + domain + ", try again later",
+				status:     http.StatusTooManyRequests,
+				retryAfter: retryAfter,
+			}
+		}
+	}
+	if rwt.Config.DomainMaxPages <= 0 && rwt.Config.DomainMaxBytes <= 0 {
+		return
+	}
+
+	usage, err := rwt.usage.get(domain, rwt.fs.GetUsage)
+	if err != nil {
+		return
+	}
+	if newPage && rwt.Config.DomainMaxPages > 0 && usage.pages >= rwt.Config.DomainMaxPages {
+		return &quotaError{
+			reason: domain + " has reached its quota of " + strconv.Itoa(rwt.Config.DomainMaxPages) + " pages",
+			status: http.StatusForbidden,
+			quota:  "Pages",
+		}
+	}
+	if grow > 0 && rwt.Config.DomainMaxBytes > 0 && usage.bytes+grow > rwt.Config.DomainMaxBytes {
+		remaining := rwt.Config.DomainMaxBytes - usage.bytes
+		if remaining < 0 {
+			remaining = 0
+		}
+		return &quotaError{
+			reason:    domain + " has reached its storage quota of " + formatSize(int(rwt.Config.DomainMaxBytes)),
+			status:    http.StatusForbidden,
+			quota:     "Bytes",
+			remaining: remaining,
+		}
+	}
+	rwt.usage.add(domain, newPage, grow)
+	return
+}
+
+// usageTTL is how long checkQuota trusts the usage of a domain it counted, as
+// counting it reads all of the pages of the domain. The writes it allows in
+// the meantime are added to it.
+const usageTTL = time.Minute
+
+// usageCache keeps the usage of the domains checked by checkQuota.
+type usageCache struct {
+	sync.Mutex
+	domains map[string]cachedUsage
+	pruned  time.Time
+}
+
+type cachedUsage struct {
+	pages   int
+	bytes   int64
+	counted time.Time
+}
+
+func newUsageCache() *usageCache {
+	return &usageCache{domains: make(map[string]cachedUsage)}
+}
+
+// get returns the usage of the domain, counting it with count if it was
+// counted more than usageTTL ago.
+func (c *usageCache) get(domain string, count func(domain string) (db.DomainUsage, error)) (cachedUsage, error) {
+	domain = strings.ToLower(domain)
+	c.Lock()
+	u, ok := c.domains[domain]
+	c.Unlock()
+	if ok && time.Since(u.counted) < usageTTL {
+		return u, nil
+	}
+
+	usage, err := count(domain)
+	if err != nil {
+		return cachedUsage{}, err
+	}
+	now := time.Now()
+	u = cachedUsage{pages: usage.Pages, bytes: usage.Bytes(), counted: now}
+	c.Lock()
+	defer c.Unlock()
+	c.domains[domain] = u
+	if now.Sub(c.pruned) > usageTTL {
+		c.pruned = now
+		for name, cached := range c.domains {
+			if now.Sub(cached.counted) > usageTTL {
+				delete(c.domains, name)
+			}
+		}
+	}
+	return u, nil
+}
+
+// add counts a write allowed by checkQuota in the usage of the domain, until it
+// is counted again.
+func (c *usageCache) add(domain string, newPage bool, grow int64) {
+	domain = strings.ToLower(domain)
+	c.Lock()
+	defer c.Unlock()
+	u, ok := c.domains[domain]
+	if !ok {
+		return
+	}
+	if newPage {
+		u.pages++
+	}
+	u.bytes += grow
+	c.domains[domain] = u
+}
+
+// forget has the usage of the domain counted again by the next check, after
+// something was deleted from it.
+func (c *usageCache) forget(domain string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.domains, strings.ToLower(domain))
+}
+
+// pageGrowth returns how many bytes saving the page adds to its domain.
+func (rwt *RWTxt) pageGrowth(f db.File) (grow int64) {
+	grow = int64(len(f.Data))
+	if rwt.Config.DomainMaxBytes <= 0 {
+		return
+	}
+	if files, err := rwt.fs.Get(f.ID, f.Domain); err == nil && len(files) == 1 {
+		grow -= int64(len(files[0].Data))
+	}
+	return
+}
+
+// writeQuotaError responds to a write refused by checkQuota, telling the
+// client when to retry or how much of the quota is left.
+func writeQuotaError(w http.ResponseWriter, qe *quotaError) {
+	setQuotaHeaders(w, qe)
+	http.Error(w, qe.reason, qe.status)
+}
+
+// setQuotaHeaders tells the client when to retry a write refused by
+// checkQuota, or how much of the quota is left.
+func setQuotaHeaders(w http.ResponseWriter, qe *quotaError) {
+	if qe.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(qe.retryAfter.Seconds())+1))
+	} else {
+		w.Header().Set("X-Quota-Remaining-"+qe.quota, strconv.FormatInt(qe.remaining, 10))
+	}
+}
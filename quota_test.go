@@ -0,0 +1,41 @@
+package rwtxt
+
+import (
+	"testing"
+	"time"
+
+	"argc.in/scratch/pkg/db"
+)
+
+func TestUsageCache(t *testing.T) {
+	c := newUsageCache()
+	counted := 0
+	count := func(domain string) (db.DomainUsage, error) {
+		counted++
+		return db.DomainUsage{Pages: 2, PageBytes: 100, UploadBytes: 50}, nil
+	}
+
+	u, err := c.get("Test", count)
+	if err != nil || u.pages != 2 || u.bytes != 150 {
+		t.Errorf("get = %+v, %v, want 2 pages of 150 bytes", u, err)
+	}
+	// the writes allowed since are added to it instead of counting again
+	c.add("test", true, 25)
+	c.add("test", false, -5)
+	if u, err = c.get("test", count); err != nil || u.pages != 3 || u.bytes != 170 || counted != 1 {
+		t.Errorf("get after writes = %+v, %v, counted %d times, want 3 pages of 170 bytes counted once", u, err, counted)
+	}
+
+	c.forget("test")
+	if u, _ = c.get("test", count); u.pages != 2 || counted != 2 {
+		t.Errorf("get after forget = %+v, counted %d times, want counted again", u, counted)
+	}
+
+	u = c.domains["test"]
+	u.counted = time.Now().Add(-usageTTL - time.Second)
+	c.domains["test"] = u
+	c.get("test", count)
+	if counted != 3 {
+		t.Errorf("counted %d times, want expired usage counted again", counted)
+	}
+}
@@ -0,0 +1,93 @@
+package rwtxt
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// rateLimiter allows each key a burst of events, refilled at a steady rate,
+// using one token bucket per key. Buckets are only held in memory.
+type rateLimiter struct {
+	sync.Mutex
+	every   time.Duration // time to refill one token
+	burst   int
+	buckets map[string]rateBucket
+	pruned  time.Time
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter allows perMinute events per minute for each key, all of them
+// at once if they come in a burst.
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{
+		every:   time.Minute / time.Duration(perMinute),
+		burst:   perMinute,
+		buckets: make(map[string]rateBucket),
+	}
+}
+
+// allow takes a token of the key, or returns how long to wait for one.
+func (l *rateLimiter) allow(key string) (ok bool, retryAfter time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	b, found := l.buckets[key]
+	if !found {
+		b = rateBucket{tokens: float64(l.burst), last: now}
+	}
+	b.tokens += float64(now.Sub(b.last)) / float64(l.every)
+	if b.tokens > float64(l.burst) {
+		b.tokens = float64(l.burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		l.buckets[key] = b
+		return false, time.Duration((1 - b.tokens) * float64(l.every))
+	}
+	b.tokens--
+	l.buckets[key] = b
+	l.prune(now)
+	return true, 0
+}
+
+// prune forgets the buckets which have refilled, they are the same as new ones.
+// It only goes through the buckets once per refill time.
+func (l *rateLimiter) prune(now time.Time) {
+	full := time.Duration(l.burst) * l.every
+	if now.Sub(l.pruned) < full {
+		return
+	}
+	l.pruned = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// allowUpload checks the upload rate limits of the client and of the domain.
+func (rwt *RWTxt) allowUpload(r *http.Request, domain string) (ok bool, retryAfter time.Duration) {
+	if rwt.ipUploads == nil {
+		return true, 0
+	}
+	ok, retryAfter = rwt.ipUploads.allow(clientIP(r))
+	if !ok {
+		return
+	}
+	return rwt.domainUploads.allow(domain)
+}
+
+// clientIP returns the IP address of the client of the request.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,106 @@
+package rwtxt
+
+import (
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// DefaultResizeFormat is the format of resized images unless set otherwise.
+const DefaultResizeFormat = "jpeg"
+
+// resizeFormats are the MIME types of the formats resized images can be
+// encoded to.
+var resizeFormats = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+}
+
+// ResizeFormatSupported reports whether resized images can be encoded to the
+// format.
+func ResizeFormatSupported(format string) bool {
+	_, ok := resizeFormats[format]
+	return ok
+}
+
+// resizeFormat returns the format of the resized image served for the request,
+// the configured one if the client accepts it, otherwise JPEG.
+func (rwt *RWTxt) resizeFormat(r *http.Request) string {
+	format := rwt.Config.ResizeFormat
+	if format == "" || format == DefaultResizeFormat {
+		return DefaultResizeFormat
+	}
+	accept := r.Header.Get("Accept")
+	if accept == "" || strings.Contains(accept, resizeFormats[format]) ||
+		strings.Contains(accept, "image/*") || strings.Contains(accept, "*/*") {
+		return format
+	}
+	return DefaultResizeFormat
+}
+
+// resizeWidth returns the width of the resized image served for the request.
+// Clients can ask for one of the ResizeWidths with the w parameter, other
+// widths are snapped to the closest one so only a few variants are cached.
+func (rwt *RWTxt) resizeWidth(r *http.Request) int {
+	width := rwt.Config.ResizeWidth
+	requested, err := strconv.Atoi(r.URL.Query().Get("w"))
+	if err != nil || requested <= 0 {
+		return width
+	}
+	for _, allowed := range rwt.Config.ResizeWidths {
+		if abs(allowed-requested) < abs(width-requested) {
+			width = allowed
+		}
+	}
+	return width
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// resizedID returns the id of the variant of an upload resized to the format
+// and width. JPEG variants of the configured width keep the id of the upload,
+// as they did before other formats and widths.
+func (rwt *RWTxt) resizedID(id, format string, width int) string {
+	if format != DefaultResizeFormat {
+		id += "." + format
+	}
+	if width != rwt.Config.ResizeWidth {
+		id += "." + strconv.Itoa(width)
+	}
+	return id
+}
+
+// resizeImage decodes an image and resizes it to the width, keeping its aspect
+// ratio. JPEGs are turned upright first as told by their EXIF orientation,
+// which is then lost, like the rest of their EXIF, when the result is encoded.
+func resizeImage(r io.Reader, width int) (image.Image, error) {
+	img, err := imaging.Decode(r, imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, err
+	}
+	return imaging.Resize(img, width, 0, imaging.Lanczos), nil
+}
+
+// encodeResized encodes a resized image to the format, JPEGs with the
+// configured quality.
+func (rwt *RWTxt) encodeResized(w io.Writer, img image.Image, format string) error {
+	if format == "png" {
+		return png.Encode(w, img)
+	}
+	quality := rwt.Config.ResizeQuality
+	if quality <= 0 {
+		quality = jpeg.DefaultQuality
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+}
@@ -0,0 +1,62 @@
+package rwtxt
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// rotatedJPEG returns a JPEG of 80x40 pixels, red on its left half and blue
+// on its right half, with an EXIF orientation of 6: to be shown upright it
+// is turned 90° clockwise, to 40x80 pixels with red on top.
+func rotatedJPEG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 80, 40))
+	for x := 0; x < 80; x++ {
+		for y := 0; y < 40; y++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= 40 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	exif := []byte{
+		0xff, 0xe1, 0, 34, // APP1 marker and length
+		'E', 'x', 'i', 'f', 0, 0,
+		'M', 'M', 0, 42, 0, 0, 0, 8, // big endian TIFF header, IFD at 8
+		0, 1, // one entry
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, 6, 0, 0, // orientation, SHORT, 6
+		0, 0, 0, 0, // no next IFD
+	}
+	data := buf.Bytes()
+	// the APP1 segment goes right after the SOI marker
+	return append(append(data[:2:2], exif...), data[2:]...)
+}
+
+func TestResizeImageOrientation(t *testing.T) {
+	img, err := resizeImage(bytes.NewReader(rotatedJPEG(t)), 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(20, 40) {
+		t.Fatalf("resized to %v, want 20x40", size)
+	}
+	isRed := func(c color.Color) bool {
+		r, _, b, _ := c.RGBA()
+		return r > 0xc000 && b < 0x4000
+	}
+	if top := img.At(10, 5); !isRed(top) {
+		t.Errorf("top is %v, want red", top)
+	}
+	if bottom := img.At(10, 35); isRed(bottom) {
+		t.Errorf("bottom is %v, want blue", bottom)
+	}
+}
@@ -0,0 +1,185 @@
+package rwtxt
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/schollz/logger"
+
+	"argc.in/scratch/pkg/db"
+)
+
+// allowIndexing returns whether search engines may index a domain with the
+// options, which is only ever the case for public domains.
+func (rwt *RWTxt) allowIndexing(isPublic bool, options db.DomainOptions) bool {
+	if !isPublic || rwt.Config.Private {
+		return false
+	}
+	if options.AllowIndexing != nil {
+		return *options.AllowIndexing
+	}
+	return rwt.Config.AllowIndexing
+}
+
+// requestOrigin returns the scheme and host the request was made to.
+func requestOrigin(r *http.Request) string {
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+// sitemapMaxURLs is the most pages listed by a sitemap, the limit of the
+// sitemap protocol. Domains with more pages have several.
+const sitemapMaxURLs = 50000
+
+// indexedDomains returns the domains that may be indexed.
+func (rwt *RWTxt) indexedDomains() (allowed []string, err error) {
+	domains, err := rwt.fs.GetDomains()
+	if err != nil {
+		return
+	}
+	for _, domain := range domains {
+		_, isPublic, options, _, errGet := rwt.fs.GetDomainFromName(domain)
+		if errGet != nil {
+			log.Error(errGet)
+			continue
+		}
+		if rwt.allowIndexing(isPublic, options) {
+			allowed = append(allowed, domain)
+		}
+	}
+	return
+}
+
+// handleRobots serves a robots.txt allowing the domains that may be indexed,
+// with the sitemap index, and disallowing everything else.
+func (rwt *RWTxt) handleRobots(w http.ResponseWriter, r *http.Request) (err error) {
+	allowed, err := rwt.indexedDomains()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("User-agent: *\n")
+	// the domain itself and its pages, but not domains starting like it
+	for _, domain := range allowed {
+		b.WriteString("Allow: /" + domain + "$\n")
+		b.WriteString("Allow: /" + domain + "/\n")
+	}
+	b.WriteString("Disallow: /\n")
+	if len(allowed) > 0 {
+		b.WriteString("\nSitemap: " + requestOrigin(r) + "/sitemap.xml\n")
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err = w.Write([]byte(b.String()))
+	return
+}
+
+// sitemapURL is a page in a sitemap.
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod"`
+}
+
+// sitemap is the sitemap of a domain.
+type sitemap struct {
+	XMLName xml.Name     `xml:"urlset"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+// sitemapRef is a sitemap in a sitemap index.
+type sitemapRef struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// sitemapIndex lists the sitemaps of all domains.
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"sitemapindex"`
+	XMLNS    string       `xml:"xmlns,attr"`
+	Sitemaps []sitemapRef `xml:"sitemap"`
+}
+
+// handleSitemapIndex serves the index of the sitemaps of the domains that may
+// be indexed, /domain/sitemap.xml and its next pages, ?p=2 and so on, for
+// domains with more than sitemapMaxURLs pages.
+func (rwt *RWTxt) handleSitemapIndex(w http.ResponseWriter, r *http.Request) (err error) {
+	allowed, err := rwt.indexedDomains()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	index := sitemapIndex{XMLNS: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+	for _, domain := range allowed {
+		count, errCount := rwt.fs.CountFiles(domain)
+		if errCount != nil {
+			log.Error(errCount)
+			continue
+		}
+		// the last change to the domain, a hint for all of its sitemaps
+		var lastMod string
+		if modified, errModified := rwt.fs.DomainLastModified(domain); errModified != nil {
+			log.Error(errModified)
+		} else if !modified.IsZero() {
+			lastMod = modified.UTC().Format(time.RFC3339)
+		}
+		loc := requestOrigin(r) + "/" + domain + "/sitemap.xml"
+		index.Sitemaps = append(index.Sitemaps, sitemapRef{Loc: loc, LastMod: lastMod})
+		for p := 2; (p-1)*sitemapMaxURLs < count; p++ {
+			index.Sitemaps = append(index.Sitemaps, sitemapRef{Loc: loc + "?p=" + strconv.Itoa(p), LastMod: lastMod})
+		}
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	_, err = w.Write([]byte(xml.Header))
+	if err != nil {
+		return
+	}
+	return xml.NewEncoder(w).Encode(index)
+}
+
+// handleSitemap serves the sitemap of the published pages of a domain that may
+// be indexed, sitemapMaxURLs at a time, the oldest first so pages keep their
+// place, the page of the sitemap being given by ?p=.
+func (tr *TemplateRender) handleSitemap(w http.ResponseWriter, r *http.Request) (err error) {
+	_, isPublic, options, _, err := tr.rwt.fs.GetDomainFromName(tr.Domain)
+	if err != nil || !tr.rwt.allowIndexing(isPublic, options) {
+		http.NotFound(w, r)
+		return nil
+	}
+	p, _ := strconv.Atoi(r.URL.Query().Get("p"))
+	if p < 1 {
+		p = 1
+	}
+	files, err := tr.rwt.fs.GetSitemapPage(tr.Domain, (p-1)*sitemapMaxURLs, sitemapMaxURLs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if p > 1 && len(files) == 0 {
+		http.NotFound(w, r)
+		return nil
+	}
+	s := sitemap{XMLNS: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+	for _, f := range files {
+		page := f.Slug
+		if page == "" {
+			page = f.ID
+		}
+		s.URLs = append(s.URLs, sitemapURL{
+			Loc:     requestOrigin(r) + "/" + tr.Domain + "/" + page,
+			LastMod: f.Modified.UTC().Format(time.RFC3339),
+		})
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	_, err = w.Write([]byte(xml.Header))
+	if err != nil {
+		return
+	}
+	return xml.NewEncoder(w).Encode(s)
+}
@@ -1,12 +1,20 @@
 package rwtxt
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"html/template"
+	"io/fs"
+	"net"
 	"net/http"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -14,32 +22,232 @@ import (
 
 	"argc.in/scratch/pkg/db"
 	"argc.in/scratch/pkg/markdown"
-	"argc.in/scratch/pkg/utils"
 )
 
 type RWTxt struct {
 	Config     Config
 	templates  *template.Template
 	fs         *db.FileSystem
-	markdown   *markdown.Parser
+	markdown   *markdown.Parsers
 	wsupgrader websocket.Upgrader
+	locks      *editLocks
+
+	// domainUploads and ipUploads limit the rate of uploads per domain and per
+	// client IP, nil without a limit.
+	domainUploads *rateLimiter
+	ipUploads     *rateLimiter
+
+	// resizes limits the rate of images resized on request per client IP,
+	// nil without a limit.
+	resizes *rateLimiter
+
+	// domainWrites limits the rate of saves, uploads and page creations per
+	// domain, nil without a limit.
+	domainWrites *rateLimiter
+
+	// usage caches the storage taken by the domains for checkQuota.
+	usage *usageCache
+
+	// renders holds a token for each markdown render in progress, nil without
+	// a limit, and queuedRenders counts the renders waiting for one.
+	renders       chan struct{}
+	queuedRenders int32
+
+	// favicon is served at /favicon.ico, which is a 404 if it is empty.
+	favicon        []byte
+	faviconModTime time.Time
+
+	// server serves Config.Bind, adminServer Config.AdminBind and
+	// redirectServer Config.RedirectBind, which are nil if unset.
+	server         *http.Server
+	adminServer    *http.Server
+	redirectServer *http.Server
+
+	// websockets are the connections of the editors, which Shutdown closes
+	// so their edits are saved.
+	websockets *websockets
 }
 
 type Config struct {
-	Bind            string // interface:port to listen on, defaults to DefaultBind.
-	Private         bool
-	ResizeWidth     int
-	ResizeOnUpload  bool
-	ResizeOnRequest bool
-	OrderByCreated  bool
+	Version          string // version of rwtxt served at /version, the module version if empty.
+	Bind             string // interface:port to listen on, defaults to DefaultBind.
+	AdminBind        string // interface:port serving the health check and admin API instead of Bind, if set.
+	TLSCert          string // certificate file of HTTPS served on Bind, with TLSKey, HTTP is served if empty.
+	TLSKey           string // private key file of TLSCert.
+	RedirectBind     string // interface:port redirecting HTTP to HTTPS when serving TLS, like :80, none if empty.
+	CookieSecure     bool   // mark cookies Secure without TLS, as behind a proxy terminating it.
+	Private          bool
+	ResizeWidth      int
+	ResizeWidths     []int // other widths clients can ask images to be resized to on request.
+	ResizesPerMinute int   // images resized on request per minute for each client IP, zero means no limit.
+	ResizeOnUpload   bool
+	ResizeOnRequest  bool
+	ResizeQuality    int    // JPEG quality of resized images, jpeg.DefaultQuality if zero.
+	ResizeFormat     string // preferred format of images resized on request, DefaultResizeFormat if empty.
+	OrderByCreated   bool
+	CanonicalByID    bool              // use the page id instead of its slug as the canonical URL.
+	RenderTimeout    time.Duration     // maximum time to render markdown, zero means no limit.
+	MaxPageBytes     int               // maximum size of a page, zero means no limit.
+	MaxUploadBytes   int64             // maximum size of an upload, zero means DefaultMaxUploadBytes.
+	DefaultDomain    string            // domain anyone can read and write, shown to visitors that are not signed in, the public domain of the database if empty.
+	AutosaveInterval time.Duration     // minimum time between saves of a page being edited.
+	CSP              string            // Content-Security-Policy of pages, {nonce} is replaced by the nonce of inline scripts, none if empty.
+	SecurityHeaders  bool              // send DefaultSecurityHeaders with every response.
+	HeaderOverrides  map[string]string // replace the value of security headers, an empty value drops the header.
+	AdminKey         string            // key of the admin API listing all domains, disabled if empty.
+	MaxDomains       int               // most domains the instance has, zero means no limit.
+	SummaryLength    int               // length of the summaries of pages, db.DefaultSummaryLength if zero.
+	IDLength         int               // length of the ids of new pages, 10 if zero.
+	IDAlphabet       string            // characters of the ids of new pages, [a-z0-9] if empty.
+	UploadsPerMinute int               // uploads allowed per minute for each domain and each client IP, zero means no limit.
+	SlowQueryMS      int               // log database queries taking longer than this many milliseconds, zero means none.
+	Favicon          string            // file served at /favicon.ico, the favicon of rwtxt if empty.
+	ReadTimeout      time.Duration     // maximum time to read a request, uploads included, zero means no limit.
+	WriteTimeout     time.Duration     // maximum time to write a response, zero means no limit. Not applied to websockets.
+	IdleTimeout      time.Duration     // time idle keep-alive connections are kept open, ReadTimeout if zero.
+
+	// RequireAdminKeyForDomainCreate only lets those giving the AdminKey
+	// create domains. Nobody can if the AdminKey is empty.
+	RequireAdminKeyForDomainCreate bool
+
+	// CreateChallenge, if set, is called with the sign in request before a
+	// new domain is created, which is refused with the message of the error
+	// it returns. It lets deployments verify a CAPTCHA, whose widget they add
+	// to the sign in form with CreateChallengeHTML.
+	CreateChallenge     func(r *http.Request) error
+	CreateChallengeHTML template.HTML
+
+	// AllowedUploadTypes are the MIME types, like image/*, of files that can
+	// be uploaded, unless domains set their own. Any type if empty.
+	AllowedUploadTypes []string
+
+	// MaxConcurrentRenders is the number of markdown renders running at once,
+	// others queue briefly or get a 503. Zero means no limit.
+	MaxConcurrentRenders int
+
+	// DomainWritesPerMinute, DomainMaxPages and DomainMaxBytes limit the
+	// saves, uploads and page creations per minute, the pages and the storage
+	// of each domain. Zero means no limit.
+	DomainWritesPerMinute int
+	DomainMaxPages        int
+	DomainMaxBytes        int64
+
+	// HighlightStyle is the chroma style of code blocks, unless domains set
+	// their own. markdown.DefaultHighlightStyle if empty.
+	HighlightStyle string
+
+	// DefaultPageSize and MaxPageSize are the number of results of paginated
+	// responses when clients don't ask for one, and the most they can ask
+	// for. DefaultPageSize and MaxPageSize if zero.
+	DefaultPageSize int
+	MaxPageSize     int
+
+	// AllowIndexing lets search engines index the public domains that don't
+	// set DomainOptions.AllowIndexing, in robots.txt. Never in private setups.
+	AllowIndexing bool
+
+	// Sessions keeps the domain keys of signed in browsers on the server,
+	// their cookie then only holds a session id. The keys are kept in the
+	// cookie if nil.
+	Sessions SessionStore
+
+	// DefaultDomainOptions are the options of new domains, db.DefaultDomainOptions() if nil.
+	DefaultDomainOptions *db.DomainOptions
+
+	// Templates holds *.html templates replacing the embedded ones of the
+	// same name, like main.html or error.html, to rebrand the site without
+	// forking it. Embedded templates that aren't replaced are kept.
+	Templates fs.FS
+}
+
+// DefaultBind is the interface:port listened on when Config.Bind is empty.
+const DefaultBind = ":8152"
+
+// DefaultPageSize and MaxPageSize are the page sizes of paginated responses
+// unless set otherwise.
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 500
+)
+
+// DefaultCSP only allows scripts served by rwtxt itself and inline scripts
+// carrying the nonce of the response. Styles may be inline because of the
+// custom CSS of domains and the style attributes of the templates, highlighted
+// code blocks only use classes.
+const DefaultCSP = "default-src 'self'; " +
+	"script-src 'self' 'nonce-{nonce}'; " +
+	"style-src 'self' 'unsafe-inline' https://cdnjs.cloudflare.com; " +
+	"img-src 'self' data: https:; " +
+	"connect-src 'self'; " +
+	"object-src 'none'; " +
+	"base-uri 'self'; " +
+	"form-action 'self'"
+
+// DefaultSecurityHeaders are sent when Config.SecurityHeaders is set.
+// Strict-Transport-Security is only sent over TLS.
+var DefaultSecurityHeaders = map[string]string{
+	"Strict-Transport-Security": "max-age=31536000",
+	"X-Content-Type-Options":    "nosniff",
+	"Referrer-Policy":           "strict-origin-when-cross-origin",
+	"X-Frame-Options":           "SAMEORIGIN",
 }
 
+// DefaultMaxPageBytes is a generous page size limit that normal notes never reach.
+const DefaultMaxPageBytes = 4 << 20
+
+// DefaultMaxUploadBytes is the upload size limit when none is configured.
+const DefaultMaxUploadBytes = 32 << 20
+
 func New(fs *db.FileSystem, config Config) *RWTxt {
 	funcMap := template.FuncMap{
-		"replace": replace,
+		"replace":   replace,
+		"csrfField": csrfField,
 	}
 
-	return &RWTxt{
+	if config.Bind == "" {
+		config.Bind = DefaultBind
+	}
+	if config.DefaultDomain == "" {
+		// none if the database has no public domain either
+		config.DefaultDomain = fs.PublicDomain()
+	}
+	fs.MaxPageBytes = config.MaxPageBytes
+	if config.MaxUploadBytes <= 0 {
+		config.MaxUploadBytes = DefaultMaxUploadBytes
+	}
+	fs.MaxBlobBytes = config.MaxUploadBytes
+	fs.MaxDomains = config.MaxDomains
+	fs.IDLength = config.IDLength
+	fs.IDAlphabet = config.IDAlphabet
+	fs.SlowQuery = time.Duration(config.SlowQueryMS) * time.Millisecond
+	if config.ResizeFormat != "" && !ResizeFormatSupported(config.ResizeFormat) {
+		log.Warnf("cannot resize images to %s, using %s", config.ResizeFormat, DefaultResizeFormat)
+		config.ResizeFormat = DefaultResizeFormat
+	}
+	if config.SummaryLength > 0 {
+		fs.SummaryLength = config.SummaryLength
+	}
+	if config.DefaultDomainOptions != nil {
+		fs.NewDomainOptions = *config.DefaultDomainOptions
+	}
+	if config.HighlightStyle != "" && !markdown.HighlightStyleExists(config.HighlightStyle) {
+		log.Warnf("no highlight style %s, using %s", config.HighlightStyle, markdown.DefaultHighlightStyle)
+		config.HighlightStyle = ""
+	}
+	if config.HighlightStyle == "" {
+		config.HighlightStyle = markdown.DefaultHighlightStyle
+	}
+	if config.MaxPageSize <= 0 {
+		config.MaxPageSize = MaxPageSize
+	}
+	if config.DefaultPageSize <= 0 {
+		config.DefaultPageSize = DefaultPageSize
+	}
+	if config.DefaultPageSize > config.MaxPageSize {
+		config.DefaultPageSize = config.MaxPageSize
+	}
+
+	rwt := &RWTxt{
 		Config: config,
 		fs:     fs,
 		wsupgrader: websocket.Upgrader{
@@ -49,15 +257,121 @@ func New(fs *db.FileSystem, config Config) *RWTxt {
 				return true
 			},
 		},
-		markdown:  markdown.NewParser(),
-		templates: template.Must(template.New("scratch").Funcs(funcMap).ParseFS(_templates, "templates/*.html")),
+		locks:      newEditLocks(),
+		websockets: newWebsockets(),
+		usage:      newUsageCache(),
+		markdown:   markdown.NewParsers(),
+	}
+	rwt.loadTemplates(funcMap)
+	if config.UploadsPerMinute > 0 {
+		rwt.domainUploads = newRateLimiter(config.UploadsPerMinute)
+		rwt.ipUploads = newRateLimiter(config.UploadsPerMinute)
+	}
+	if config.ResizesPerMinute > 0 {
+		rwt.resizes = newRateLimiter(config.ResizesPerMinute)
+	}
+	if config.DomainWritesPerMinute > 0 {
+		rwt.domainWrites = newRateLimiter(config.DomainWritesPerMinute)
+	}
+	if config.MaxConcurrentRenders > 0 {
+		rwt.renders = make(chan struct{}, config.MaxConcurrentRenders)
+	}
+	rwt.loadFavicon()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", rwt.Handler)
+	rwt.server = rwt.newServer(config.Bind, mux)
+	if config.AdminBind != "" {
+		rwt.adminServer = rwt.newServer(config.AdminBind, http.HandlerFunc(rwt.AdminHandler))
+	}
+	if config.RedirectBind != "" {
+		rwt.redirectServer = rwt.newServer(config.RedirectBind, http.HandlerFunc(rwt.redirectToHTTPS))
 	}
+	return rwt
 }
 
+// newServer returns a server of the handler on addr with the timeouts of the
+// Config.
+func (rwt *RWTxt) newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  rwt.Config.ReadTimeout,
+		WriteTimeout: rwt.Config.WriteTimeout,
+		IdleTimeout:  rwt.Config.IdleTimeout,
+	}
+}
+
+// Serve serves rwtxt on Config.Bind, over HTTPS if Config.TLSCert and
+// Config.TLSKey are set, until Shutdown is called.
 func (rwt *RWTxt) Serve() (err error) {
-	log.Infof("listening on %v", rwt.Config.Bind)
-	http.HandleFunc("/", rwt.Handler)
-	return http.ListenAndServe(rwt.Config.Bind, nil)
+	info := rwt.buildInfo()
+	log.Infof("rwtxt %s (%s, revision %s)", info.Version, info.GoVersion, info.Revision)
+	tls := rwt.Config.TLSCert != "" && rwt.Config.TLSKey != ""
+	errs := make(chan error, 3)
+	if rwt.adminServer != nil {
+		go func() {
+			errs <- rwt.serveAdmin()
+		}()
+	}
+	if tls && rwt.redirectServer != nil {
+		go func() {
+			log.Infof("redirecting to https on %v", rwt.Config.RedirectBind)
+			errs <- rwt.redirectServer.ListenAndServe()
+		}()
+	}
+	go func() {
+		if tls {
+			log.Infof("listening with tls on %v", rwt.Config.Bind)
+			errs <- rwt.server.ListenAndServeTLS(rwt.Config.TLSCert, rwt.Config.TLSKey)
+			return
+		}
+		log.Infof("listening on %v", rwt.Config.Bind)
+		errs <- rwt.server.ListenAndServe()
+	}()
+	err = <-errs
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	return
+}
+
+// Shutdown stops the servers from accepting connections and waits for the
+// requests in progress to finish, then closes the websockets of editors and
+// waits for their last edits to be saved, or for ctx to be done.
+func (rwt *RWTxt) Shutdown(ctx context.Context) (err error) {
+	for _, server := range []*http.Server{rwt.redirectServer, rwt.adminServer} {
+		if server != nil {
+			if errShutdown := server.Shutdown(ctx); errShutdown != nil {
+				log.Error(errShutdown)
+			}
+		}
+	}
+	// the websockets are closed even if the server didn't shut down in time
+	err = rwt.server.Shutdown(ctx)
+	if errClose := rwt.websockets.closeAll(ctx); err == nil {
+		err = errClose
+	}
+	return
+}
+
+// ServeTLS serves rwtxt over HTTPS with the certificate and private key files.
+func (rwt *RWTxt) ServeTLS(certFile, keyFile string) error {
+	rwt.Config.TLSCert, rwt.Config.TLSKey = certFile, keyFile
+	return rwt.Serve()
+}
+
+// redirectToHTTPS permanently redirects to the same URL over HTTPS, on the port
+// of Config.Bind.
+func (rwt *RWTxt) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+	if _, port, err := net.SplitHostPort(rwt.Config.Bind); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
 }
 
 func (rwt *RWTxt) isSignedIn(w http.ResponseWriter, r *http.Request, domain string) (signedin bool, domainkey string, defaultDomain string, domainList []string, domainKeys map[string]string) {
@@ -79,9 +393,10 @@ func (rwt *RWTxt) isSignedIn(w http.ResponseWriter, r *http.Request, domain stri
 func (rwt *RWTxt) getDomainListCookie(w http.ResponseWriter, r *http.Request) (domainKeys map[string]string, defaultDomain string) {
 	startTime := time.Now().UTC()
 	domainKeys = make(map[string]string)
-	cookie, cookieErr := r.Cookie("rwtxt-domains")
 	keysToUpdate := []string{}
-	if cookieErr == nil {
+	if rwt.Config.Sessions != nil {
+		domainKeys, defaultDomain, keysToUpdate = rwt.getSessionDomains(r)
+	} else if cookie, cookieErr := r.Cookie("rwtxt-domains"); cookieErr == nil {
 		log.Debugf("got cookie: %s", cookie.Value)
 		for _, key := range strings.Split(cookie.Value, ",") {
 			startTime2 := time.Now().UTC()
@@ -96,9 +411,11 @@ func (rwt *RWTxt) getDomainListCookie(w http.ResponseWriter, r *http.Request) (d
 			}
 		}
 	}
-	domainKeys["public"] = ""
+	if rwt.Config.DefaultDomain != "" {
+		domainKeys[rwt.Config.DefaultDomain] = ""
+	}
 	if defaultDomain == "" {
-		defaultDomain = "public"
+		defaultDomain = rwt.Config.DefaultDomain
 	}
 	log.Debugf("logged in domains: %+v [%s]", domainKeys, time.Since(startTime))
 	go func() {
@@ -111,34 +428,52 @@ func (rwt *RWTxt) getDomainListCookie(w http.ResponseWriter, r *http.Request) (d
 
 func (rwt *RWTxt) Handler(w http.ResponseWriter, r *http.Request) {
 	t := time.Now().UTC()
-	err := rwt.Handle(w, r)
+	rw := &responseWriter{ResponseWriter: w}
+	err := rwt.Handle(rw, r)
 	if err != nil {
 		log.Error(err)
+		if !rw.started {
+			rwt.handleError(rw, r)
+		}
 	}
 	log.Infof("%v %v %v %s", r.RemoteAddr, r.Method, r.URL.Path, time.Since(t))
 }
 
 func (rwt *RWTxt) Handle(w http.ResponseWriter, r *http.Request) (err error) {
+	rwt.setSecurityHeaders(w, r)
 
 	// very special paths
 	if r.URL.Path == "/robots.txt" {
 		// special path
-		w.Write([]byte(`User-agent: * 
-Disallow: /`))
-		return
+		return rwt.handleRobots(w, r)
 	} else if r.URL.Path == "/favicon.ico" {
-		// TODO
+		// special path
+		return rwt.handleFavicon(w, r)
 	} else if r.URL.Path == "/sitemap.xml" {
-		// TODO
+		// special path
+		return rwt.handleSitemapIndex(w, r)
+	} else if isAdminPath(r.URL.Path) {
+		// admin paths are on their own listener if it is configured
+		if rwt.Config.AdminBind != "" {
+			http.NotFound(w, r)
+			return
+		}
+		return rwt.handleAdmin(w, r)
+	} else if r.URL.Path == "/version" {
+		// special path /version
+		return rwt.handleVersion(w, r)
 	} else if strings.HasPrefix(r.URL.Path, "/static") {
 		// special path /static
 		return rwt.handleStatic(w, r)
+	} else if strings.HasPrefix(r.URL.Path, "/api/") {
+		// special path /api
+		return rwt.handleAPI(w, r)
 	}
 
 	fields := strings.Split(r.URL.Path, "/")
 
 	tr := NewTemplateRender(rwt)
-	tr.Domain = "public"
+	tr.Domain = rwt.Config.DefaultDomain
 	if len(fields) > 2 {
 		tr.Page = strings.TrimSpace(strings.ToLower(fields[2]))
 	}
@@ -146,6 +481,10 @@ Disallow: /`))
 		tr.Domain = strings.TrimSpace(strings.ToLower(fields[1]))
 	}
 
+	tr.Nonce = newNonce()
+	rwt.setCSP(w, tr.Nonce)
+	tr.CSRFToken = rwt.csrfToken(w, r)
+
 	tr.SignedIn, tr.DomainKey, tr.DefaultDomain, tr.DomainList, tr.DomainKeys = rwt.isSignedIn(w, r, tr.Domain)
 
 	// get browser local time
@@ -153,6 +492,10 @@ Disallow: /`))
 
 	if r.URL.Path == "/" {
 		// special path /
+		if tr.DefaultDomain == "" {
+			// nowhere to go, show the login
+			return tr.handleMain(w, r)
+		}
 		http.Redirect(w, r, "/"+tr.DefaultDomain, 302)
 	} else if r.URL.Path == "/login" {
 		// special path /login
@@ -163,6 +506,15 @@ Disallow: /`))
 	} else if r.URL.Path == "/update" {
 		// special path /login
 		return tr.handleLoginUpdate(w, r)
+	} else if r.URL.Path == "/publish" {
+		// special path /publish
+		return tr.handlePublish(w, r)
+	} else if r.URL.Path == "/rename" {
+		// special path /rename
+		return tr.handleRename(w, r)
+	} else if r.URL.Path == "/revert" {
+		// special path /revert
+		return tr.handleRevert(w, r)
 	} else if r.URL.Path == "/logout" {
 		// special path /logout
 		return tr.handleLogout(w, r)
@@ -170,16 +522,33 @@ Disallow: /`))
 		// special path /upload
 		return tr.handleUpload(w, r)
 	} else if tr.Page == "new" {
-		// special path /upload
-		http.Redirect(w, r, "/"+tr.DefaultDomain+"/"+rwt.createPage(tr.DefaultDomain).ID, 302)
+		// special path /new
+		if !rwt.anonymousWriteAllowed(tr.DefaultDomain, true) {
+			tr.httpError(w, r, "anonymous page creation is disabled", http.StatusForbidden)
+			return
+		}
+		f, createErr := rwt.createPage(tr.DefaultDomain)
+		var qe *quotaError
+		if errors.As(createErr, &qe) {
+			writeQuotaError(w, qe)
+			return
+		} else if createErr != nil {
+			http.Error(w, "could not create a page", http.StatusInternalServerError)
+			return createErr
+		}
+		if f.Data != "" {
+			http.Redirect(w, r, "/"+tr.DefaultDomain+"/"+f.ID+"?edit=1", 302)
+			return
+		}
+		http.Redirect(w, r, "/"+tr.DefaultDomain+"/"+f.ID, 302)
 		return
 	} else if strings.HasPrefix(r.URL.Path, "/uploads") {
 		// special path /uploads
 		return tr.handleUploads(w, r, tr.Page)
 	} else if tr.Domain != "" && tr.Page == "" {
 		if r.URL.Query().Get("q") != "" {
-			if tr.Domain == "public" && !rwt.Config.Private {
-				err = fmt.Errorf("cannot search public")
+			if rwt.isDefaultDomain(tr.Domain) && !rwt.Config.Private {
+				err = fmt.Errorf("cannot search %s", tr.Domain)
 				http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte(err.Error())), 302)
 				return
 			}
@@ -190,42 +559,354 @@ Disallow: /`))
 	} else if tr.Domain != "" && tr.Page != "" {
 		log.Debugf("[%s/%s]", tr.Domain, tr.Page)
 		if tr.Page == "list" {
-			if tr.Domain == "public" && !rwt.Config.Private {
-				err = fmt.Errorf("cannot list public")
+			if rwt.isDefaultDomain(tr.Domain) && !rwt.Config.Private {
+				err = fmt.Errorf("cannot list %s", tr.Domain)
 				http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte(err.Error())), 302)
 				return
 			}
 
-			files, _ := rwt.fs.GetAll(tr.Domain, tr.RWTxtConfig.OrderByCreated)
+			drafts := r.URL.Query().Get("drafts") != ""
+			var files []db.File
+			if drafts {
+				files, _ = rwt.fs.GetAllFiltered(tr.Domain, drafts, tr.RWTxtConfig.OrderByCreated)
+			} else {
+				// a page at a time, for domains with many pages
+				tr.NumResults, err = rwt.fs.CountFiles(tr.Domain)
+				if err != nil {
+					return
+				}
+				tr.PageCount = (tr.NumResults + rwt.Config.DefaultPageSize - 1) / rwt.Config.DefaultPageSize
+				tr.PageNum, _ = strconv.Atoi(r.URL.Query().Get("p"))
+				if tr.PageNum < 1 {
+					tr.PageNum = 1
+				}
+				files, _ = rwt.fs.GetPage(tr.Domain, (tr.PageNum-1)*rwt.Config.DefaultPageSize, rwt.Config.DefaultPageSize, tr.RWTxtConfig.OrderByCreated)
+			}
 			for i := range files {
 				files[i].Data = ""
 				files[i].DataHTML = template.HTML("")
 			}
 			return tr.handleList(w, r, "All", files)
+		} else if tr.Page == "sitemap.xml" {
+			return tr.handleSitemap(w, r)
+		} else if tr.Page == "favicon.ico" {
+			return tr.handleBranding(w, r, false)
+		} else if tr.Page == "logo.png" {
+			return tr.handleBranding(w, r, true)
 		} else if tr.Page == "export" {
 			return tr.handleExport(w, r)
+		} else if tr.Page == "recent" {
+			return tr.handleRecent(w, r)
+		} else if tr.Page == "activity" {
+			if rwt.isDefaultDomain(tr.Domain) && !rwt.Config.Private {
+				err = fmt.Errorf("cannot list %s", tr.Domain)
+				http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte(err.Error())), 302)
+				return
+			}
+			return tr.handleActivity(w, r)
+		} else if tr.Page == "tags" {
+			if rwt.isDefaultDomain(tr.Domain) && !rwt.Config.Private {
+				err = fmt.Errorf("cannot list %s", tr.Domain)
+				http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte(err.Error())), 302)
+				return
+			}
+			return tr.handleTags(w, r)
+		} else if r.URL.Query().Has("toggle") {
+			return tr.handleToggleTask(w, r)
 		}
 		return tr.handleViewEdit(w, r)
 	}
 	return
 }
 
+// newNonce returns an unguessable value for the nonce of inline scripts.
+func newNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Error(err)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// setCSP sets the Content-Security-Policy of the response, allowing the inline
+// scripts carrying nonce.
+func (rwt *RWTxt) setCSP(w http.ResponseWriter, nonce string) {
+	if rwt.Config.CSP == "" {
+		return
+	}
+	w.Header().Set("Content-Security-Policy", strings.ReplaceAll(rwt.Config.CSP, "{nonce}", nonce))
+}
+
+// setSecurityHeaders sets the security headers of the response, if enabled.
+func (rwt *RWTxt) setSecurityHeaders(w http.ResponseWriter, r *http.Request) {
+	if !rwt.Config.SecurityHeaders {
+		return
+	}
+	for name, value := range DefaultSecurityHeaders {
+		if override, ok := rwt.Config.HeaderOverrides[name]; ok {
+			value = override
+		}
+		if value == "" {
+			continue
+		}
+		if name == "Strict-Transport-Security" && r.TLS == nil {
+			continue
+		}
+		w.Header().Set(name, value)
+	}
+}
+
+// uploadTypeAllowed reports whether files of the sniffed contentType can be
+// uploaded to the domain with options.
+func (rwt *RWTxt) uploadTypeAllowed(contentType string, options db.DomainOptions) bool {
+	patterns := rwt.Config.AllowedUploadTypes
+	if options.AllowedUploadTypes != "" {
+		patterns = strings.Fields(options.AllowedUploadTypes)
+	}
+	if len(patterns) == 0 {
+		return true
+	}
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.TrimSpace(mediaType)
+	for _, pattern := range patterns {
+		if pattern == "*/*" || pattern == mediaType ||
+			(strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// secureCookie reports whether the cookies of the response to r should only be
+// sent back over HTTPS.
+func (rwt *RWTxt) secureCookie(r *http.Request) bool {
+	return rwt.Config.CookieSecure || r.TLS != nil
+}
+
+// isDefaultDomain reports whether domain is the default domain, which anyone
+// can read and write.
+func (rwt *RWTxt) isDefaultDomain(domain string) bool {
+	return rwt.Config.DefaultDomain != "" && domain == rwt.Config.DefaultDomain
+}
+
+// anonymousWriteAllowed reports whether visitors that are not signed in may
+// create (or edit, if create is false) pages in the domain. Only the default
+// domain accepts anonymous writes, so other domains always allow them here and
+// rely on their keys instead.
+func (rwt *RWTxt) anonymousWriteAllowed(domain string, create bool) bool {
+	if !rwt.isDefaultDomain(domain) {
+		return true
+	}
+	_, _, options, _, err := rwt.fs.GetDomainFromName(domain)
+	if err != nil {
+		return false
+	}
+	if create {
+		return options.AllowAnonymousCreate
+	}
+	return options.AllowAnonymousEdit
+}
+
 func (rwt *RWTxt) handleStatic(w http.ResponseWriter, r *http.Request) (err error) {
+	if strings.HasPrefix(r.URL.Path, "/static/css/chroma/") {
+		style := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/static/css/chroma/"), ".css")
+		return rwt.handleHighlightCSS(w, r, style)
+	}
 	http.FileServer(http.FS(_static)).ServeHTTP(w, r)
 	return nil
 }
 
+// handleHighlightCSS serves the stylesheet of code blocks in a chroma style,
+// the same for every page using the style so browsers can cache it.
+func (rwt *RWTxt) handleHighlightCSS(w http.ResponseWriter, r *http.Request, style string) (err error) {
+	if !markdown.HighlightStyleExists(style) {
+		http.NotFound(w, r)
+		return
+	}
+	css, err := markdown.HighlightCSS(style)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	_, err = w.Write(css)
+	return
+}
+
 // createPage throws error if domain does not exist
-func (rwt *RWTxt) createPage(domain string) (f db.File) {
+func (rwt *RWTxt) createPage(domain string) (f db.File, err error) {
+	err = rwt.checkQuota(domain, true, 0)
+	if err != nil {
+		return
+	}
+	id, err := rwt.fs.NewID()
+	if err != nil {
+		return
+	}
 	f = db.File{
-		ID:       utils.UUID(),
+		ID:       id,
 		Created:  time.Now().UTC(),
 		Domain:   domain,
 		Modified: time.Now().UTC(),
 	}
-	err := rwt.fs.Save(f)
+	_, _, options, _, _ := rwt.fs.GetDomainFromName(domain)
+	f.Data = newPageData(options, f)
+	err = rwt.fs.Save(f)
 	if err != nil {
 		log.Debug(err)
 	}
 	return
 }
+
+// newPageData returns the initial text of a new page, from the template of its
+// domain.
+func newPageData(options db.DomainOptions, f db.File) string {
+	if options.NewPageTemplate == "" {
+		return ""
+	}
+	return strings.NewReplacer(
+		"{{date}}", f.Created.Format("2006-01-02"),
+		"{{slug}}", f.Slug,
+		"{{id}}", f.ID,
+	).Replace(options.NewPageTemplate)
+}
+
+// includedPage returns the function giving the contents of pages of the domain
+// included in other pages. Pages in the trash, and unpublished pages unless
+// signedIn, can't be included.
+func (rwt *RWTxt) includedPage(ctx context.Context, domain string, signedIn bool) func(page string) (string, bool) {
+	return func(page string) (string, bool) {
+		id, many, err := rwt.fs.Exists(page, domain)
+		if err != nil || id == "" || many {
+			return "", false
+		}
+		files, err := rwt.fs.GetContext(ctx, id, domain)
+		if err != nil || len(files) != 1 {
+			return "", false
+		}
+		f := files[0]
+		if !f.Deleted.IsZero() || (!f.IsPublished() && !signedIn) {
+			return "", false
+		}
+		return f.Data, true
+	}
+}
+
+// variableName matches the names of variables of a domain.
+var variableName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// parseVariables parses "name = value" lines into variables, skipping lines
+// without a valid name.
+func parseVariables(text string) (vars map[string]string) {
+	vars = make(map[string]string)
+	for _, line := range strings.Split(text, "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		name := strings.TrimSpace(parts[0])
+		if !variableName.MatchString(name) {
+			continue
+		}
+		vars[name] = strings.TrimSpace(parts[1])
+	}
+	return
+}
+
+// pageVariables returns the variables expanded in the page f of the domain, the
+// built in {{date}}, {{views}} and {{backlinks}} and those of its options.
+func (rwt *RWTxt) pageVariables(domain string, options db.DomainOptions, f db.File) (vars map[string]func() string) {
+	vars = make(map[string]func() string)
+	for name, value := range options.Variables {
+		value := value
+		vars[name] = func() string { return value }
+	}
+	vars["date"] = func() string { return time.Now().UTC().Format("2006-01-02") }
+	vars["views"] = func() string { return strconv.Itoa(f.Views) }
+	vars["backlinks"] = func() string {
+		files, err := rwt.fs.GetBacklinks(domain, f.Slug)
+		if err != nil {
+			log.Error(err)
+			return ""
+		}
+		lines := make([]string, len(files))
+		for i, backlink := range files {
+			title := backlink.Title
+			if title == "" {
+				title = backlink.Slug
+			}
+			lines[i] = "- [" + title + "](/" + domain + "/" + backlink.Slug + ")"
+		}
+		return strings.Join(lines, "\n")
+	}
+	return
+}
+
+// activityLength is the number of entries shown in the activity of a domain.
+const activityLength = 100
+
+// renderTimeoutHTML is shown in place of content that took too long to render.
+const renderTimeoutHTML = template.HTML("<p><em>render took too long</em></p>")
+
+// renderQueueWait is how long a render waits for one of the
+// Config.MaxConcurrentRenders to finish before giving up.
+const renderQueueWait = 2 * time.Second
+
+// errRenderBusy is returned by render when too many renders are running.
+var errRenderBusy = errors.New("too many renders in progress")
+
+// acquireRender waits for a render slot, and returns the function releasing it.
+// Once as many renders are queued as can run, more are turned away at once.
+func (rwt *RWTxt) acquireRender(ctx context.Context) (release func(), err error) {
+	if rwt.renders == nil {
+		return func() {}, nil
+	}
+	if atomic.AddInt32(&rwt.queuedRenders, 1) > int32(cap(rwt.renders)) {
+		atomic.AddInt32(&rwt.queuedRenders, -1)
+		return nil, errRenderBusy
+	}
+	defer atomic.AddInt32(&rwt.queuedRenders, -1)
+
+	timer := time.NewTimer(renderQueueWait)
+	defer timer.Stop()
+	select {
+	case rwt.renders <- struct{}{}:
+		return func() { <-rwt.renders }, nil
+	case <-timer.C:
+		return nil, errRenderBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// renderBusy tells the client to come back once renders have caught up.
+func renderBusy(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(renderQueueWait.Seconds())))
+	http.Error(w, "server busy, try again later", http.StatusServiceUnavailable)
+}
+
+// render converts markdown to HTML, aborting when the request is cancelled or
+// Config.RenderTimeout is exceeded. On timeout a placeholder is returned along
+// with markdown.ErrRenderTimeout, when cancelled the error wraps
+// context.Canceled. At most Config.MaxConcurrentRenders run at once, those
+// given up on included until they finish, otherwise errRenderBusy is returned.
+// The markdown is parsed with the options.
+func (rwt *RWTxt) render(r *http.Request, data string, opts markdown.ParserOptions) (html template.HTML, err error) {
+	ctx := r.Context()
+	release, err := rwt.acquireRender(ctx)
+	if err != nil {
+		return
+	}
+	if rwt.Config.RenderTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rwt.Config.RenderTimeout)
+		defer cancel()
+	}
+	// the slot is released by the conversion, which outlives ctx on timeout
+	html, err = rwt.markdown.Get(opts).ConvertContextRelease(ctx, data, release)
+	if errors.Is(err, markdown.ErrRenderTimeout) {
+		html = renderTimeoutHTML
+	}
+	return
+}
@@ -0,0 +1,32 @@
+package rwtxt
+
+import (
+	"testing"
+
+	"argc.in/scratch/pkg/db"
+)
+
+func TestNewDefaultDomain(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []db.Option
+		set  string
+		want string
+	}{
+		{"public domain", nil, "", "public"},
+		{"renamed public domain", []db.Option{db.WithPublicDomain("Open")}, "", "open"},
+		{"no public domain", []db.Option{db.WithoutPublicDomain()}, "", ""},
+		{"set", nil, "notes", "notes"},
+	}
+	for _, tt := range tests {
+		fs, err := db.New(":memory:", tt.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rwt := New(fs, Config{DefaultDomain: tt.set})
+		if got := rwt.Config.DefaultDomain; got != tt.want {
+			t.Errorf("%s: DefaultDomain = %q, want %q", tt.name, got, tt.want)
+		}
+		fs.Close()
+	}
+}
@@ -0,0 +1,247 @@
+package rwtxt
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/schollz/logger"
+
+	"argc.in/scratch/pkg/db"
+)
+
+// sessionCookie holds the id of the session of a browser when sessions are kept
+// on the server, instead of its domain keys.
+const sessionCookie = "rwtxt-session"
+
+// sessionTTL is how long sessions are kept after they were last saved, which
+// happens at least every sessionCheckInterval while they are used, and how long
+// their cookies last.
+const sessionTTL = 365 * 24 * time.Hour
+
+// sessionPruneInterval is how often the expired sessions are removed.
+const sessionPruneInterval = time.Hour
+
+// sessionCheckInterval is how long the domain keys of a session are trusted
+// before they are checked again, in case a domain was renamed.
+const sessionCheckInterval = 5 * time.Minute
+
+// Session is the sign in state of a browser.
+type Session struct {
+	Keys    map[string]string // domain keys by the name of their domain
+	Default string            // domain signed in to last
+	Checked time.Time         // when the Keys were last checked
+}
+
+// SessionStore keeps sessions on the server, so browsers only need a cookie
+// with the session id. Without one, the keys are kept in the cookie.
+type SessionStore interface {
+	// Get returns the session with the id, false if there is none.
+	Get(id string) (s Session, ok bool, err error)
+	// Set creates or replaces the session with the id.
+	Set(id string, s Session) error
+	// Delete removes the session with the id.
+	Delete(id string) error
+}
+
+// MemorySessionStore keeps sessions in memory, they are lost on restart.
+// Sessions expire sessionTTL after they were last set.
+type MemorySessionStore struct {
+	sync.Mutex
+	sessions map[string]memorySession
+	pruned   time.Time
+}
+
+// memorySession is a session of a MemorySessionStore with when it was set.
+type memorySession struct {
+	Session
+	modified time.Time
+}
+
+// NewMemorySessionStore returns an empty MemorySessionStore.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[string]memorySession), pruned: time.Now()}
+}
+
+func (m *MemorySessionStore) Get(id string) (s Session, ok bool, err error) {
+	m.Lock()
+	defer m.Unlock()
+	ms, ok := m.sessions[id]
+	if ok && time.Since(ms.modified) > sessionTTL {
+		delete(m.sessions, id)
+		return s, false, nil
+	}
+	return ms.Session, ok, nil
+}
+
+func (m *MemorySessionStore) Set(id string, s Session) error {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	m.sessions[id] = memorySession{Session: s, modified: now}
+	if now.Sub(m.pruned) > sessionPruneInterval {
+		m.pruned = now
+		for id, ms := range m.sessions {
+			if now.Sub(ms.modified) > sessionTTL {
+				delete(m.sessions, id)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *MemorySessionStore) Delete(id string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+// DBSessionStore keeps sessions in the database, they survive restarts.
+// Sessions expire sessionTTL after they were last set.
+type DBSessionStore struct {
+	fs *db.FileSystem
+
+	mu     sync.Mutex
+	pruned time.Time
+}
+
+// NewDBSessionStore returns a DBSessionStore keeping sessions in fs.
+func NewDBSessionStore(fs *db.FileSystem) *DBSessionStore {
+	return &DBSessionStore{fs: fs}
+}
+
+func (d *DBSessionStore) Get(id string) (s Session, ok bool, err error) {
+	data, modified, err := d.fs.GetSession(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s, false, nil
+	} else if err != nil {
+		return
+	}
+	if time.Since(modified) > sessionTTL {
+		return s, false, d.fs.DeleteSession(id)
+	}
+	err = json.Unmarshal([]byte(data), &s)
+	return s, err == nil, err
+}
+
+func (d *DBSessionStore) Set(id string, s Session) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	err = d.fs.SaveSession(id, string(data))
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if time.Since(d.pruned) > sessionPruneInterval {
+		d.pruned = time.Now()
+		n, errPrune := d.fs.DeleteSessionsBefore(time.Now().Add(-sessionTTL))
+		if errPrune != nil {
+			return errPrune
+		}
+		log.Debugf("removed %d expired sessions", n)
+	}
+	return nil
+}
+
+func (d *DBSessionStore) Delete(id string) error {
+	return d.fs.DeleteSession(id)
+}
+
+// getSessionDomains returns the domain keys of the session of the request, and
+// the domain signed in to last. The keys are checked again, and returned in
+// checked, once the session is older than sessionCheckInterval.
+func (rwt *RWTxt) getSessionDomains(r *http.Request) (domainKeys map[string]string, defaultDomain string, checked []string) {
+	domainKeys = make(map[string]string)
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return
+	}
+	s, ok, err := rwt.Config.Sessions.Get(cookie.Value)
+	if err != nil {
+		log.Error(err)
+		return
+	} else if !ok {
+		return
+	}
+	if time.Since(s.Checked) > sessionCheckInterval {
+		defaultKey := s.Keys[s.Default]
+		keys := make(map[string]string)
+		s.Default = ""
+		for _, key := range s.Keys {
+			_, domainName, domainErr := rwt.fs.CheckKey(key)
+			if domainErr != nil || domainName == "" {
+				continue
+			}
+			keys[domainName] = key
+			checked = append(checked, key)
+			if key == defaultKey {
+				s.Default = domainName
+			}
+		}
+		s.Keys = keys
+		s.Checked = time.Now().UTC()
+		if err = rwt.Config.Sessions.Set(cookie.Value, s); err != nil {
+			log.Error(err)
+		}
+	}
+	for domainName, key := range s.Keys {
+		domainKeys[domainName] = key
+	}
+	if _, ok := s.Keys[s.Default]; ok {
+		defaultDomain = s.Default
+	}
+	return
+}
+
+// updateSession stores the domain keys of the template in a new session,
+// replacing the one of the request so that session ids never outlive a sign
+// in, and returns the cookie of the new session.
+func (tr TemplateRender) updateSession(r *http.Request) (cookie http.Cookie) {
+	if old, err := r.Cookie(sessionCookie); err == nil {
+		if err = tr.rwt.Config.Sessions.Delete(old.Value); err != nil {
+			log.Error(err)
+		}
+	}
+	id, err := newSessionID()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	s := Session{Keys: make(map[string]string), Default: tr.Domain, Checked: time.Now().UTC()}
+	for domainName, key := range tr.DomainKeys {
+		if key != "" {
+			s.Keys[domainName] = key
+		}
+	}
+	if err = tr.rwt.Config.Sessions.Set(id, s); err != nil {
+		log.Error(err)
+		return
+	}
+	return http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		Expires:  time.Now().UTC().Add(sessionTTL),
+		HttpOnly: true,
+		Secure:   tr.rwt.secureCookie(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// newSessionID returns an unguessable session id.
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,37 @@
+package rwtxt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemorySessionStoreExpiry(t *testing.T) {
+	m := NewMemorySessionStore()
+	for _, id := range []string{"old", "stale", "new"} {
+		if err := m.Set(id, Session{Default: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expired := time.Now().Add(-sessionTTL - time.Minute)
+	for _, id := range []string{"old", "stale"} {
+		ms := m.sessions[id]
+		ms.modified = expired
+		m.sessions[id] = ms
+	}
+
+	if _, ok, err := m.Get("old"); ok || err != nil {
+		t.Errorf("Get expired = %v, %v, want not found", ok, err)
+	}
+	if s, ok, err := m.Get("new"); !ok || err != nil || s.Default != "new" {
+		t.Errorf("Get = %v, %v, %v", s, ok, err)
+	}
+
+	// expired sessions never asked for are removed too
+	m.pruned = time.Now().Add(-sessionPruneInterval - time.Minute)
+	if err := m.Set("newer", Session{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.sessions["stale"]; ok || len(m.sessions) != 2 {
+		t.Errorf("sessions after pruning: %v", m.sessions)
+	}
+}
@@ -0,0 +1,48 @@
+// shows the buttons of code blocks, which copy the code without line numbers
+(function() {
+    function codeText(block) {
+        var pre = block.querySelector("pre").cloneNode(true);
+        var numbers = pre.querySelectorAll(".ln, .lnt, .lntd:first-child");
+        for (var i = 0; i < numbers.length; i++) {
+            numbers[i].parentNode.removeChild(numbers[i]);
+        }
+        return pre.textContent;
+    }
+
+    function copied(button, label) {
+        button.textContent = label;
+        setTimeout(function() { button.textContent = "Copy"; }, 2000);
+    }
+
+    function copyFallback(text) {
+        var textarea = document.createElement("textarea");
+        textarea.value = text;
+        textarea.setAttribute("readonly", "");
+        textarea.style.position = "absolute";
+        textarea.style.left = "-9999px";
+        document.body.appendChild(textarea);
+        textarea.select();
+        var ok = document.execCommand("copy");
+        document.body.removeChild(textarea);
+        return ok;
+    }
+
+    var buttons = document.querySelectorAll("div.code-block > button.copy-code");
+    for (var i = 0; i < buttons.length; i++) {
+        var button = buttons[i];
+        button.hidden = false;
+        button.addEventListener("click", function(event) {
+            var button = event.currentTarget;
+            var text = codeText(button.parentNode);
+            if (navigator.clipboard && window.isSecureContext) {
+                navigator.clipboard.writeText(text).then(function() {
+                    copied(button, "Copied");
+                }, function() {
+                    copied(button, copyFallback(text) ? "Copied" : "Failed");
+                });
+            } else {
+                copied(button, copyFallback(text) ? "Copied" : "Failed");
+            }
+        });
+    }
+})();
@@ -0,0 +1,86 @@
+// gives the editor line numbers, indents and unindents the selected lines with
+// tab and shift+tab, and keeps the indentation of new lines
+(function() {
+    var editor = document.getElementById("editable");
+    var wrap = document.createElement("div");
+    wrap.className = "code-editor-wrap";
+    var gutter = document.createElement("pre");
+    gutter.className = "code-editor-lines";
+    gutter.setAttribute("aria-hidden", "true");
+    editor.parentNode.insertBefore(wrap, editor);
+    wrap.appendChild(gutter);
+    wrap.appendChild(editor);
+
+    var shownLines = 0;
+    function update() {
+        gutter.style.display = editor.style.display == "none" ? "none" : "";
+        var computed = window.getComputedStyle(editor);
+        gutter.style.font = computed.font;
+        gutter.style.lineHeight = computed.lineHeight;
+        gutter.style.paddingTop = computed.paddingTop;
+        var lines = editor.value.split("\n").length;
+        if (lines != shownLines) {
+            var numbers = [];
+            for (var i = 1; i <= lines; i++) {
+                numbers.push(i);
+            }
+            gutter.textContent = numbers.join("\n");
+            shownLines = lines;
+        }
+    }
+
+    // replace text like typing it, telling rwtxt.js the editor changed
+    function replace(text, start, end, selectStart, selectEnd) {
+        editor.setRangeText(text, start, end);
+        editor.setSelectionRange(selectStart, selectEnd);
+        editor.dispatchEvent(new Event("input"));
+    }
+
+    function indent(unindent) {
+        var value = editor.value;
+        var start = editor.selectionStart;
+        var end = editor.selectionEnd;
+        if (!unindent && value.substring(start, end).indexOf("\n") < 0) {
+            replace("\t", start, end, start + 1, start + 1);
+            return;
+        }
+        var first = value.lastIndexOf("\n", start - 1) + 1;
+        if (end > start && value[end - 1] == "\n") {
+            end--;
+        }
+        var lines = value.substring(first, end).split("\n");
+        for (var i = 0; i < lines.length; i++) {
+            if (!unindent) {
+                lines[i] = "\t" + lines[i];
+            } else if (lines[i][0] == "\t") {
+                lines[i] = lines[i].substring(1);
+            } else {
+                lines[i] = lines[i].replace(/^ {1,4}/, "");
+            }
+        }
+        var text = lines.join("\n");
+        replace(text, first, end, first, first + text.length);
+    }
+
+    editor.onkeydown = function(e) {
+        if (e.key == "Tab" && !e.ctrlKey && !e.altKey && !e.metaKey) {
+            e.preventDefault();
+            indent(e.shiftKey);
+        } else if (e.key == "Enter" && !e.shiftKey && !e.ctrlKey && !e.altKey && !e.metaKey && !e.isComposing) {
+            var start = editor.selectionStart;
+            var line = editor.value.substring(editor.value.lastIndexOf("\n", start - 1) + 1, start);
+            var indentation = line.match(/^[ \t]*/)[0];
+            if (indentation != "") {
+                e.preventDefault();
+                var text = "\n" + indentation;
+                replace(text, start, editor.selectionEnd, start + text.length, start + text.length);
+            }
+        }
+    };
+
+    editor.classList.add("code-editor");
+    editor.addEventListener("input", update);
+    editor.addEventListener("focusin", update);
+    window.addEventListener("resize", update);
+    update();
+})();
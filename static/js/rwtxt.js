@@ -13,6 +13,10 @@ const socketOpenListener = (event) => {
     setTimeout(function() {
         document.getElementById("connectedicon").style.display = 'none';
     }, 1000);
+    CY.lastSent = null;
+    if (document.getElementById("editable").style.display != "none") {
+        CY.requestLock("lock");
+    }
 };
 
 const socketCloseListener = (event) => {
@@ -89,22 +93,80 @@ CY.debounce = function(func, wait, immediate) {
     };
 };
 
+// the document as last sent to the server, null when it needs the full document
+CY.lastSent = null;
+
+// hash of the UTF-16 code units of text, matching hashText in delta.go
+CY.hashText = function(text) {
+    var h = 0;
+    for (var i = 0; i < text.length; i++) {
+        h = (Math.imul(h, 31) + text.charCodeAt(i)) >>> 0;
+    }
+    return h;
+};
+
+// delta returns the edit turning from into to
+CY.delta = function(from, to) {
+    var start = 0;
+    while (start < from.length && start < to.length && from[start] == to[start]) {
+        start++;
+    }
+    var end = 0;
+    while (end < from.length - start && end < to.length - start &&
+        from[from.length - 1 - end] == to[to.length - 1 - end]) {
+        end++;
+    }
+    // don't split surrogate pairs, they can't be sent on their own
+    if (start > 0 && /[\uD800-\uDBFF]/.test(from[start - 1])) {
+        start--;
+    }
+    if (end > 0 && /[\uDC00-\uDFFF]/.test(from[from.length - end])) {
+        end--;
+    }
+    return {
+        "base": CY.hashText(from),
+        "start": start,
+        "delete": from.length - start - end,
+        "insert": to.substring(start, to.length - end)
+    };
+};
+
 CY.contentEdited = function() {
     // console.log('edited');
     var markdown = document.getElementById("editable").value.replaceAll("<br>", "\n");
-    var slug = slugify(markdown);
-    socket.send(JSON.stringify({
+    var payload = {
         "id": window.rwtxt.file_id,
         "slug": slugify(markdown),
-        "data": markdown,
         "domain": window.rwtxt.domain,
         "domain_key": window.rwtxt.domain_key
+    };
+    if (CY.lastSent == null) {
+        payload.data = markdown;
+    } else {
+        payload.delta = CY.delta(CY.lastSent, markdown);
+    }
+    CY.lastSent = markdown;
+    socket.send(JSON.stringify(payload));
+};
+
+// ask to lock the page for this editor, or take over another editor's lock
+CY.requestLock = function(message) {
+    socket.send(JSON.stringify({
+        "id": window.rwtxt.file_id,
+        "domain": window.rwtxt.domain,
+        "domain_key": window.rwtxt.domain_key,
+        "message": message
     }));
 };
 
 CY.serverResponse = function(jsonString) {
     var data = JSON.parse(jsonString);
-    if (data.message == "unique_slug") {
+    if (data.message == "resync") {
+        CY.lastSent = null;
+        CY.contentEdited();
+    } else if (data.message == "lock") {
+        document.getElementById("locked").style.display = data.success ? 'none' : 'block';
+    } else if (data.message == "unique_slug") {
         var newwindowname = ""
         if (data.success) {
             newwindowname = data.slug;
@@ -121,11 +183,35 @@ CY.serverResponse = function(jsonString) {
         setTimeout(function() {
             document.getElementById("saved").style.display = 'none';
         }, 1000);
-    } else if (data.message == "not saving") {
+    } else if (data.message == "rate_limited") {
+        // resend the whole page once the domain can be written again
+        console.error(data.data);
         document.getElementById("notsaved").style.display = 'inline-block';
         setTimeout(function() {
             document.getElementById("notsaved").style.display = 'none';
-        }, 1000);
+            CY.lastSent = null;
+            CY.contentEdited();
+        }, 5000);
+    } else if (data.message == "quota") {
+        console.error(data.data);
+        document.getElementById("notsaved").style.display = 'inline-block';
+    } else if (data.message == "too_large") {
+        console.error('Page is too large to save.');
+        document.getElementById("notsaved").style.display = 'inline-block';
+    } else if (data.message == "save_failed") {
+        // resend the whole page, the server may have lost the last edits
+        console.error('Page could not be saved.');
+        document.getElementById("notsaved").style.display = 'inline-block';
+        setTimeout(function() {
+            document.getElementById("notsaved").style.display = 'none';
+            CY.lastSent = null;
+            CY.contentEdited();
+        }, 5000);
+    } else if (data.message == "refused") {
+        // the edits won't be saved, keep saying so
+        console.error(data.data);
+        document.getElementById("notsaved").title = data.data;
+        document.getElementById("notsaved").style.display = 'inline-block';
     }
 }
 
@@ -159,6 +245,18 @@ document.getElementById("editable").onkeydown = function(e) {
     }
 }
 
+document.getElementById("takeover").addEventListener("click", function(e) {
+    e.preventDefault();
+    CY.requestLock("takeover");
+});
+
+// keep the edit lock while editing
+setInterval(function() {
+    if (socket && socket.readyState == WebSocket.OPEN && document.getElementById("editable").style.display != "none") {
+        CY.requestLock("lock");
+    }
+}, 10000);
+
 editlink = document.getElementById("editlink")
 if (editlink != null) {
     editlink.addEventListener("click", CY.loadEditor);
@@ -218,6 +316,10 @@ function showMessage() {
 function onUploadFinished(file) {
     // // console.log("upload finished");
     // // console.log(file);
+    if (file.status != Dropzone.SUCCESS) {
+        // leave the error shown by dropzone
+        return;
+    }
     this.removeFile(file);
     var cursorPos = document.getElementById("editable").selectionStart;
     var cursorEnd = document.getElementById("editable").selectionEnd;
@@ -267,7 +369,7 @@ window.onclick = function(event) {
 if (window.rwtxt.domain_key != "") {
     Dropzone.options.dropzoneForm = {
         clickable: false,
-        maxFilesize: 10,
+        maxFilesize: window.rwtxt.max_upload_bytes / 1048576,
         init: function initDropzone() {
             this.on("complete", onUploadFinished);
         }
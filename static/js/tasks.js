@@ -0,0 +1,28 @@
+// lets the checkboxes of task lists be clicked, saving the page
+(function() {
+    var boxes = document.querySelectorAll("#rendered li > input[type=checkbox], #rendered li > p:first-child > input[type=checkbox]");
+    for (var i = 0; i < boxes.length; i++) {
+        var box = boxes[i];
+        box.disabled = false;
+        box.dataset.task = i;
+        box.addEventListener("change", function(event) {
+            var box = event.currentTarget;
+            box.disabled = true;
+            fetch(window.location.pathname + "?toggle=" + box.dataset.task + "&checked=" + box.checked + "&csrf_token=" + window.rwtxt.csrf_token, {
+                method: "POST",
+                credentials: "same-origin"
+            }).then(function(response) {
+                if (!response.ok) {
+                    return response.text().then(function(text) {
+                        throw new Error(text);
+                    });
+                }
+            }).catch(function(err) {
+                box.checked = !box.checked;
+                alert(err.message);
+            }).then(function() {
+                box.disabled = false;
+            });
+        });
+    }
+})();
@@ -3,25 +3,29 @@ package rwtxt
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
-	"image/jpeg"
 	"io"
 	"net/http"
 	"net/url"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/disintegration/imaging"
-
 	log "github.com/schollz/logger"
 
 	"argc.in/scratch/pkg/db"
+	"argc.in/scratch/pkg/markdown"
 	"argc.in/scratch/pkg/utils"
 )
 
@@ -52,21 +56,34 @@ type TemplateRender struct {
 	NumResults         int
 	Files              []db.File
 	MostActiveList     []db.File
+	ScheduledFiles     []db.File
 	SimilarFiles       []db.File
 	AllFiles           []db.File
 	Search             string
 	DomainExists       bool
 	ShowCookieMessage  bool
 	EditOnly           bool
+	TaskToggles        bool // the checkboxes of tasks can be clicked
 	Languages          []string
 	LanguageJS         []template.JS
 	rwt                *RWTxt
 	RWTxtConfig        Config
 	RenderTime         time.Time
-	UTCOffset          int
+	UTCOffset          int // minutes behind UTC of the browser
 	Options            db.DomainOptions
 	CustomIntro        template.HTML
 	CustomCSS          template.CSS
+	CanonicalURL       string
+	Nonce              string
+	CSRFToken          string
+	ErrorStatus        int
+	Hours              int
+	Since              int64
+	Activity           []db.ActivityEntry
+	Tags               []TagCount
+	DuplicateSlugs     map[string][]string
+	PageNum            int
+	PageCount          int
 }
 
 type Payload struct {
@@ -77,6 +94,7 @@ type Payload struct {
 	Slug      string `json:"slug,omitempty"`
 	Message   string `json:"message,omitempty"`
 	Success   bool   `json:"success"`
+	Delta     *Delta `json:"delta,omitempty"`
 }
 
 func NewTemplateRender(rwt *RWTxt) *TemplateRender {
@@ -87,14 +105,52 @@ func NewTemplateRender(rwt *RWTxt) *TemplateRender {
 	return tr
 }
 
+// InDefaultDomain reports whether the page is in the default domain, which
+// anyone can read and write.
+func (tr *TemplateRender) InDefaultDomain() bool {
+	return tr.rwt.isDefaultDomain(tr.Domain)
+}
+
+// HighlightStyle returns the chroma style of the code blocks of the domain.
+func (tr *TemplateRender) HighlightStyle() string {
+	if markdown.HighlightStyleExists(tr.Options.HighlightStyle) {
+		return tr.Options.HighlightStyle
+	}
+	return tr.rwt.Config.HighlightStyle
+}
+
+// fontFamily matches CSS font families, like Fira Code, monospace, without
+// quotes or anything else that could escape the style attribute.
+var fontFamily = regexp.MustCompile(`^[\pL\pN ,_-]*$`)
+
+// languageTag matches language tags like en, de-CH or zh-Hant-TW.
+var languageTag = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{1,8})*$`)
+
+// PrevPage and NextPage are the numbers of the pages around the current page
+// of a paginated list, zero if there are none.
+func (tr *TemplateRender) PrevPage() int {
+	if tr.PageNum > 1 {
+		return tr.PageNum - 1
+	}
+	return 0
+}
+
+func (tr *TemplateRender) NextPage() int {
+	if tr.PageNum < tr.PageCount {
+		return tr.PageNum + 1
+	}
+	return 0
+}
+
 func (tr *TemplateRender) handleSearch(w http.ResponseWriter, r *http.Request, domain, query string) (err error) {
-	_, tr.DomainIsPublic, tr.Options, _ = tr.rwt.fs.GetDomainFromName(domain)
+	_, tr.DomainIsPublic, tr.Options, _, _ = tr.rwt.fs.GetDomainFromName(domain)
 	if !tr.SignedIn && !tr.DomainIsPublic {
 		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("need to log in to search")), 302)
 		return
 
 	}
-	files, errGet := tr.rwt.fs.Find(query, tr.Domain)
+	byRelevance := r.URL.Query().Get("order") != "modified"
+	files, errGet := tr.rwt.fs.FindContext(r.Context(), query, tr.Domain, byRelevance)
 	if errGet != nil {
 		return errGet
 	}
@@ -102,7 +158,7 @@ func (tr *TemplateRender) handleSearch(w http.ResponseWriter, r *http.Request, d
 }
 
 func (tr *TemplateRender) handleList(w http.ResponseWriter, r *http.Request, query string, files []db.File) (err error) {
-	_, tr.DomainIsPublic, tr.Options, _ = tr.rwt.fs.GetDomainFromName(tr.Domain)
+	_, tr.DomainIsPublic, tr.Options, _, _ = tr.rwt.fs.GetDomainFromName(tr.Domain)
 	if !tr.SignedIn && !tr.DomainIsPublic {
 		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("need to log in to list")), 302)
 		return
@@ -111,9 +167,15 @@ func (tr *TemplateRender) handleList(w http.ResponseWriter, r *http.Request, que
 	// show the list page
 	tr.Title = query + " pages"
 	tr.Files = files
-	tr.NumResults = len(files)
+	if tr.PageCount == 0 {
+		tr.NumResults = len(files)
+	}
 	tr.Search = query
-	tr.RandomUUID = utils.UUID()
+	tr.RandomUUID, err = tr.rwt.fs.NewID()
+	if err != nil {
+		tr.httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Encoding", "gzip")
 	w.Header().Set("Content-Type", "text/html")
@@ -123,9 +185,12 @@ func (tr *TemplateRender) handleList(w http.ResponseWriter, r *http.Request, que
 }
 
 func (tr TemplateRender) updateDomainCookie(w http.ResponseWriter, r *http.Request) (cookie http.Cookie) {
-	delete(tr.DomainKeys, "public")
+	delete(tr.DomainKeys, tr.rwt.Config.DefaultDomain)
 	tr.DomainKeys[tr.Domain] = tr.DomainKey
 	log.Debugf("updated domain keys: %+v", tr.DomainKeys)
+	if tr.rwt.Config.Sessions != nil {
+		return tr.updateSession(r)
+	}
 
 	// add the current one as default
 	domainKeyList := []string{tr.DomainKey}
@@ -140,9 +205,13 @@ func (tr TemplateRender) updateDomainCookie(w http.ResponseWriter, r *http.Reque
 	log.Debugf("setting new list: %+v", domainKeyList)
 	// return the new cookie
 	return http.Cookie{
-		Name:    "rwtxt-domains",
-		Value:   strings.Join(domainKeyList, ","),
-		Expires: time.Now().UTC().Add(365 * 24 * time.Hour),
+		Name:     "rwtxt-domains",
+		Value:    strings.Join(domainKeyList, ","),
+		Path:     "/",
+		Expires:  time.Now().UTC().Add(365 * 24 * time.Hour),
+		HttpOnly: true,
+		Secure:   tr.rwt.secureCookie(r),
+		SameSite: http.SameSiteLaxMode,
 	}
 }
 
@@ -163,7 +232,7 @@ func (tr *TemplateRender) handleMain(w http.ResponseWriter, r *http.Request) (er
 	}
 
 	var domainErr error
-	tr.DomainID, tr.DomainIsPublic, tr.Options, domainErr = tr.rwt.fs.GetDomainFromName(tr.Domain)
+	tr.DomainID, tr.DomainIsPublic, tr.Options, _, domainErr = tr.rwt.fs.GetDomainFromName(tr.Domain)
 
 	// // check cache if signed in
 	// if tr.SignedIn && message == "" {
@@ -198,21 +267,28 @@ func (tr *TemplateRender) handleMain(w http.ResponseWriter, r *http.Request) (er
 	// }
 
 	// create a page to write to
+	id, err := tr.rwt.fs.NewID()
+	if err != nil {
+		tr.httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	newFile := db.File{
-		ID:       utils.UUID(),
+		ID:       id,
 		Created:  time.Now().UTC(),
 		Domain:   tr.Domain,
 		Modified: time.Now().UTC(),
 	}
-	defer func() {
-		go func() {
-			// premediate the page
-			err := tr.rwt.fs.Save(newFile)
-			if err != nil {
-				log.Debug(err)
-			}
+	if tr.rwt.anonymousWriteAllowed(tr.Domain, true) {
+		defer func() {
+			go func() {
+				// premediate the page
+				err := tr.rwt.fs.Save(newFile)
+				if err != nil {
+					log.Debug(err)
+				}
+			}()
 		}()
-	}()
+	}
 	tr.RandomUUID = newFile.ID
 
 	// delete this
@@ -222,7 +298,7 @@ func (tr *TemplateRender) handleMain(w http.ResponseWriter, r *http.Request) (er
 		signedin = false
 	}
 	tr.SignedIn = signedin
-	tr.DomainIsPrivate = !tr.DomainIsPublic && (tr.Domain != "public" || tr.rwt.Config.Private)
+	tr.DomainIsPrivate = !tr.DomainIsPublic && (!tr.InDefaultDomain() || tr.rwt.Config.Private)
 	tr.PrivateEnvironment = tr.rwt.Config.Private
 	tr.DomainExists = domainErr == nil
 
@@ -231,11 +307,11 @@ func (tr *TemplateRender) handleMain(w http.ResponseWriter, r *http.Request) (er
 		tr.Options.MostRecent = 10
 		tr.Options.MostEdited = 10
 	}
-	tr.Files, err = tr.rwt.fs.GetTopX(tr.Domain, tr.Options.MostRecent, tr.RWTxtConfig.OrderByCreated)
+	tr.Files, err = tr.rwt.fs.GetTopX(tr.Domain, tr.Options.MostRecent, false, tr.RWTxtConfig.OrderByCreated)
 	if err != nil {
 		log.Debug(err)
 	}
-	tr.AllFiles, err = tr.rwt.fs.GetAll(tr.Domain, true)
+	tr.AllFiles, err = tr.rwt.fs.GetAll(tr.Domain, false, true)
 	if err != nil {
 		log.Debug(err)
 	}
@@ -244,13 +320,28 @@ func (tr *TemplateRender) handleMain(w http.ResponseWriter, r *http.Request) (er
 	}
 
 	tr.MostActiveList, _ = tr.rwt.fs.GetTopXMostViews(tr.Domain, tr.Options.MostEdited)
+	if tr.SignedIn && !tr.InDefaultDomain() {
+		tr.ScheduledFiles, _ = tr.rwt.fs.GetScheduled(tr.Domain)
+		tr.DuplicateSlugs, err = tr.rwt.fs.FindDuplicateSlugs(tr.Domain)
+		if err != nil {
+			log.Debug(err)
+		}
+	}
 	tr.Title = tr.Domain
 	tr.Message = message
 	tr.DomainValue = template.HTMLAttr(`value="` + tr.Domain + `"`)
 	tr.RenderTime = time.Now().UTC()
 	if tr.Options.CustomIntro != "" {
-		tr.CustomIntro, err = tr.rwt.markdown.Convert(tr.Options.CustomIntro)
-		if err != nil {
+		tr.CustomIntro, err = tr.rwt.render(r, tr.Options.CustomIntro, tr.Options.ParserOptions())
+		if errors.Is(err, errRenderBusy) {
+			renderBusy(w)
+			return err
+		} else if errors.Is(err, markdown.ErrRenderTimeout) {
+			log.Warn(err)
+		} else if errors.Is(err, context.Canceled) {
+			// the client is gone, no one is left to answer
+			return nil
+		} else if err != nil {
 			return err
 		}
 	}
@@ -279,8 +370,13 @@ func (tr *TemplateRender) handleMain(w http.ResponseWriter, r *http.Request) (er
 	return tr.rwt.templates.ExecuteTemplate(gz, "main.html", tr)
 }
 
+// utcOffsetCookie holds the minutes the browser is behind UTC. The cookie
+// named UTCOffset of older versions held hours, which got zones like UTC+5:30
+// wrong.
+const utcOffsetCookie = "UTCOffsetMinutes"
+
 func (tr *TemplateRender) getUTCOffsetFromCookie(r *http.Request) {
-	c, err := r.Cookie("UTCOffset")
+	c, err := r.Cookie(utcOffsetCookie)
 	if err == nil {
 		tr.UTCOffset, _ = strconv.Atoi(c.Value)
 	}
@@ -289,9 +385,32 @@ func (tr *TemplateRender) getUTCOffsetFromCookie(r *http.Request) {
 }
 
 func (tr *TemplateRender) handleLogout(w http.ResponseWriter, r *http.Request) (err error) {
-	tr.Domain = strings.ToLower(strings.TrimSpace(r.URL.Query().Get("domain")))
+	if r.Method != http.MethodPost {
+		tr.httpError(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !tr.checkCSRF(w, r) {
+		return
+	}
+	tr.Domain = strings.ToLower(strings.TrimSpace(r.FormValue("domain")))
 
 	// delete all cookies
+	if session, errSession := r.Cookie(sessionCookie); errSession == nil {
+		if tr.rwt.Config.Sessions != nil {
+			if err = tr.rwt.Config.Sessions.Delete(session.Value); err != nil {
+				log.Error(err)
+			}
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     sessionCookie,
+			Value:    "",
+			Path:     "/",
+			Expires:  time.Unix(0, 0),
+			HttpOnly: true,
+			Secure:   tr.rwt.secureCookie(r),
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
 	_, err = r.Cookie("rwtxt-domains")
 	if err == nil {
 		c := &http.Cookie{
@@ -300,6 +419,8 @@ func (tr *TemplateRender) handleLogout(w http.ResponseWriter, r *http.Request) (
 			Path:     "/",
 			Expires:  time.Unix(0, 0),
 			HttpOnly: true,
+			Secure:   tr.rwt.secureCookie(r),
+			SameSite: http.SameSiteLaxMode,
 		}
 		http.SetCookie(w, c)
 	}
@@ -309,35 +430,51 @@ func (tr *TemplateRender) handleLogout(w http.ResponseWriter, r *http.Request) (
 }
 
 func (tr *TemplateRender) handleLogin(w http.ResponseWriter, r *http.Request) (err error) {
+	if !tr.checkCSRF(w, r) {
+		return
+	}
 	tr.Domain = strings.TrimSpace(strings.ToLower(r.FormValue("domain")))
 	password := strings.TrimSpace(r.FormValue("password"))
-	if tr.Domain == "public" || tr.Domain == "" {
-		tr.Domain = "public"
+	if tr.InDefaultDomain() || tr.Domain == "" {
+		tr.Domain = tr.rwt.Config.DefaultDomain
 		return tr.handleMain(w, r)
 	}
 	if password == "" {
-		tr.Domain = "public"
+		tr.Domain = tr.rwt.Config.DefaultDomain
 		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("domain key cannot be empty")), 302)
 		return
 	}
 	var key string
 
 	// check if exists
-	_, _, _, err = tr.rwt.fs.GetDomainFromName(tr.Domain)
+	_, _, _, _, err = tr.rwt.fs.GetDomainFromName(tr.Domain)
 	if err != nil {
 		// domain doesn't exist, create it
 		log.Debugf("domain '%s' doesn't exist, creating it", tr.Domain)
+		if tr.rwt.Config.RequireAdminKeyForDomainCreate && (tr.rwt.Config.AdminKey == "" ||
+			subtle.ConstantTimeCompare([]byte(r.FormValue("admin_key")), []byte(tr.rwt.Config.AdminKey)) != 1) {
+			tr.Domain = tr.rwt.Config.DefaultDomain
+			http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("only operators can create domains")), 302)
+			return nil
+		}
+		if tr.rwt.Config.CreateChallenge != nil {
+			if err = tr.rwt.Config.CreateChallenge(r); err != nil {
+				tr.Domain = tr.rwt.Config.DefaultDomain
+				http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte(err.Error())), 302)
+				return nil
+			}
+		}
 		err = tr.rwt.fs.SetDomain(tr.Domain, password)
 		if err != nil {
 			log.Error(err)
-			tr.Domain = "public"
+			tr.Domain = tr.rwt.Config.DefaultDomain
 			http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte(err.Error())), 302)
 			return
 		}
 	}
 	tr.DomainKey, err = tr.rwt.fs.SetKey(tr.Domain, password)
 	if err != nil {
-		tr.Domain = "public"
+		tr.Domain = tr.rwt.Config.DefaultDomain
 		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte(err.Error())), 302)
 		return
 	}
@@ -351,11 +488,14 @@ func (tr *TemplateRender) handleLogin(w http.ResponseWriter, r *http.Request) (e
 }
 
 func (tr *TemplateRender) handleLoginUpdate(w http.ResponseWriter, r *http.Request) (err error) {
+	if !tr.checkCSRF(w, r) {
+		return
+	}
 	tr.SignedIn, tr.DomainKey, tr.DefaultDomain, tr.DomainList, tr.DomainKeys = tr.rwt.isSignedIn(w, r, r.FormValue("domain"))
 	if !tr.SignedIn {
 		domain := r.FormValue("domain")
 		if domain == "" {
-			domain = "public"
+			domain = tr.rwt.Config.DefaultDomain
 		}
 		http.Redirect(w, r, "/"+domain+"?m="+base64.URLEncoding.EncodeToString([]byte("must be signed in")), 302)
 		return
@@ -364,19 +504,64 @@ func (tr *TemplateRender) handleLoginUpdate(w http.ResponseWriter, r *http.Reque
 	tr.Domain = strings.TrimSpace(strings.ToLower(r.FormValue("domain")))
 	password := strings.TrimSpace(r.FormValue("password"))
 	isPublic := strings.TrimSpace(r.FormValue("ispublic")) == "on"
-	options := db.DomainOptions{}
+	options := db.DefaultDomainOptions()
 	options.ShowSearch = strings.TrimSpace(r.FormValue("showsearch")) == "on"
+	options.LockEditing = strings.TrimSpace(r.FormValue("lockediting")) == "on"
 	options.LastCreated, _ = strconv.Atoi(r.FormValue("created"))
 	options.MostRecent, _ = strconv.Atoi(r.FormValue("recent"))
 	options.MostEdited, _ = strconv.Atoi(r.FormValue("edited"))
 	options.CSS = strings.TrimSpace(r.FormValue("css"))
 	options.CustomTitle = strings.TrimSpace(r.FormValue("title"))
 	options.CustomIntro = strings.TrimSpace(r.FormValue("intro"))
+	options.EmbedOrigins = strings.TrimSpace(r.FormValue("embedorigins"))
+	options.AllowedUploadTypes = strings.Join(strings.Fields(r.FormValue("uploadtypes")), " ")
+	options.HighlightStyle = strings.TrimSpace(r.FormValue("highlightstyle"))
+	options.AutoDetectCode = strings.TrimSpace(r.FormValue("autodetectcode")) == "on"
+	options.EditorFont = strings.TrimSpace(r.FormValue("editorfont"))
+	if !fontFamily.MatchString(options.EditorFont) {
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("invalid editor font "+options.EditorFont)), 302)
+		return
+	}
+	options.CodeEditor = strings.TrimSpace(r.FormValue("codeeditor")) == "on"
+	options.CustomDictionary = strings.Fields(r.FormValue("dictionary"))
+	if errCheck := checkDictionary(options.CustomDictionary); errCheck != nil {
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte(errCheck.Error())), 302)
+		return
+	}
+	options.Markdown = markdown.Extensions{
+		GFM:          strings.TrimSpace(r.FormValue("gfm")) == "on",
+		Footnotes:    strings.TrimSpace(r.FormValue("footnotes")) == "on",
+		Emoji:        strings.TrimSpace(r.FormValue("emoji")) == "on",
+		WikiLinks:    strings.TrimSpace(r.FormValue("wikilinks")) == "on",
+		Highlighting: strings.TrimSpace(r.FormValue("highlighting")) == "on",
+	}
+	options.LineNumbers = strings.TrimSpace(r.FormValue("linenumbers")) == "on"
+	options.CopyCodeButtons = strings.TrimSpace(r.FormValue("copycodebuttons")) == "on"
+	options.HeadingAnchors = strings.TrimSpace(r.FormValue("headinganchors")) == "on"
+	options.NewPageTemplate = strings.TrimSpace(r.FormValue("newpagetemplate"))
+	options.ExpandVariables = strings.TrimSpace(r.FormValue("expandvariables")) == "on"
+	options.Variables = parseVariables(r.FormValue("variables"))
+	if indexing := r.FormValue("allowindexing"); indexing == "on" || indexing == "off" {
+		allow := indexing == "on"
+		options.AllowIndexing = &allow
+	}
+	options.Language = strings.TrimSpace(r.FormValue("language"))
+	if options.Language != "" && !languageTag.MatchString(options.Language) {
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("invalid language "+options.Language)), 302)
+		return
+	}
+	options.RelatedPages = r.FormValue("relatedpages")
+	if options.RelatedPages != "" && options.RelatedPages != db.RelatedByTags && options.RelatedPages != db.RelatedByContent {
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("invalid related pages "+options.RelatedPages)), 302)
+		return
+	}
+	options.LogoBlobID = uploadID(r.FormValue("logo"))
+	options.FaviconBlobID = uploadID(r.FormValue("favicon"))
 
 	log.Debugf("new options: %+v", options)
-	if tr.Domain == "public" || tr.Domain == "" {
-		tr.Domain = "public"
-		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("cannot modify public")), 302)
+	if tr.InDefaultDomain() || tr.Domain == "" {
+		tr.Domain = tr.rwt.Config.DefaultDomain
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("cannot modify "+tr.Domain)), 302)
 		return
 	}
 
@@ -390,6 +575,16 @@ func (tr *TemplateRender) handleLoginUpdate(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	for _, id := range []string{options.LogoBlobID, options.FaviconBlobID} {
+		if id == "" {
+			continue
+		}
+		if err = tr.rwt.checkBrandingUpload(tr.Domain, id); err != nil {
+			http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte(err.Error())), 302)
+			return nil
+		}
+	}
+
 	err = tr.rwt.fs.UpdateDomain(tr.Domain, password, isPublic, options)
 	message := "settings updated"
 	if password != "" {
@@ -402,6 +597,315 @@ func (tr *TemplateRender) handleLoginUpdate(w http.ResponseWriter, r *http.Reque
 	return
 }
 
+// handleRename renames the domain, which takes its password again.
+func (tr *TemplateRender) handleRename(w http.ResponseWriter, r *http.Request) (err error) {
+	if r.Method != http.MethodPost {
+		tr.httpError(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !tr.checkCSRF(w, r) {
+		return
+	}
+	tr.Domain = strings.TrimSpace(strings.ToLower(r.FormValue("domain")))
+	tr.SignedIn, tr.DomainKey, tr.DefaultDomain, tr.DomainList, tr.DomainKeys = tr.rwt.isSignedIn(w, r, tr.Domain)
+	if !tr.SignedIn || tr.InDefaultDomain() {
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("must be signed in")), 302)
+		return
+	}
+	newName := strings.TrimSpace(strings.ToLower(r.FormValue("newname")))
+	err = tr.rwt.fs.RenameDomain(tr.Domain, newName, strings.TrimSpace(r.FormValue("password")))
+	if err != nil {
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte(err.Error())), 302)
+		return nil
+	}
+	http.Redirect(w, r, "/"+newName+"?m="+base64.URLEncoding.EncodeToString([]byte("domain renamed")), 302)
+	return
+}
+
+func (tr *TemplateRender) handlePublish(w http.ResponseWriter, r *http.Request) (err error) {
+	if r.Method != http.MethodPost {
+		tr.httpError(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !tr.checkCSRF(w, r) {
+		return
+	}
+	tr.Domain = strings.TrimSpace(strings.ToLower(r.FormValue("domain")))
+	id := strings.TrimSpace(r.FormValue("id"))
+	tr.SignedIn, tr.DomainKey, tr.DefaultDomain, tr.DomainList, tr.DomainKeys = tr.rwt.isSignedIn(w, r, tr.Domain)
+	if !tr.SignedIn || tr.InDefaultDomain() {
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("must be signed in")), 302)
+		return
+	}
+
+	if publishAt := r.FormValue("publish_at"); publishAt != "" {
+		// the time is local to the browser
+		var at time.Time
+		at, err = time.Parse("2006-01-02T15:04", publishAt)
+		if err != nil {
+			http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("invalid publishing time")), 302)
+			return
+		}
+		err = tr.rwt.fs.SchedulePublish(id, tr.Domain, at.Add(time.Duration(tr.UTCOffset)*time.Minute))
+	} else if r.FormValue("published") == "1" {
+		err = tr.rwt.fs.Publish(id, tr.Domain)
+	} else {
+		err = tr.rwt.fs.Unpublish(id, tr.Domain)
+	}
+	if err != nil {
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte(err.Error())), 302)
+		return
+	}
+	http.Redirect(w, r, "/"+tr.Domain+"/"+id, 302)
+	return
+}
+
+// handleRecent shows the owner of a domain what changed on its pages in the
+// last hours, with the contents from before so they can be reverted.
+func (tr *TemplateRender) handleRecent(w http.ResponseWriter, r *http.Request) (err error) {
+	if !tr.SignedIn || tr.InDefaultDomain() {
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("must be signed in")), 302)
+		return
+	}
+	tr.Hours, _ = strconv.Atoi(r.URL.Query().Get("hours"))
+	if tr.Hours <= 0 {
+		tr.Hours = 24
+	}
+	since := time.Duration(tr.Hours) * time.Hour
+	tr.Since = time.Now().UTC().Add(-since).UnixNano()
+	tr.Files, err = tr.rwt.fs.RecentlyModified(tr.Domain, since)
+	if err != nil {
+		tr.httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tr.NumResults = len(tr.Files)
+	tr.Title = "Recent changes | " + tr.Domain
+	_, _, tr.Options, _, _ = tr.rwt.fs.GetDomainFromName(tr.Domain)
+	if tr.Options.CSS != "" {
+		tr.CustomCSS = template.CSS(tr.Options.CSS)
+	}
+	return tr.rwt.templates.ExecuteTemplate(w, "recent.html", tr)
+}
+
+// handleActivity shows the latest pages created and modified in the domain.
+func (tr *TemplateRender) handleActivity(w http.ResponseWriter, r *http.Request) (err error) {
+	var errGet error
+	_, tr.DomainIsPublic, tr.Options, _, errGet = tr.rwt.fs.GetDomainFromName(tr.Domain)
+	if errGet != nil {
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("domain does not exist")), 302)
+		return
+	}
+	if !tr.SignedIn && !tr.DomainIsPublic {
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("domain is not public, sign in first")), 302)
+		return
+	}
+	tr.Activity, err = tr.rwt.fs.GetActivity(tr.Domain, activityLength)
+	if err != nil {
+		tr.httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tr.Title = "Activity | " + tr.Domain
+	if tr.Options.CSS != "" {
+		tr.CustomCSS = template.CSS(tr.Options.CSS)
+	}
+	return tr.rwt.templates.ExecuteTemplate(w, "activity.html", tr)
+}
+
+// relatedLength is the number of related pages shown below a page.
+const relatedLength = 5
+
+// TagCount is a tag in the tag cloud of a domain, with the number of pages
+// using it and its font size in em.
+type TagCount struct {
+	Tag   string
+	Count int
+	Size  float64
+}
+
+// handleTags shows the tags of the domain as a cloud ordered by count, or by
+// name with ?order=name, or the pages using the tag given with ?tag=.
+func (tr *TemplateRender) handleTags(w http.ResponseWriter, r *http.Request) (err error) {
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		files, errGet := tr.rwt.fs.GetTagged(tr.Domain, tag, tr.RWTxtConfig.OrderByCreated)
+		if errGet != nil {
+			return errGet
+		}
+		return tr.handleList(w, r, "#"+strings.ToLower(strings.TrimPrefix(tag, "#")), files)
+	}
+
+	var errGet error
+	_, tr.DomainIsPublic, tr.Options, _, errGet = tr.rwt.fs.GetDomainFromName(tr.Domain)
+	if errGet != nil {
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("domain does not exist")), 302)
+		return
+	}
+	if !tr.SignedIn && !tr.DomainIsPublic {
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("domain is not public, sign in first")), 302)
+		return
+	}
+	tags, err := tr.rwt.fs.GetTags(tr.Domain)
+	if err != nil {
+		tr.httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	most := 1
+	for tag, count := range tags {
+		tr.Tags = append(tr.Tags, TagCount{Tag: tag, Count: count})
+		if count > most {
+			most = count
+		}
+	}
+	// sizes go from 1em for tags of one page to 2em for the most used
+	for i := range tr.Tags {
+		tr.Tags[i].Size = 1
+		if most > 1 {
+			tr.Tags[i].Size += float64(tr.Tags[i].Count-1) / float64(most-1)
+		}
+	}
+	byName := r.URL.Query().Get("order") == "name"
+	sort.Slice(tr.Tags, func(i, j int) bool {
+		if !byName && tr.Tags[i].Count != tr.Tags[j].Count {
+			return tr.Tags[i].Count > tr.Tags[j].Count
+		}
+		return tr.Tags[i].Tag < tr.Tags[j].Tag
+	})
+	tr.Title = "Tags | " + tr.Domain
+	if tr.Options.CSS != "" {
+		tr.CustomCSS = template.CSS(tr.Options.CSS)
+	}
+	return tr.rwt.templates.ExecuteTemplate(w, "tags.html", tr)
+}
+
+// handleRevert restores a page to how it was at the version, a timestamp in
+// nanoseconds.
+func (tr *TemplateRender) handleRevert(w http.ResponseWriter, r *http.Request) (err error) {
+	if r.Method != http.MethodPost {
+		tr.httpError(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !tr.checkCSRF(w, r) {
+		return
+	}
+	tr.Domain = strings.TrimSpace(strings.ToLower(r.FormValue("domain")))
+	id := strings.TrimSpace(r.FormValue("id"))
+	tr.SignedIn, tr.DomainKey, tr.DefaultDomain, tr.DomainList, tr.DomainKeys = tr.rwt.isSignedIn(w, r, tr.Domain)
+	if !tr.SignedIn || tr.InDefaultDomain() {
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("must be signed in")), 302)
+		return
+	}
+
+	version, err := strconv.ParseInt(r.FormValue("version"), 10, 64)
+	if err != nil {
+		tr.httpError(w, r, "invalid version", http.StatusBadRequest)
+		return nil
+	}
+	files, err := tr.rwt.fs.GetContext(r.Context(), id, tr.Domain)
+	if err != nil || len(files) != 1 {
+		tr.httpError(w, r, "page not found", http.StatusNotFound)
+		return nil
+	}
+	f := files[0]
+	snapshots := f.History.GetSnapshots()
+	if len(snapshots) == 0 || snapshots[0] > version {
+		tr.httpError(w, r, "no earlier version to revert to", http.StatusBadRequest)
+		return nil
+	}
+	f.Data, err = f.History.GetPreviousByTimestamp(version)
+	if err != nil {
+		return
+	}
+	err = tr.rwt.fs.Save(f)
+	if err != nil {
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte(err.Error())), 302)
+		return
+	}
+	http.Redirect(w, r, "/"+tr.Domain+"/"+id, 302)
+	return
+}
+
+// errNoTask is returned when the page has no task to toggle at the index.
+var errNoTask = errors.New("no such task")
+
+// handleToggleTask checks or unchecks the task ?toggle=N of the page, or sets
+// it to ?checked=, for the checkboxes of task lists. The page is read again
+// and saved under the lock of the database, so edits made since it was shown,
+// or while it is toggled, are kept.
+func (tr *TemplateRender) handleToggleTask(w http.ResponseWriter, r *http.Request) (err error) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !tr.checkCSRF(w, r) {
+		return
+	}
+	n, errAtoi := strconv.Atoi(r.URL.Query().Get("toggle"))
+	if errAtoi != nil || n < 0 {
+		http.Error(w, "invalid task", http.StatusBadRequest)
+		return
+	}
+	var checked *bool
+	if value := r.URL.Query().Get("checked"); value != "" {
+		check, errBool := strconv.ParseBool(value)
+		if errBool != nil {
+			http.Error(w, "invalid checked", http.StatusBadRequest)
+			return
+		}
+		checked = &check
+	}
+	if tr.InDefaultDomain() {
+		if !tr.rwt.anonymousWriteAllowed(tr.Domain, false) {
+			http.Error(w, "anonymous editing is disabled", http.StatusForbidden)
+			return
+		}
+	} else if !tr.SignedIn {
+		http.Error(w, "must be signed in", http.StatusForbidden)
+		return
+	}
+
+	pageID, many, err := tr.rwt.fs.Exists(tr.Page, tr.Domain)
+	if err != nil {
+		return
+	}
+	if pageID == "" || many {
+		http.Error(w, "page not found", http.StatusNotFound)
+		return
+	}
+	_, _, options, _, err := tr.rwt.fs.GetDomainFromName(tr.Domain)
+	if err != nil {
+		return
+	}
+	if options.LockEditing && tr.rwt.locks.held(pageID) {
+		http.Error(w, "page is being edited", http.StatusConflict)
+		return
+	}
+	var qe *quotaError
+	if err = tr.rwt.checkQuota(tr.Domain, false, 0); errors.As(err, &qe) {
+		writeQuotaError(w, qe)
+		return nil
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	parser := tr.rwt.markdown.Get(options.ParserOptions())
+	err = tr.rwt.fs.UpdateContext(r.Context(), pageID, tr.Domain, func(f *db.File) error {
+		var found bool
+		f.Data, found = parser.ToggleTask(f.Data, n, checked)
+		if !found {
+			return errNoTask
+		}
+		return nil
+	})
+	if errors.Is(err, errNoTask) {
+		http.Error(w, "the page has changed, reload it", http.StatusConflict)
+		return nil
+	} else if err != nil {
+		http.Error(w, "could not save page", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return
+}
+
 func (tr *TemplateRender) handleWebsocket(w http.ResponseWriter, r *http.Request) (err error) {
 	// handle websockets on this page
 	c, errUpgrade := tr.rwt.wsupgrader.Upgrade(w, r, nil)
@@ -409,11 +913,49 @@ func (tr *TemplateRender) handleWebsocket(w http.ResponseWriter, r *http.Request
 		return errUpgrade
 	}
 	defer c.Close()
+	if !tr.rwt.websockets.add(c) {
+		return
+	}
+	defer tr.rwt.websockets.remove(c)
 	domainChecked := false
 	domainValidated := false
+	var options db.DomainOptions
 	var editFile db.File
 	var p Payload
+
+	// the document as last seen by the editor, which deltas apply to
+	var baseID, baseData string
+
+	// the autosaver reports the saves it held on to from its timers, so
+	// writes are serialized
+	var writeMu sync.Mutex
+	send := func(p Payload) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return c.WriteJSON(p)
+	}
+
+	// coalesce saves, telling the editor about those failing after it was
+	// answered
+	saver := newAutosaver(tr.rwt.Config.AutosaveInterval, tr.rwt.fs.Save, func(f db.File, err error) {
+		if errSend := send(Payload{ID: f.ID, Message: "save_failed"}); errSend != nil {
+			log.Debug("write:", errSend)
+		}
+	})
+
+	// when the editor goes away, save its last edits and only then release
+	// its edit lock, so they don't overwrite those of an editor taking over
+	session := utils.UUID()
+	var lockedID string
+	defer func() {
+		saver.Flush()
+		if lockedID != "" {
+			tr.rwt.locks.release(lockedID, session)
+		}
+	}()
+
 	for {
+		p = Payload{}
 		err := c.ReadJSON(&p)
 		if err != nil {
 			log.Debug("read:", err)
@@ -424,9 +966,12 @@ func (tr *TemplateRender) handleWebsocket(w http.ResponseWriter, r *http.Request
 		}
 		log.Debugf("recv: %v", p)
 
+		if p.Domain == "" {
+			p.Domain = tr.rwt.Config.DefaultDomain
+		}
 		if !domainChecked {
 			domainChecked = true
-			if p.Domain == "public" {
+			if tr.rwt.isDefaultDomain(p.Domain) {
 				domainValidated = true
 			} else {
 				_, _, keyErr := tr.rwt.fs.CheckKey(p.DomainKey)
@@ -434,13 +979,80 @@ func (tr *TemplateRender) handleWebsocket(w http.ResponseWriter, r *http.Request
 					domainValidated = true
 				}
 			}
+			_, _, options, _, _ = tr.rwt.fs.GetDomainFromName(p.Domain)
 		}
 
-		// save it
-		if p.ID != "" && domainValidated {
-			if p.Domain == "" {
-				p.Domain = "public"
+		// lock the page for this editor
+		if p.Message == "lock" || p.Message == "takeover" {
+			locked := !options.LockEditing || p.ID == ""
+			if !locked && domainValidated {
+				locked = tr.rwt.locks.acquire(p.ID, session, p.Message == "takeover")
+				if locked {
+					lockedID = p.ID
+				}
+			}
+			err = send(Payload{
+				ID:      p.ID,
+				Message: "lock",
+				Success: locked,
+			})
+			if err != nil {
+				log.Debug("write:", err)
+				break
+			}
+			continue
+		}
+		if options.LockEditing && p.ID != "" && domainValidated {
+			if !tr.rwt.locks.acquire(p.ID, session, false) {
+				log.Debugf("%s is locked by another session", p.ID)
+				err = send(Payload{
+					ID:      p.ID,
+					Message: "lock",
+					Success: false,
+				})
+				if err != nil {
+					log.Debug("write:", err)
+					break
+				}
+				continue
+			}
+			lockedID = p.ID
+		}
+
+		// rebuild the document from a delta, asking for the full document
+		// when the editor and server disagree on what it looks like
+		if p.Delta != nil && p.ID != "" && domainValidated {
+			if baseID != p.ID {
+				baseID, baseData = p.ID, ""
+				if files, errGet := tr.rwt.fs.Get(p.ID, p.Domain); errGet == nil && len(files) == 1 {
+					baseData = files[0].Data
+				}
 			}
+			p.Data, err = p.Delta.apply(baseData)
+			if err != nil {
+				log.Debugf("%s: %s", p.ID, err)
+				err = send(Payload{
+					ID:      p.ID,
+					Message: "resync",
+				})
+				if err != nil {
+					log.Debug("write:", err)
+					break
+				}
+				continue
+			}
+		}
+
+		writeAllowed := domainValidated
+		newPage := false
+		if writeAllowed && p.ID != "" {
+			existingID, _, _ := tr.rwt.fs.Exists(p.ID, p.Domain)
+			newPage = existingID == ""
+			writeAllowed = tr.rwt.anonymousWriteAllowed(p.Domain, newPage)
+		}
+
+		// save it
+		if p.ID != "" && writeAllowed {
 			data := strings.TrimSpace(p.Data)
 			if data == introText {
 				data = ""
@@ -452,13 +1064,60 @@ func (tr *TemplateRender) handleWebsocket(w http.ResponseWriter, r *http.Request
 				Created: time.Now().UTC(),
 				Domain:  p.Domain,
 			}
-			err = tr.rwt.fs.Save(editFile)
-			if err != nil {
+			err = tr.rwt.fs.CheckPageSize(editFile.Data)
+			if err == nil {
+				err = tr.rwt.checkQuota(p.Domain, newPage, tr.rwt.pageGrowth(editFile))
+			}
+			if err == nil {
+				err = saver.Save(editFile)
+			}
+			if err == nil {
+				baseID, baseData = p.ID, p.Data
+			}
+			var tooLarge *db.PageTooLargeError
+			var qe *quotaError
+			if errors.As(err, &qe) {
+				log.Debug(err)
+				message := "quota"
+				if qe.retryAfter > 0 {
+					message = "rate_limited"
+				}
+				err = send(Payload{
+					ID:      p.ID,
+					Message: message,
+					Data:    qe.reason,
+				})
+				if err != nil {
+					log.Debug("write:", err)
+					break
+				}
+				continue
+			} else if errors.As(err, &tooLarge) {
+				log.Debug(err)
+				err = send(Payload{
+					ID:      p.ID,
+					Message: "too_large",
+				})
+				if err != nil {
+					log.Debug("write:", err)
+					break
+				}
+				continue
+			} else if err != nil {
 				log.Error(err)
+				err = send(Payload{
+					ID:      p.ID,
+					Message: "save_failed",
+				})
+				if err != nil {
+					log.Debug("write:", err)
+					break
+				}
+				continue
 			}
 			fs, _ := tr.rwt.fs.Get(p.Slug, p.Domain)
 
-			err = c.WriteJSON(Payload{
+			err = send(Payload{
 				ID:      p.ID,
 				Slug:    p.Slug,
 				Message: "unique_slug",
@@ -469,9 +1128,20 @@ func (tr *TemplateRender) handleWebsocket(w http.ResponseWriter, r *http.Request
 				break
 			}
 		} else {
-			log.Debug("not saving")
-			err = c.WriteJSON(Payload{
-				Message: "not saving",
+			// refuse it for good, the editor keeps the edits it can't save
+			reason := "must be signed in to save"
+			if p.ID == "" {
+				reason = "no page to save"
+			} else if domainValidated && newPage {
+				reason = "anonymous page creation is disabled"
+			} else if domainValidated {
+				reason = "anonymous editing is disabled"
+			}
+			log.Debugf("not saving %s: %s", p.ID, reason)
+			err = send(Payload{
+				ID:      p.ID,
+				Message: "refused",
+				Data:    reason,
 			})
 			if err != nil {
 				log.Debug("write:", err)
@@ -505,7 +1175,7 @@ func (tr *TemplateRender) handleViewEdit(w http.ResponseWriter, r *http.Request)
 	// check if domain is public and exists
 	timerStart = time.Now().UTC()
 	var errGet error
-	_, tr.DomainIsPublic, tr.Options, errGet = tr.rwt.fs.GetDomainFromName(tr.Domain)
+	_, tr.DomainIsPublic, tr.Options, _, errGet = tr.rwt.fs.GetDomainFromName(tr.Domain)
 	if errGet == nil && !tr.SignedIn && !tr.DomainIsPublic {
 		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("domain is not public, sign in first")), 302)
 		return
@@ -520,9 +1190,9 @@ func (tr *TemplateRender) handleViewEdit(w http.ResponseWriter, r *http.Request)
 		var files []db.File
 		timerStart = time.Now().UTC()
 		if !many {
-			files, err = tr.rwt.fs.Get(pageID, tr.Domain)
+			files, err = tr.rwt.fs.GetContext(r.Context(), pageID, tr.Domain)
 		} else {
-			files, err = tr.rwt.fs.Get(tr.Page, tr.Domain)
+			files, err = tr.rwt.fs.GetContext(r.Context(), tr.Page, tr.Domain)
 		}
 		if err != nil {
 			log.Error(err)
@@ -536,7 +1206,24 @@ func (tr *TemplateRender) handleViewEdit(w http.ResponseWriter, r *http.Request)
 		}
 		log.Debugf("got %s content in %s", tr.Page, time.Since(timerStart))
 	} else {
-		uuid := utils.UUID()
+		if !tr.rwt.anonymousWriteAllowed(tr.Domain, true) {
+			tr.httpError(w, r, "anonymous page creation is disabled", http.StatusForbidden)
+			return
+		}
+		var qe *quotaError
+		if err = tr.rwt.checkQuota(tr.Domain, true, 0); errors.As(err, &qe) {
+			writeQuotaError(w, qe)
+			return nil
+		} else if err != nil {
+			tr.httpError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var uuid string
+		uuid, err = tr.rwt.fs.NewID()
+		if err != nil {
+			tr.httpError(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
 		f = db.File{
 			ID:       uuid,
 			Created:  time.Now().UTC(),
@@ -544,7 +1231,7 @@ func (tr *TemplateRender) handleViewEdit(w http.ResponseWriter, r *http.Request)
 			Modified: time.Now().UTC(),
 		}
 		f.Slug = tr.Page
-		f.Data = ""
+		f.Data = newPageData(tr.Options, f)
 		err = tr.rwt.fs.Save(f)
 		if err != nil {
 			err = fmt.Errorf("domain does not exist")
@@ -552,10 +1239,41 @@ func (tr *TemplateRender) handleViewEdit(w http.ResponseWriter, r *http.Request)
 			return
 		}
 		log.Debugf("saved: %+v", f)
+		if f.Data != "" {
+			// open the template in the editor, as new empty pages are
+			http.Redirect(w, r, "/"+tr.Domain+"/"+tr.Page+"?edit=1", 302)
+			return
+		}
 		http.Redirect(w, r, "/"+tr.Domain+"/"+tr.Page, 302)
 		return
 	}
 	tr.File = f
+	if !f.IsPublished() && !tr.SignedIn {
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("page is not published")), 302)
+		return
+	}
+
+	// redirect to the canonical URL, unless the page has no slug to use
+	if f.Slug != "" {
+		canonical := f.Slug
+		if tr.rwt.Config.CanonicalByID {
+			canonical = f.ID
+		} else if _, slugShared, _ := tr.rwt.fs.Exists(f.Slug, tr.Domain); slugShared {
+			canonical = f.ID
+		}
+		tr.CanonicalURL = "/" + tr.Domain + "/" + canonical
+		if tr.Page != canonical {
+			u := *r.URL
+			u.Path = tr.CanonicalURL
+			http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+			return
+		}
+	}
+
+	if r.URL.Query().Get("toc") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(tr.rwt.markdown.Get(tr.Options.ParserOptions()).TOC(tr.File.Data))
+	}
 
 	if showRaw {
 		w.Header().Set("Content-Encoding", "gzip")
@@ -582,7 +1300,20 @@ func (tr *TemplateRender) handleViewEdit(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
-	initialMarkdown += "\n\n" + f.Data
+	data := markdown.ExpandIncludes(f.Data, f.Slug, tr.rwt.includedPage(r.Context(), tr.Domain, tr.SignedIn))
+	// the tasks of included pages would be counted as those of this one
+	tr.TaskToggles = version == "" && data == f.Data && tr.Options.Markdown.GFM &&
+		(tr.SignedIn || tr.InDefaultDomain() && tr.Options.AllowAnonymousEdit)
+	if tr.Options.ExpandVariables {
+		data = markdown.ExpandVariables(data, tr.rwt.pageVariables(tr.Domain, tr.Options, f))
+	}
+	// pages showing an old version, other pages or variables can't be cached,
+	// code languages are guessed the same from the same contents
+	cacheable := version == "" && data == f.Data
+	if tr.Options.AutoDetectCode {
+		data = markdown.LabelCodeBlocks(data)
+	}
+	initialMarkdown += "\n\n" + data
 	// if f.Data == "" {
 	// 	f.Data = introText
 	// }
@@ -597,24 +1328,55 @@ func (tr *TemplateRender) handleViewEdit(w http.ResponseWriter, r *http.Request)
 	// make title
 	timerStart = time.Now().UTC()
 	domain := tr.Domain
-	slug := f.Slug
+	title := f.Title
 	if domain == "" {
-		domain = "public"
+		domain = tr.rwt.Config.DefaultDomain
 	}
-	if slug == "" {
-		slug = f.ID
+	if title == "" {
+		title = f.ID
 	}
-	tr.Title = slug + " | " + domain
+	tr.Title = title + " | " + domain
 	// initialMarkdown = strings.Replace(initialMarkdown, "- [ ]", "- ☐", -1)
 	// initialMarkdown = strings.Replace(initialMarkdown, "- [x]", "- 🗹", -1)
-	tr.Rendered, err = tr.rwt.markdown.Convert(initialMarkdown)
-	if err != nil {
-		return err
+	var cached []byte
+	var cachedModified time.Time
+	errCache := sql.ErrNoRows
+	if cacheable {
+		cached, cachedModified, errCache = tr.rwt.fs.GetRenderedHTML(f.ID)
+	}
+	if errCache == nil && cachedModified.Equal(f.Modified) {
+		tr.Rendered = template.HTML(cached)
+	} else {
+		tr.Rendered, err = tr.rwt.render(r, initialMarkdown, tr.Options.ParserOptions())
+		if errors.Is(err, errRenderBusy) {
+			renderBusy(w)
+			return err
+		} else if errors.Is(err, markdown.ErrRenderTimeout) {
+			log.Warnf("rendering %s/%s: %s", tr.Domain, f.ID, err)
+		} else if errors.Is(err, context.Canceled) {
+			// the client is gone, no one is left to answer
+			return nil
+		} else if err != nil {
+			return err
+		} else if cacheable {
+			if errSave := tr.rwt.fs.SaveRenderedHTML(f.ID, f.Modified, []byte(tr.Rendered)); errSave != nil {
+				log.Error(errSave)
+			}
+		}
 	}
+	tr.Rendered = tr.rwt.uploadCards(tr.Rendered)
 	if tr.Options.CSS != "" {
 		tr.CustomCSS = template.CSS(tr.Options.CSS)
 	}
 
+	if tr.Options.RelatedPages != "" && version == "" {
+		tr.SimilarFiles, err = tr.rwt.fs.GetRelated(f.ID, tr.Domain, relatedLength)
+		if err != nil {
+			log.Error(err)
+			err = nil
+		}
+	}
+
 	tr.IntroText = template.JS(introText)
 	tr.Rows = len(strings.Split(string(tr.Rendered), "\n")) + 1
 	tr.EditOnly = strings.TrimSpace(f.Data) == ""
@@ -634,27 +1396,62 @@ func (tr *TemplateRender) handleViewEdit(w http.ResponseWriter, r *http.Request)
 	// 	}
 	// }()
 
+	page := "viewedit.html"
+	if r.URL.Query().Get("embed") != "" {
+		// only the content, to be embedded elsewhere
+		page = "embed.html"
+		if r.URL.Query().Get("css") == "" {
+			tr.CustomCSS = ""
+		}
+		setFrameHeaders(w, tr.Options.EmbedOrigins)
+	}
+
 	w.Header().Set("Content-Encoding", "gzip")
 	w.Header().Set("Content-Type", "text/html")
 	gz := gzip.NewWriter(w)
 	defer gz.Close()
 
-	return tr.rwt.templates.ExecuteTemplate(gz, "viewedit.html", tr)
+	return tr.rwt.templates.ExecuteTemplate(gz, page, tr)
+}
+
+// setFrameHeaders only allows framing the response by the same origin and by
+// the space separated origins. The policy is added next to the one of the
+// page, if any, as browsers enforce both.
+func setFrameHeaders(w http.ResponseWriter, origins string) {
+	origins = strings.Join(strings.Fields(origins), " ")
+	if origins == "" {
+		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+		w.Header().Add("Content-Security-Policy", "frame-ancestors 'self'")
+		return
+	}
+	w.Header().Del("X-Frame-Options")
+	w.Header().Add("Content-Security-Policy", "frame-ancestors 'self' "+origins)
 }
 
 func (tr *TemplateRender) handleUploads(w http.ResponseWriter, r *http.Request, id string) (err error) {
+	if r.Method == http.MethodDelete {
+		return tr.handleDeleteUpload(w, r, id)
+	}
 	log.Debug("getting ", id)
-	name, data, _, err := tr.rwt.fs.GetBlob(id)
+	name, blob, size, err := tr.rwt.fs.GetBlobReader(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	defer blob.Close()
+	var data []byte
+	contentType := "text/plain"
 	log.Debug("ResizeOnRequest", tr.rwt.Config.ResizeOnRequest)
 	log.Debug("ResizeWidth", tr.rwt.Config.ResizeWidth)
 	log.Debug("name", name)
 	if tr.rwt.Config.ResizeWidth > 0 && tr.rwt.Config.ResizeOnRequest && (strings.Contains(strings.ToLower(name), ".jpg") || strings.Contains(strings.ToLower(name), ".jpeg")) {
 		// Get resized image
-		name, data, _, err = tr.rwt.fs.GetResizedImage(id)
+		format := tr.rwt.resizeFormat(r)
+		width := tr.rwt.resizeWidth(r)
+		variantID := tr.rwt.resizedID(id, format, width)
+		contentType = resizeFormats[format]
+		w.Header().Add("Vary", "Accept")
+		name, data, _, err = tr.rwt.fs.GetResizedImage(variantID)
 		if err != nil && err != sql.ErrNoRows {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
@@ -662,6 +1459,13 @@ func (tr *TemplateRender) handleUploads(w http.ResponseWriter, r *http.Request,
 
 		// Create if not exists
 		if err != nil && err == sql.ErrNoRows {
+			if tr.rwt.resizes != nil {
+				if ok, retryAfter := tr.rwt.resizes.allow(clientIP(r)); !ok {
+					w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+					http.Error(w, "too many resized images, try again later", http.StatusTooManyRequests)
+					return nil
+				}
+			}
 			log.Debug("resizing image ", id)
 
 			var bigImgBytes []byte
@@ -684,17 +1488,15 @@ func (tr *TemplateRender) handleUploads(w http.ResponseWriter, r *http.Request,
 				return err
 			}
 
-			img, err := jpeg.Decode(&buf)
+			img, err := resizeImage(&buf, width)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return err
 			}
 
-			img = imaging.Resize(img, tr.rwt.Config.ResizeWidth, 0, imaging.Lanczos)
-
 			var bufout bytes.Buffer
 			gw := gzip.NewWriter(&bufout)
-			err = jpeg.Encode(gw, img, nil)
+			err = tr.rwt.encodeResized(gw, img, format)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return err
@@ -705,7 +1507,7 @@ func (tr *TemplateRender) handleUploads(w http.ResponseWriter, r *http.Request,
 				return err
 			}
 
-			err = tr.rwt.fs.SaveResizedImage(id, name, bufout.Bytes())
+			err = tr.rwt.fs.SaveResizedImage(variantID, name, bufout.Bytes())
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return err
@@ -716,18 +1518,68 @@ func (tr *TemplateRender) handleUploads(w http.ResponseWriter, r *http.Request,
 
 	}
 
-	w.Header().Set("Vary", "Accept-Encoding")
+	w.Header().Add("Vary", "Accept-Encoding")
 	w.Header().Set("Cache-Control", "public, max-age=7776000")
 	w.Header().Set("Content-Encoding", "gzip")
-	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Type", contentType)
 	w.Header().Set("Content-Disposition",
 		`attachment; filename="`+name+`"`,
 	)
-	w.Write(data)
+	if data != nil {
+		w.Write(data)
+		return
+	}
+	// stream the upload rather than holding all of it in memory
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	_, err = io.Copy(w, blob)
+	return
+}
+
+// handleDeleteUpload deletes an upload of a domain the user is signed in to,
+// given by the domain parameter like for uploading.
+func (tr *TemplateRender) handleDeleteUpload(w http.ResponseWriter, r *http.Request, id string) (err error) {
+	domain := r.URL.Query().Get("domain")
+	signedIn := false
+	for _, domainName := range tr.DomainList {
+		if domain == domainName {
+			signedIn = true
+			break
+		}
+	}
+	if !signedIn || tr.rwt.isDefaultDomain(domain) {
+		http.Error(w, "need to be logged in", http.StatusForbidden)
+		return
+	}
+
+	info, err := tr.rwt.fs.GetBlobInfo(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return nil
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if info.Domain != domain {
+		http.Error(w, "upload belongs to another domain", http.StatusForbidden)
+		return
+	}
+	err = tr.rwt.fs.DeleteBlob(id)
+	if errors.Is(err, db.ErrBlobNotFound) {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return nil
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tr.rwt.usage.forget(domain)
+	w.WriteHeader(http.StatusNoContent)
 	return
 }
 
 func (tr *TemplateRender) handleUpload(w http.ResponseWriter, r *http.Request) (err error) {
+	if !tr.checkCSRF(w, r) {
+		return
+	}
 	domain := r.URL.Query().Get("domain")
 	// special check for sign in
 	for _, domainName := range tr.DomainList {
@@ -736,32 +1588,82 @@ func (tr *TemplateRender) handleUpload(w http.ResponseWriter, r *http.Request) (
 			break
 		}
 	}
-	if !tr.SignedIn || domain == "public" {
+	if !tr.SignedIn || tr.rwt.isDefaultDomain(domain) {
 		log.Debugf("got domain: %s, signed in: %+v", domain, tr)
 		log.Debugf("refusing to upload")
 		http.Error(w, "need to be logged in", http.StatusForbidden)
 		return
 	}
 
+	// refuse large uploads before reading them, allowing for the rest of the
+	// multipart form
+	maxBytes := tr.rwt.Config.MaxUploadBytes
+	tooLarge := "files larger than " + formatSize(int(maxBytes)) + " can't be uploaded"
+	if r.ContentLength > maxBytes+1<<20 {
+		http.Error(w, tooLarge, http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes+1<<20)
 	file, info, err := r.FormFile("file")
-	if err != nil {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, tooLarge, http.StatusRequestEntityTooLarge)
+		return nil
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	defer file.Close()
+	if info.Size > maxBytes {
+		http.Error(w, tooLarge, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// check the sniffed type, the one declared by the client can't be trusted
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	contentType := http.DetectContentType(head[:n])
+	_, _, options, _, _ := tr.rwt.fs.GetDomainFromName(domain)
+	if !tr.rwt.uploadTypeAllowed(contentType, options) {
+		http.Error(w, contentType+" files are not allowed", http.StatusUnsupportedMediaType)
+		return nil
+	}
+
+	// throttle before decoding and resizing, which are expensive, but not
+	// uploads refused anyway
+	if ok, retryAfter := tr.rwt.allowUpload(r, domain); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		http.Error(w, "too many uploads, try again later", http.StatusTooManyRequests)
+		return
+	}
+	var qe *quotaError
+	if err = tr.rwt.checkQuota(domain, false, info.Size); errors.As(err, &qe) {
+		writeQuotaError(w, qe)
+		return nil
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	if tr.rwt.Config.ResizeWidth > 0 && tr.rwt.Config.ResizeOnUpload && (strings.Contains(strings.ToLower(info.Filename), ".jpg") || strings.Contains(strings.ToLower(info.Filename), ".jpeg")) {
 		log.Debug("process jpg upload")
-		img, err := jpeg.Decode(file)
+		img, err := resizeImage(file, tr.rwt.Config.ResizeWidth)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return err
 		}
 
-		img = imaging.Resize(img, tr.rwt.Config.ResizeWidth, 0, imaging.Lanczos)
-
 		var bufout bytes.Buffer
-		err = jpeg.Encode(&bufout, img, nil)
+		err = tr.rwt.encodeResized(&bufout, img, DefaultResizeFormat)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return err
@@ -784,8 +1686,12 @@ func (tr *TemplateRender) handleUpload(w http.ResponseWriter, r *http.Request) (
 			return err
 		}
 
-		err = tr.rwt.fs.SaveBlob(id, info.Filename, fileData.Bytes())
-		if err != nil {
+		err = tr.rwt.fs.SaveBlob(id, domain, info.Filename, "image/jpeg", bufout.Len(), fileData.Bytes())
+		var blobErr *db.BlobTooLargeError
+		if errors.As(err, &blobErr) {
+			http.Error(w, tooLarge, http.StatusRequestEntityTooLarge)
+			return nil
+		} else if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return err
 		}
@@ -818,8 +1724,12 @@ func (tr *TemplateRender) handleUpload(w http.ResponseWriter, r *http.Request) (
 		}
 
 		// save file
-		err = tr.rwt.fs.SaveBlob(id, info.Filename, fileData.Bytes())
-		if err != nil {
+		err = tr.rwt.fs.SaveBlob(id, domain, info.Filename, contentType, len(b), fileData.Bytes())
+		var blobErr *db.BlobTooLargeError
+		if errors.As(err, &blobErr) {
+			http.Error(w, tooLarge, http.StatusRequestEntityTooLarge)
+			return nil
+		} else if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return err
 		}
@@ -832,15 +1742,15 @@ func (tr *TemplateRender) handleUpload(w http.ResponseWriter, r *http.Request) (
 
 func (tr *TemplateRender) handleExport(w http.ResponseWriter, r *http.Request) (err error) {
 	log.Debug("exporting")
-	if tr.Domain == "public" {
-		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("cannot export public")), 302)
+	if tr.InDefaultDomain() {
+		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("cannot export "+tr.Domain)), 302)
 		return
 	}
 	if !tr.SignedIn {
 		http.Redirect(w, r, "/"+tr.Domain+"?m="+base64.URLEncoding.EncodeToString([]byte("must sign in")), 302)
 		return
 	}
-	files, _ := tr.rwt.fs.GetAll(tr.Domain, tr.RWTxtConfig.OrderByCreated)
+	files, _ := tr.rwt.fs.GetAllFiltered(tr.Domain, true, tr.RWTxtConfig.OrderByCreated)
 	for i := range files {
 		files[i].DataHTML = template.HTML("")
 	}
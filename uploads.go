@@ -0,0 +1,69 @@
+package rwtxt
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"regexp"
+	"strings"
+)
+
+// uploadImage matches the images rendered for uploads, capturing the id of the
+// upload.
+var uploadImage = regexp.MustCompile(`<img src="/uploads/([^"?]+)[^"]*"[^>]*>`)
+
+// uploadIcons are the icons of non-image uploads by MIME type, or by the
+// prefix before the slash.
+var uploadIcons = map[string]string{
+	"application/pdf":              "pdf",
+	"application/zip":              "archive",
+	"application/gzip":             "archive",
+	"application/x-gzip":           "archive",
+	"application/x-rar-compressed": "archive",
+	"application/x-7z-compressed":  "archive",
+	"text":                         "text",
+	"audio":                        "audio",
+	"video":                        "video",
+}
+
+// uploadCards replaces the images of uploads which aren't images, and so would
+// show up broken, with download cards.
+func (rwt *RWTxt) uploadCards(rendered template.HTML) template.HTML {
+	return template.HTML(uploadImage.ReplaceAllStringFunc(string(rendered), func(img string) string {
+		id := html.UnescapeString(uploadImage.FindStringSubmatch(img)[1])
+		info, err := rwt.fs.GetBlobInfo(id)
+		if err != nil || info.MimeType == "" || strings.HasPrefix(info.MimeType, "image/") {
+			return img
+		}
+		return fmt.Sprintf(`<a class="upload" href="/uploads/%s?filename=%s" download="%s"><img src="/static/img/filetypes/%s.svg" alt=""><span>%s</span> <small>%s</small></a>`,
+			html.EscapeString(info.ID), html.EscapeString(template.URLQueryEscaper(info.Name)), html.EscapeString(info.Name),
+			uploadIcon(info.MimeType), html.EscapeString(info.Name), formatSize(info.Size))
+	}))
+}
+
+// uploadIcon returns the name of the icon of a MIME type.
+func uploadIcon(mimetype string) string {
+	mediaType, _, _ := strings.Cut(mimetype, ";")
+	if icon, ok := uploadIcons[mediaType]; ok {
+		return icon
+	}
+	kind, _, _ := strings.Cut(mediaType, "/")
+	if icon, ok := uploadIcons[kind]; ok {
+		return icon
+	}
+	return "file"
+}
+
+// formatSize returns the size in bytes in a human readable form.
+func formatSize(size int) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := unit, 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "kMGTPE"[exp])
+}
@@ -0,0 +1,43 @@
+package rwtxt
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// BuildInfo identifies the build of rwtxt which is running.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	Revision  string `json:"revision,omitempty"`
+	Modified  bool   `json:"modified,omitempty"` // built with uncommitted changes.
+}
+
+// buildInfo returns the build of rwtxt, with the configured version, or the
+// version of the module if it wasn't set when building.
+func (rwt *RWTxt) buildInfo() (info BuildInfo) {
+	info.Version = rwt.Config.Version
+	info.GoVersion = runtime.Version()
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	if info.Version == "" {
+		info.Version = bi.Main.Version
+	}
+	for _, setting := range bi.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Revision = setting.Value
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	return
+}
+
+// handleVersion serves the build of rwtxt, to check what is deployed.
+func (rwt *RWTxt) handleVersion(w http.ResponseWriter, r *http.Request) (err error) {
+	return writeAPIJSON(w, http.StatusOK, rwt.buildInfo())
+}
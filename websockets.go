@@ -0,0 +1,76 @@
+package rwtxt
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// websockets keeps the open websockets, which are hijacked from the server so
+// its Shutdown doesn't wait for them.
+type websockets struct {
+	sync.Mutex
+	conns  map[*websocket.Conn]bool
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newWebsockets() *websockets {
+	return &websockets{conns: make(map[*websocket.Conn]bool)}
+}
+
+// add keeps c until remove is called, returning false if closeAll was called.
+func (ws *websockets) add(c *websocket.Conn) bool {
+	ws.Lock()
+	defer ws.Unlock()
+	if ws.closed {
+		return false
+	}
+	ws.conns[c] = true
+	ws.wg.Add(1)
+	return true
+}
+
+// remove is called when the handler of c is done with it.
+func (ws *websockets) remove(c *websocket.Conn) {
+	ws.Lock()
+	defer ws.Unlock()
+	delete(ws.conns, c)
+	ws.wg.Done()
+}
+
+// closeAll closes the websockets and waits for their handlers to return, or
+// for ctx to be done.
+func (ws *websockets) closeAll(ctx context.Context) error {
+	ws.Lock()
+	ws.closed = true
+	conns := make([]*websocket.Conn, 0, len(ws.conns))
+	for c := range ws.conns {
+		conns = append(conns, c)
+	}
+	ws.Unlock()
+
+	// each close waits up to a second for a slow client, so they are closed
+	// together and without the lock, which remove needs
+	for _, c := range conns {
+		go func(c *websocket.Conn) {
+			c.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), time.Now().Add(time.Second))
+			c.Close()
+		}(c)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ws.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
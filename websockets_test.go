@@ -0,0 +1,71 @@
+package rwtxt
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebsocketsCloseAll(t *testing.T) {
+	ws := newWebsockets()
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		if !ws.add(c) {
+			c.Close()
+			return
+		}
+		defer ws.remove(c)
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	clients := make([]*websocket.Conn, 3)
+	for i := range clients {
+		c, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		clients[i] = c
+	}
+	// wait for the handlers to add them
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		ws.Lock()
+		n := len(ws.conns)
+		ws.Unlock()
+		if n == len(clients) {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("%d websockets added, want %d", n, len(clients))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ws.closeAll(ctx); err != nil {
+		t.Fatalf("closeAll = %v", err)
+	}
+	for i, c := range clients {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := c.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Errorf("client %d read %v, want going away", i, err)
+		}
+	}
+	if ws.add(nil) {
+		t.Error("added a websocket after closeAll")
+	}
+}